@@ -0,0 +1,83 @@
+// Copyright (C) 2026 Toit contributors.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"context"
+	"fmt"
+)
+
+// The version of the protocol between jag and devices that this jag speaks.
+// Devices announce their version and features in their identity. Firmware
+// from before protocol versions doesn't announce anything and is treated as
+// version 0, without features.
+const protocolVersion = 1
+
+// Features that devices or proxies may announce.
+// Features are only introduced together with a protocol version, so that
+// jag can rely on their absence.
+const (
+	// The device accepts several unacknowledged chunks when streaming over
+	// UART.
+	featureUartWindow = "uart-window"
+	// The device supports UART packets with a CRC.
+	featureUartCrc = "uart-crc"
+	// The device accepts data that it drops, for benchmarking the UART.
+	featureUartDiscard = "uart-discard"
+	// The proxy reports packet statistics on its '/uart-stats' path.
+	featureUartStats = "uart-stats"
+	// The proxy reports the progress of uploads to the device when asked
+	// with the X-Jaguar-Progress header.
+	featureProgress = "progress"
+	// The device passes the arguments in the X-Jaguar-Arguments header, or
+	// the 'jag.arguments' define over UART, to the programs it starts.
+	featureArguments = "arguments"
+)
+
+// deviceCapabilities describes the protocol version and features of a
+// device.
+type deviceCapabilities struct {
+	ProtocolVersion int      `json:"protocolVersion"`
+	Features        []string `json:"features"`
+}
+
+// Has returns whether the feature is supported.
+func (c deviceCapabilities) Has(feature string) bool {
+	for _, f := range c.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// FirmwareTooOldError is returned when a device lacks a feature.
+type FirmwareTooOldError struct {
+	Device  string
+	Feature string
+}
+
+func (e *FirmwareTooOldError) Error() string {
+	return fmt.Sprintf("device firmware too old for this feature: '%s' doesn't support '%s'; update it with 'jag firmware update'", e.Device, e.Feature)
+}
+
+// requireFeature returns a FirmwareTooOldError if the device doesn't support
+// the feature.
+// Devices are often remembered from an earlier scan, so the device is
+// identified again before giving up, in case its firmware was updated in
+// the meantime.
+func requireFeature(ctx context.Context, d Device, feature string) error {
+	if d.HasFeature(feature) {
+		return nil
+	}
+	if d.Address() != "" {
+		if identified, err := Identify(ctx, deviceAddressSelect(d.Address())); err == nil && len(identified) == 1 {
+			if identified[0].HasFeature(feature) {
+				return nil
+			}
+		}
+	}
+	return &FirmwareTooOldError{Device: d.Name(), Feature: feature}
+}
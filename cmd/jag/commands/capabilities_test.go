@@ -0,0 +1,44 @@
+// Copyright (C) 2026 Toit contributors.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestDeviceCapabilities(t *testing.T) {
+	// Devices are stored through viper, which lowercases the keys.
+	device, err := NewDeviceNetworkFromJson(map[string]interface{}{
+		"name":            "dev",
+		"protocolversion": float64(1),
+		"features":        []interface{}{featureUartStats},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.ProtocolVersion() != 1 || !device.HasFeature(featureUartStats) || device.HasFeature(featureUartCrc) {
+		t.Errorf("got version %d and features %v", device.ProtocolVersion(), device.Features())
+	}
+	if err := requireFeature(context.Background(), device, featureUartStats); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	var tooOld *FirmwareTooOldError
+	err = requireFeature(context.Background(), device, featureUartCrc)
+	if !errors.As(err, &tooOld) || tooOld.Feature != featureUartCrc {
+		t.Errorf("got %v, want a FirmwareTooOldError", err)
+	}
+
+	// Firmware without protocol version has no features.
+	old, err := NewDeviceNetworkFromJson(map[string]interface{}{"name": "old"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old.ProtocolVersion() != 0 || len(old.Features()) != 0 {
+		t.Errorf("got version %d and features %v", old.ProtocolVersion(), old.Features())
+	}
+}
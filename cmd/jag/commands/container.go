@@ -75,7 +75,7 @@ func ContainerListCmd() *cobra.Command {
 
 func ContainerInstallCmd() *cobra.Command {
 	cmd := &cobra.Command{
-		Use: "install <name> <file>",
+		Use: "install <name> <file> [-- <arguments>...]",
 		Long: "Install a container on a device.\n" +
 			"Installed containers run when they are installed, and on boot.\n" +
 			"\n" +
@@ -89,8 +89,10 @@ func ContainerInstallCmd() *cobra.Command {
 			"     UART-only mode.\n" +
 			"	'-D jag.interval' (or --interval):Interval for container starts\n" +
 			"     (e.g., '30s', '5m', '1h'). When specified, Jaguar will start the\n" +
-			"     container at the specified interval if it has previously exited.",
-		Args: cobra.ExactArgs(2),
+			"     container at the specified interval if it has previously exited.\n" +
+			"\n" +
+			"Arguments after the file are passed to 'main' whenever the container starts.",
+		Args: cobra.MinimumNArgs(2),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			ctx := cmd.Context()
 
@@ -157,6 +159,8 @@ func ContainerInstallCmd() *cobra.Command {
 				}
 			}
 
+			defines = withArguments(defines, args[2:])
+
 			return InstallFile(cmd, device, sdk, name, entrypoint, defines, programAssetsPath, optimizationLevel)
 		},
 	}
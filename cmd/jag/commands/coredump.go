@@ -0,0 +1,714 @@
+// Copyright (C) 2026 Toit contributors.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"debug/dwarf"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// The ESP-IDF stores core dumps in a data partition with this subtype.
+const (
+	partitionTableOffset     = 0x8000
+	partitionTableSize       = 0xc00
+	partitionTypeData        = 0x01
+	partitionSubtypeCoredump = 0x03
+)
+
+// Note types that the ESP-IDF uses in the ELF core dump.
+const (
+	notePrStatus      = 1
+	noteEspInfo       = 8266
+	noteEspExtraInfo  = 677
+	prStatusRegsStart = 72
+	prStatusPidOffset = 24
+
+	// With the default FreeRTOS configuration of the ESP-IDF the task name is
+	// stored at this offset of the task control block.
+	tcbNameOffset = 52
+	tcbNameLength = 16
+
+	maxBacktraceDepth = 64
+)
+
+func CoredumpCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "coredump [file]",
+		Short: "Read and analyze the core dump of a crashed ESP32",
+		Long: "Read and analyze the core dump of a crashed ESP32.\n" +
+			"When the native code of a device crashes, the ESP-IDF writes a core dump into\n" +
+			"the 'coredump' partition of the flash. This command reads that partition over\n" +
+			"serial (using the esptool), and prints the registers and stacks of all tasks\n" +
+			"symbolically, using the ELF file of the firmware envelope.\n" +
+			"\n" +
+			"If a file is given, the core dump is read from that file instead. The file can\n" +
+			"either be the raw content of the core dump partition, or the ELF core dump.",
+		Args:         cobra.MaximumNArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			envelope, err := cmd.Flags().GetString("envelope")
+			if err != nil {
+				return err
+			}
+
+			output, err := cmd.Flags().GetString("output")
+			if err != nil {
+				return err
+			}
+
+			sdk, err := GetSDK(ctx)
+			if err != nil {
+				return err
+			}
+
+			var data []byte
+			if len(args) == 1 {
+				data, err = os.ReadFile(args[0])
+				if err != nil {
+					return err
+				}
+			} else {
+				port, err := cmd.Flags().GetString("port")
+				if err != nil {
+					return err
+				}
+				shouldSkipPortCheck, err := cmd.Flags().GetBool("skip-port-check")
+				if err != nil {
+					return err
+				}
+				if !shouldSkipPortCheck {
+					if port, err = checkPort(port, cmd.Flags().Changed("port")); err != nil {
+						return err
+					}
+				}
+				baud, err := cmd.Flags().GetUint("baud")
+				if err != nil {
+					return err
+				}
+				fmt.Printf("Reading core dump over serial on port '%s' ...\n", port)
+				data, err = readCoredumpPartition(ctx, sdk, port, baud)
+				if err != nil {
+					return err
+				}
+			}
+
+			if output != "" {
+				if err := os.WriteFile(output, data, 0644); err != nil {
+					return err
+				}
+				fmt.Printf("Wrote core dump to '%s'\n", output)
+			}
+
+			dump, err := parseCoredump(data)
+			if err != nil {
+				return err
+			}
+
+			firmwareElf, err := extractFirmwareElf(ctx, sdk, envelope)
+			if err != nil {
+				return err
+			}
+			defer os.Remove(firmwareElf.Name())
+			defer firmwareElf.Close()
+
+			symbols, err := newSymbolizer(firmwareElf.Name())
+			if err != nil {
+				return fmt.Errorf("failed to load firmware ELF: %w", err)
+			}
+			defer symbols.Close()
+
+			dump.print(symbols)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringP("port", "p", ConfiguredPort(), "serial port to read the core dump from")
+	cmd.Flags().Uint("baud", 921600, "baud rate used for reading the flash")
+	cmd.Flags().Bool("skip-port-check", false, "accept the given port without checking")
+	cmd.Flags().String("envelope", "", "name or path of the firmware envelope")
+	cmd.Flags().StringP("output", "o", "", "also write the raw core dump to a file")
+	return cmd
+}
+
+// readCoredumpPartition reads the partition table of the device and then the
+// content of the core dump partition.
+func readCoredumpPartition(ctx context.Context, sdk *SDK, port string, baud uint) ([]byte, error) {
+	table, err := readFlash(ctx, sdk, port, baud, partitionTableOffset, partitionTableSize)
+	if err != nil {
+		return nil, err
+	}
+	offset, size, err := findCoredumpPartition(table)
+	if err != nil {
+		return nil, err
+	}
+	return readFlash(ctx, sdk, port, baud, offset, size)
+}
+
+func readFlash(ctx context.Context, sdk *SDK, port string, baud uint, offset uint32, size uint32) ([]byte, error) {
+	tmpDir, err := os.MkdirTemp("", "jag_coredump")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "flash.bin")
+	cmd, err := sdk.EspTool(ctx,
+		"--port", esptoolPort(port),
+		"--baud", strconv.Itoa(int(baud)),
+		"read_flash",
+		fmt.Sprintf("0x%x", offset),
+		fmt.Sprintf("0x%x", size),
+		path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve esptool command: %w", err)
+	}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read flash: %w: %s", err, string(output))
+	}
+	return os.ReadFile(path)
+}
+
+// findCoredumpPartition returns the offset and size of the core dump
+// partition in the given binary partition table.
+func findCoredumpPartition(table []byte) (uint32, uint32, error) {
+	const entrySize = 32
+	for pos := 0; pos+entrySize <= len(table); pos += entrySize {
+		entry := table[pos : pos+entrySize]
+		if entry[0] != 0xaa || entry[1] != 0x50 {
+			// Either the end of the table, or the MD5 checksum entry.
+			break
+		}
+		if entry[2] == partitionTypeData && entry[3] == partitionSubtypeCoredump {
+			offset := binary.LittleEndian.Uint32(entry[4:8])
+			size := binary.LittleEndian.Uint32(entry[8:12])
+			return offset, size, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("the partition table of the device doesn't have a core dump partition")
+}
+
+type coredumpTask struct {
+	tcb  uint32
+	name string
+	regs []uint32
+}
+
+type coredumpSegment struct {
+	address uint32
+	data    []byte
+}
+
+type coredump struct {
+	machine      elf.Machine
+	tasks        []coredumpTask
+	segments     []coredumpSegment
+	crashedTcb   uint32
+	hasCrashed   bool
+	extraInfo    [][2]uint32
+	checksumGood bool
+}
+
+// parseCoredump parses the content of a core dump partition, or a plain ELF
+// core dump.
+func parseCoredump(data []byte) (*coredump, error) {
+	elfData := data
+	checksumGood := true
+	if !bytes.HasPrefix(data, []byte(elf.ELFMAG)) {
+		if len(data) < 8 || binary.LittleEndian.Uint32(data[0:4]) == 0xffffffff {
+			return nil, fmt.Errorf("no core dump found; the core dump partition is empty")
+		}
+		length := int(binary.LittleEndian.Uint32(data[0:4]))
+		version := binary.LittleEndian.Uint32(data[4:8]) & 0xffff
+		if version>>8 != 1 {
+			return nil, fmt.Errorf("unsupported core dump format (version 0x%x); only ELF core dumps are supported", version)
+		}
+		if length > len(data) || length < 8 {
+			return nil, fmt.Errorf("invalid core dump: length %d doesn't fit into %d bytes", length, len(data))
+		}
+		// The header size differs between versions of the ESP-IDF, so we
+		// simply look for the start of the ELF file.
+		start := bytes.Index(data[:min(length, 64)], []byte(elf.ELFMAG))
+		if start < 0 {
+			return nil, fmt.Errorf("invalid core dump: no ELF data found")
+		}
+		// Even minor versions use CRC32 checksums, odd ones SHA256.
+		checksumSize := 4
+		if version&1 == 1 {
+			checksumSize = sha256.Size
+		}
+		if length-checksumSize < start {
+			return nil, fmt.Errorf("invalid core dump: too short")
+		}
+		checksumGood = verifyCoredumpChecksum(data[:length-checksumSize], data[length-checksumSize:length])
+		elfData = data[start : length-checksumSize]
+	}
+
+	file, err := elf.NewFile(bytes.NewReader(elfData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the core dump as ELF file: %w", err)
+	}
+	if file.Type != elf.ET_CORE {
+		return nil, fmt.Errorf("the ELF file is not a core dump")
+	}
+
+	result := &coredump{
+		machine:      file.Machine,
+		checksumGood: checksumGood,
+	}
+
+	for _, prog := range file.Progs {
+		content := make([]byte, prog.Filesz)
+		if _, err := prog.ReadAt(content, 0); err != nil {
+			return nil, fmt.Errorf("failed to read core dump segment: %w", err)
+		}
+		switch prog.Type {
+		case elf.PT_LOAD:
+			result.segments = append(result.segments, coredumpSegment{
+				address: uint32(prog.Vaddr),
+				data:    content,
+			})
+		case elf.PT_NOTE:
+			if err := result.parseNotes(content); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for i := range result.tasks {
+		result.tasks[i].name = result.taskName(result.tasks[i].tcb)
+	}
+	return result, nil
+}
+
+func verifyCoredumpChecksum(data []byte, checksum []byte) bool {
+	if len(checksum) == 4 {
+		return crc32.ChecksumIEEE(data) == binary.LittleEndian.Uint32(checksum)
+	}
+	sum := sha256.Sum256(data)
+	return bytes.Equal(sum[:], checksum)
+}
+
+func (c *coredump) parseNotes(notes []byte) error {
+	align := func(n int) int { return (n + 3) &^ 3 }
+	for pos := 0; pos+12 <= len(notes); {
+		nameSize := int(binary.LittleEndian.Uint32(notes[pos:]))
+		descSize := int(binary.LittleEndian.Uint32(notes[pos+4:]))
+		noteType := binary.LittleEndian.Uint32(notes[pos+8:])
+		pos += 12
+		if pos+align(nameSize)+descSize > len(notes) {
+			return fmt.Errorf("invalid core dump: truncated note")
+		}
+		name := strings.TrimRight(string(notes[pos:pos+nameSize]), "\x00")
+		pos += align(nameSize)
+		desc := notes[pos : pos+descSize]
+		pos += align(descSize)
+
+		switch {
+		case name == "CORE" && noteType == notePrStatus:
+			if len(desc) < prStatusRegsStart {
+				return fmt.Errorf("invalid core dump: truncated task status")
+			}
+			task := coredumpTask{
+				tcb: binary.LittleEndian.Uint32(desc[prStatusPidOffset:]),
+			}
+			for i := prStatusRegsStart; i+4 <= len(desc); i += 4 {
+				task.regs = append(task.regs, binary.LittleEndian.Uint32(desc[i:]))
+			}
+			c.tasks = append(c.tasks, task)
+		case name == "EXTRA_INFO" && noteType == noteEspExtraInfo:
+			if len(desc) >= 4 {
+				c.crashedTcb = binary.LittleEndian.Uint32(desc)
+				c.hasCrashed = true
+				for i := 4; i+8 <= len(desc); i += 8 {
+					c.extraInfo = append(c.extraInfo, [2]uint32{
+						binary.LittleEndian.Uint32(desc[i:]),
+						binary.LittleEndian.Uint32(desc[i+4:]),
+					})
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// read32 reads a word from the memory that was saved in the core dump.
+func (c *coredump) read32(address uint32) (uint32, bool) {
+	data, ok := c.read(address, 4)
+	if !ok {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(data), true
+}
+
+func (c *coredump) read(address uint32, size uint32) ([]byte, bool) {
+	for _, segment := range c.segments {
+		if address >= segment.address && uint64(address)+uint64(size) <= uint64(segment.address)+uint64(len(segment.data)) {
+			offset := address - segment.address
+			return segment.data[offset : offset+size], true
+		}
+	}
+	return nil, false
+}
+
+func (c *coredump) taskName(tcb uint32) string {
+	data, ok := c.read(tcb+tcbNameOffset, tcbNameLength)
+	if !ok {
+		return ""
+	}
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		data = data[:i]
+	}
+	for _, b := range data {
+		if b < 0x20 || b > 0x7e {
+			return ""
+		}
+	}
+	return string(data)
+}
+
+func (c *coredump) isXtensa() bool {
+	return c.machine == elf.EM_XTENSA
+}
+
+// registerNames returns the names of the registers in the order they are
+// stored in the task status.
+func (c *coredump) registerNames() []string {
+	if c.isXtensa() {
+		// The Xtensa register dump starts with the special registers, followed
+		// by 56 reserved words and the address registers of the current window.
+		names := make([]string, 64+16)
+		copy(names, []string{"pc", "ps", "lbeg", "lend", "lcount", "sar", "windowstart", "windowbase"})
+		for i := 0; i < 16; i++ {
+			names[64+i] = "a" + strconv.Itoa(i)
+		}
+		return names
+	}
+	return []string{
+		"pc", "ra", "sp", "gp", "tp", "t0", "t1", "t2",
+		"s0", "s1", "a0", "a1", "a2", "a3", "a4", "a5",
+		"a6", "a7", "s2", "s3", "s4", "s5", "s6", "s7",
+		"s8", "s9", "s10", "s11", "t3", "t4", "t5", "t6",
+	}
+}
+
+func (c *coredump) register(task coredumpTask, name string) uint32 {
+	for i, n := range c.registerNames() {
+		if n == name && i < len(task.regs) {
+			return task.regs[i]
+		}
+	}
+	return 0
+}
+
+// backtrace returns the program counters of the call stack of the given task.
+//
+// On Xtensa chips the windowed ABI lets us walk the stack precisely: the
+// return address and stack pointer of the caller are stored in the base save
+// area just below the stack pointer of each frame. On RISC-V chips there are
+// no frame pointers, and we fall back to scanning the stack for words that
+// look like return addresses. The returned boolean is true if the backtrace
+// is exact.
+func (c *coredump) backtrace(task coredumpTask, isCode func(uint32) bool) ([]uint32, bool) {
+	pc := c.register(task, "pc")
+	if c.isXtensa() {
+		sp := c.register(task, "a1")
+		nextPC := c.register(task, "a0")
+		result := []uint32{pc}
+		for len(result) < maxBacktraceDepth && nextPC != 0 {
+			pc = xtensaCallAddress(nextPC)
+			var ok bool
+			if nextPC, ok = c.read32(sp - 16); !ok {
+				break
+			}
+			if sp, ok = c.read32(sp - 12); !ok {
+				break
+			}
+			if !isCode(pc) {
+				break
+			}
+			result = append(result, pc)
+		}
+		return result, true
+	}
+
+	result := []uint32{pc}
+	if ra := c.register(task, "ra"); isCode(ra) {
+		result = append(result, ra)
+	}
+	sp := c.register(task, "sp")
+	for address := sp; len(result) < maxBacktraceDepth; address += 4 {
+		word, ok := c.read32(address)
+		if !ok {
+			break
+		}
+		if isCode(word) {
+			result = append(result, word)
+		}
+	}
+	return result, false
+}
+
+// xtensaCallAddress converts a return address (with the window increment in
+// its top bits) into the address of the call instruction.
+func xtensaCallAddress(pc uint32) uint32 {
+	if pc&0x80000000 != 0 {
+		pc = (pc & 0x3fffffff) | 0x40000000
+	}
+	return pc - 3
+}
+
+var xtensaExceptionCauses = map[uint32]string{
+	0:  "IllegalInstruction",
+	2:  "InstructionFetchError",
+	3:  "LoadStoreError",
+	6:  "IntegerDivideByZero",
+	9:  "LoadStoreAlignment",
+	12: "InstrPIFDataError",
+	13: "LoadStorePIFDataError",
+	14: "InstrPIFAddrError",
+	15: "LoadStorePIFAddrError",
+	20: "InstFetchProhibited",
+	28: "LoadProhibited",
+	29: "StoreProhibited",
+}
+
+var riscvExceptionCauses = map[uint32]string{
+	0: "Instruction address misaligned",
+	1: "Instruction access fault",
+	2: "Illegal instruction",
+	3: "Breakpoint",
+	4: "Load address misaligned",
+	5: "Load access fault",
+	6: "Store address misaligned",
+	7: "Store access fault",
+}
+
+func (c *coredump) extraInfoName(register uint32) string {
+	if c.isXtensa() {
+		switch register {
+		case 232:
+			return "exccause"
+		case 238:
+			return "excvaddr"
+		}
+		if register >= 177 && register <= 183 {
+			return "epc" + strconv.Itoa(int(register-176))
+		}
+		if register >= 194 && register <= 199 {
+			return "eps" + strconv.Itoa(int(register-192))
+		}
+	} else {
+		switch register {
+		case 0x300:
+			return "mstatus"
+		case 0x305:
+			return "mtvec"
+		case 0x342:
+			return "mcause"
+		case 0x343:
+			return "mtval"
+		case 0xf14:
+			return "mhartid"
+		}
+	}
+	return fmt.Sprintf("reg%d", register)
+}
+
+func (c *coredump) print(symbols *symbolizer) {
+	separator := strings.Repeat("*", 78)
+	fmt.Println(separator)
+	fmt.Printf("Core dump with %d task(s)\n", len(c.tasks))
+	if !c.checksumGood {
+		fmt.Println("Warning: the checksum of the core dump doesn't match; it may be corrupted.")
+	}
+	for _, info := range c.extraInfo {
+		name := c.extraInfoName(info[0])
+		description := ""
+		if name == "exccause" {
+			description = " (" + xtensaExceptionCauses[info[1]] + ")"
+		} else if name == "mcause" {
+			description = " (" + riscvExceptionCauses[info[1]] + ")"
+		}
+		fmt.Printf("%-10s 0x%08x%s\n", name, info[1], strings.TrimSuffix(description, " ()"))
+	}
+	fmt.Println(separator)
+
+	// Print the crashed task first.
+	tasks := append([]coredumpTask{}, c.tasks...)
+	sort.SliceStable(tasks, func(i, j int) bool {
+		return c.hasCrashed && tasks[i].tcb == c.crashedTcb && tasks[j].tcb != c.crashedTcb
+	})
+
+	for _, task := range tasks {
+		name := task.name
+		if name == "" {
+			name = "<unknown>"
+		}
+		state := ""
+		if c.hasCrashed && task.tcb == c.crashedTcb {
+			state = " - crashed"
+		}
+		fmt.Printf("\nTask '%s' (tcb 0x%08x)%s\n", name, task.tcb, state)
+
+		fmt.Println("Registers:")
+		for i, register := range c.registerNames() {
+			if register == "" || i >= len(task.regs) {
+				continue
+			}
+			value := task.regs[i]
+			description := ""
+			if register == "pc" || register == "ra" || (c.isXtensa() && register == "a0") {
+				address := value
+				if c.isXtensa() && register == "a0" {
+					address = xtensaCallAddress(value)
+				}
+				if symbols.isCode(address) {
+					description = "  " + symbols.describe(address)
+				}
+			}
+			fmt.Printf("  %-11s 0x%08x%s\n", register, value, description)
+		}
+
+		frames, exact := c.backtrace(task, symbols.isCode)
+		if exact {
+			fmt.Println("Backtrace:")
+		} else {
+			fmt.Println("Backtrace (heuristic, from scanning the stack):")
+		}
+		for i, pc := range frames {
+			fmt.Printf("  #%-2d 0x%08x in %s\n", i, pc, symbols.describe(pc))
+		}
+	}
+}
+
+// symbolizer maps addresses to functions and source lines of an ELF file.
+type symbolizer struct {
+	file    *elf.File
+	symbols []elf.Symbol
+	code    []*elf.Section
+	dwarf   *dwarf.Data
+	units   []*dwarf.Entry
+}
+
+func newSymbolizer(path string) (*symbolizer, error) {
+	file, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	result := &symbolizer{file: file}
+
+	symbols, _ := file.Symbols()
+	for _, symbol := range symbols {
+		if elf.ST_TYPE(symbol.Info) == elf.STT_FUNC && symbol.Value != 0 {
+			result.symbols = append(result.symbols, symbol)
+		}
+	}
+	sort.Slice(result.symbols, func(i, j int) bool {
+		return result.symbols[i].Value < result.symbols[j].Value
+	})
+
+	for _, section := range file.Sections {
+		if section.Flags&elf.SHF_EXECINSTR != 0 && section.Addr != 0 {
+			result.code = append(result.code, section)
+		}
+	}
+
+	if data, err := file.DWARF(); err == nil {
+		result.dwarf = data
+		reader := data.Reader()
+		for {
+			entry, err := reader.Next()
+			if err != nil || entry == nil {
+				break
+			}
+			if entry.Tag == dwarf.TagCompileUnit {
+				result.units = append(result.units, entry)
+			}
+			reader.SkipChildren()
+		}
+	}
+	return result, nil
+}
+
+func (s *symbolizer) Close() error {
+	return s.file.Close()
+}
+
+func (s *symbolizer) isCode(address uint32) bool {
+	for _, section := range s.code {
+		if uint64(address) >= section.Addr && uint64(address) < section.Addr+section.Size {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *symbolizer) describe(address uint32) string {
+	result := "??"
+	i := sort.Search(len(s.symbols), func(i int) bool {
+		return s.symbols[i].Value > uint64(address)
+	})
+	if i > 0 {
+		symbol := s.symbols[i-1]
+		offset := uint64(address) - symbol.Value
+		if symbol.Size == 0 || offset < symbol.Size {
+			result = fmt.Sprintf("%s+0x%x", symbol.Name, offset)
+		}
+	}
+	if line := s.line(address); line != "" {
+		result += " at " + line
+	}
+	return result
+}
+
+func (s *symbolizer) line(address uint32) string {
+	if s.dwarf == nil {
+		return ""
+	}
+	for _, unit := range s.units {
+		ranges, err := s.dwarf.Ranges(unit)
+		if err != nil {
+			continue
+		}
+		for _, r := range ranges {
+			if uint64(address) < r[0] || uint64(address) >= r[1] {
+				continue
+			}
+			reader, err := s.dwarf.LineReader(unit)
+			if err != nil || reader == nil {
+				return ""
+			}
+			var entry dwarf.LineEntry
+			if err := reader.SeekPC(uint64(address), &entry); err != nil {
+				return ""
+			}
+			return fmt.Sprintf("%s:%d", entry.File.Name, entry.Line)
+		}
+	}
+	return ""
+}
+
+func min(x int, y int) int {
+	if x < y {
+		return x
+	}
+	return y
+}
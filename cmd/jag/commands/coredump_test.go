@@ -0,0 +1,175 @@
+// Copyright (C) 2026 Toit contributors.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"hash/crc32"
+	"reflect"
+	"testing"
+)
+
+func TestFindCoredumpPartition(t *testing.T) {
+	entry := func(kind byte, subtype byte, offset uint32, size uint32) []byte {
+		result := make([]byte, 32)
+		result[0], result[1], result[2], result[3] = 0xaa, 0x50, kind, subtype
+		binary.LittleEndian.PutUint32(result[4:], offset)
+		binary.LittleEndian.PutUint32(result[8:], size)
+		return result
+	}
+	table := append(entry(0x01, 0x02, 0x9000, 0x6000), entry(0x01, 0x03, 0x3f0000, 0x10000)...)
+	table = append(table, bytes.Repeat([]byte{0xff}, 32)...)
+
+	offset, size, err := findCoredumpPartition(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != 0x3f0000 || size != 0x10000 {
+		t.Fatalf("got offset 0x%x, size 0x%x", offset, size)
+	}
+
+	if _, _, err := findCoredumpPartition(table[:32]); err == nil {
+		t.Fatal("found a core dump partition in a table without one")
+	}
+}
+
+// buildXtensaCoredump builds a minimal ELF core dump with a single task and
+// a stack segment that links two frames.
+func buildXtensaCoredump() []byte {
+	const (
+		tcb      = 0x3ffb0000
+		stackTop = 0x3ffc0100
+		callerSP = 0x3ffc0200
+	)
+
+	note := func(name string, kind uint32, desc []byte) []byte {
+		var buf bytes.Buffer
+		nameBytes := append([]byte(name), 0)
+		binary.Write(&buf, binary.LittleEndian, []uint32{uint32(len(nameBytes)), uint32(len(desc)), kind})
+		buf.Write(nameBytes)
+		buf.Write(make([]byte, (4-len(nameBytes)%4)%4))
+		buf.Write(desc)
+		buf.Write(make([]byte, (4-len(desc)%4)%4))
+		return buf.Bytes()
+	}
+
+	status := make([]byte, prStatusRegsStart+(64+16)*4)
+	binary.LittleEndian.PutUint32(status[prStatusPidOffset:], tcb)
+	regs := status[prStatusRegsStart:]
+	binary.LittleEndian.PutUint32(regs[0:], 0x400d1000)    // pc.
+	binary.LittleEndian.PutUint32(regs[64*4:], 0x800d2003) // a0.
+	binary.LittleEndian.PutUint32(regs[65*4:], stackTop)   // a1.
+	notes := note("CORE", notePrStatus, status)
+	extra := make([]byte, 12)
+	binary.LittleEndian.PutUint32(extra[0:], tcb)
+	binary.LittleEndian.PutUint32(extra[4:], 232)
+	binary.LittleEndian.PutUint32(extra[8:], 28)
+	notes = append(notes, note("EXTRA_INFO", noteEspExtraInfo, extra)...)
+
+	// The TCB holds the task name.
+	tcbData := make([]byte, 0x100)
+	copy(tcbData[tcbNameOffset:], "main\x00")
+	// The base save area below the stack pointer links to the caller, which
+	// is the last frame.
+	stackData := make([]byte, 0x200)
+	binary.LittleEndian.PutUint32(stackData[0x100-16:], 0)
+	binary.LittleEndian.PutUint32(stackData[0x100-12:], callerSP)
+
+	type segment struct {
+		kind    elf.ProgType
+		address uint32
+		data    []byte
+	}
+	segments := []segment{
+		{elf.PT_NOTE, 0, notes},
+		{elf.PT_LOAD, tcb, tcbData},
+		{elf.PT_LOAD, stackTop - 0x100, stackData},
+	}
+
+	var out bytes.Buffer
+	header := elf.Header32{
+		Type:      uint16(elf.ET_CORE),
+		Machine:   uint16(elf.EM_XTENSA),
+		Version:   uint32(elf.EV_CURRENT),
+		Phoff:     52,
+		Ehsize:    52,
+		Phentsize: 32,
+		Phnum:     uint16(len(segments)),
+	}
+	copy(header.Ident[:], elf.ELFMAG)
+	header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS32)
+	header.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	binary.Write(&out, binary.LittleEndian, header)
+	offset := uint32(52 + 32*len(segments))
+	for _, s := range segments {
+		binary.Write(&out, binary.LittleEndian, elf.Prog32{
+			Type:   uint32(s.kind),
+			Off:    offset,
+			Vaddr:  s.address,
+			Filesz: uint32(len(s.data)),
+			Memsz:  uint32(len(s.data)),
+		})
+		offset += uint32(len(s.data))
+	}
+	for _, s := range segments {
+		out.Write(s.data)
+	}
+	return out.Bytes()
+}
+
+func TestParseCoredump(t *testing.T) {
+	elfData := buildXtensaCoredump()
+
+	// Wrap the ELF file the way the ESP-IDF stores it in the partition.
+	header := make([]byte, 20)
+	binary.LittleEndian.PutUint32(header[0:], uint32(len(header)+len(elfData)+4))
+	binary.LittleEndian.PutUint32(header[4:], 0x0102)
+	partition := append(header, elfData...)
+	checksum := make([]byte, 4)
+	binary.LittleEndian.PutUint32(checksum, crc32.ChecksumIEEE(partition))
+	partition = append(partition, checksum...)
+	partition = append(partition, bytes.Repeat([]byte{0xff}, 100)...)
+
+	for name, data := range map[string][]byte{"elf": elfData, "partition": partition} {
+		t.Run(name, func(t *testing.T) {
+			dump, err := parseCoredump(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !dump.checksumGood {
+				t.Fatal("checksum mismatch")
+			}
+			if len(dump.tasks) != 1 {
+				t.Fatalf("got %d tasks, want 1", len(dump.tasks))
+			}
+			task := dump.tasks[0]
+			if task.name != "main" {
+				t.Fatalf("task name is %q, want \"main\"", task.name)
+			}
+			if !dump.hasCrashed || dump.crashedTcb != task.tcb {
+				t.Fatal("crashed task not recorded")
+			}
+			if dump.extraInfoName(dump.extraInfo[0][0]) != "exccause" {
+				t.Fatalf("unexpected extra info %v", dump.extraInfo)
+			}
+
+			isCode := func(address uint32) bool { return address >= 0x400d0000 && address < 0x400e0000 }
+			frames, exact := dump.backtrace(task, isCode)
+			want := []uint32{0x400d1000, 0x400d2000}
+			if !exact || !reflect.DeepEqual(frames, want) {
+				t.Fatalf("backtrace is %x (exact: %v), want %x", frames, exact, want)
+			}
+		})
+	}
+}
+
+func TestParseEmptyCoredump(t *testing.T) {
+	if _, err := parseCoredump(bytes.Repeat([]byte{0xff}, 64)); err == nil {
+		t.Fatal("parsed an erased partition as core dump")
+	}
+}
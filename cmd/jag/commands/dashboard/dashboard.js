@@ -0,0 +1,122 @@
+// The dashboard of a proxied device.
+// Everything is loaded from the JSON API of the proxy, so that the page
+// works without internet access.
+
+"use strict";
+
+function element(tag, text, className) {
+  const result = document.createElement(tag);
+  if (text !== undefined) result.textContent = text;
+  if (className !== undefined) result.className = className;
+  return result;
+}
+
+function setStatus(id, text, isError) {
+  const status = document.getElementById(id);
+  status.textContent = text;
+  status.className = isError ? "error mt-20" : "mt-20";
+}
+
+async function loadDevice() {
+  const response = await fetch("/api/device");
+  if (!response.ok) throw new Error(response.statusText);
+  const device = await response.json();
+  document.title = device.name + " (Jaguar device)";
+  document.getElementById("name").textContent = device.name;
+  document.getElementById("run-hint").textContent = "> jag run -d " + device.name + " hello.toit";
+  const rows = [
+    ["Id", device.id],
+    ["Chip", device.chip],
+    ["SDK", device.sdkVersion],
+    ["Protocol", String(device.protocolVersion)],
+    ["Features", device.features.length === 0 ? "-" : device.features.join(", ")],
+    ["Address", device.address],
+    ["Serial port", device.serialPort || "-"],
+    ["Transfer", device.chunkSize + " byte chunks, " + device.window + " byte window"],
+    ["Packets", device.stats.packetsSent + " sent, " + device.stats.packetsReceived + " received, " +
+        device.stats.retransmissions + " retransmitted"],
+  ];
+  const identity = document.getElementById("identity");
+  identity.replaceChildren();
+  for (const [label, value] of rows) {
+    identity.appendChild(element("p", label));
+    const p = element("p");
+    p.appendChild(element("b", value, "text-black"));
+    identity.appendChild(p);
+  }
+}
+
+async function loadContainers() {
+  const table = document.getElementById("containers");
+  try {
+    const response = await fetch("/api/containers");
+    if (!response.ok) throw new Error(await response.text() || response.statusText);
+    const result = await response.json();
+    table.replaceChildren();
+    for (const container of result.containers) {
+      const row = element("tr");
+      row.appendChild(element("td", container.name));
+      row.appendChild(element("td", container.id));
+      const cell = element("td");
+      const button = element("button", "Uninstall");
+      button.onclick = () => uninstall(container.name, button);
+      cell.appendChild(button);
+      row.appendChild(cell);
+      table.appendChild(row);
+    }
+    setStatus("containers-status", result.containers.length === 0 ? "No containers installed." : "");
+  } catch (e) {
+    setStatus("containers-status", "Failed to list the containers: " + e.message, true);
+  }
+}
+
+async function uninstall(name, button) {
+  button.disabled = true;
+  try {
+    const response = await fetch("/uninstall", {
+      method: "PUT",
+      headers: { "X-Jaguar-Container-Name": name },
+    });
+    if (!response.ok) throw new Error(response.statusText);
+  } catch (e) {
+    setStatus("containers-status", "Failed to uninstall '" + name + "': " + e.message, true);
+  }
+  await loadContainers();
+}
+
+async function runSnapshot(event) {
+  event.preventDefault();
+  const file = document.getElementById("snapshot").files[0];
+  if (file === undefined) {
+    setStatus("run-status", "Pick a snapshot first.", true);
+    return;
+  }
+  setStatus("run-status", "Running '" + file.name + "' ...");
+  try {
+    const response = await fetch("/api/run", { method: "PUT", body: file });
+    const text = await response.text();
+    if (!response.ok) throw new Error(text || response.statusText);
+    setStatus("run-status", "Started '" + file.name + "'.");
+  } catch (e) {
+    setStatus("run-status", "Failed to run '" + file.name + "': " + e.message, true);
+  }
+}
+
+function followLogs() {
+  const logs = document.getElementById("logs");
+  const source = new EventSource("/api/logs");
+  source.onopen = () => setStatus("logs-status", "");
+  source.onmessage = (event) => {
+    const atBottom = logs.scrollTop + logs.clientHeight >= logs.scrollHeight - 4;
+    logs.appendChild(document.createTextNode(event.data + "\n"));
+    if (atBottom) logs.scrollTop = logs.scrollHeight;
+  };
+  source.onerror = () => setStatus("logs-status", "Disconnected from the proxy; reconnecting ...", true);
+}
+
+document.getElementById("run").addEventListener("submit", runSnapshot);
+loadDevice().catch((e) => setStatus("containers-status", "Failed to load the device: " + e.message, true));
+loadContainers();
+followLogs();
+// The device might be identified again, for example after a firmware update.
+setInterval(() => loadDevice().catch(() => {}), 5000);
@@ -10,10 +10,12 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 
 	"github.com/google/uuid"
 	"github.com/mitchellh/mapstructure"
@@ -43,7 +45,7 @@ func DecodeCmd() *cobra.Command {
 			if err != nil {
 				return err
 			}
-			return serialDecode(cmd.Context(), envelope, args[0], pretty, plain)
+			return serialDecode(cmd.Context(), os.Stdout, envelope, args[0], pretty, plain)
 		},
 	}
 	cmd.Flags().BoolP("force-pretty", "r", false, "force output to use terminal graphics")
@@ -52,17 +54,17 @@ func DecodeCmd() *cobra.Command {
 	return cmd
 }
 
-func serialDecode(ctx context.Context, envelope string, message string, forcePretty bool, forcePlain bool) error {
+func serialDecode(ctx context.Context, out io.Writer, envelope string, message string, forcePretty bool, forcePlain bool) error {
 	if strings.HasPrefix(message, "jag decode ") {
-		return jagDecode(ctx, message[11:], forcePretty, forcePlain)
+		return jagDecode(ctx, out, message[11:], forcePretty, forcePlain)
 	} else if strings.HasPrefix(message, "Backtrace:") {
-		return crashDecode(ctx, envelope, message)
+		return crashDecode(ctx, out, envelope, message)
 	} else {
-		return jagDecode(ctx, message, forcePretty, forcePlain)
+		return jagDecode(ctx, out, message, forcePretty, forcePlain)
 	}
 }
 
-func jagDecode(ctx context.Context, base64Message string, forcePretty bool, forcePlain bool) error {
+func jagDecode(ctx context.Context, out io.Writer, base64Message string, forcePretty bool, forcePlain bool) error {
 	sdk, err := GetSDK(ctx)
 	if err != nil {
 		return err
@@ -184,7 +186,7 @@ func jagDecode(ctx context.Context, base64Message string, forcePretty bool, forc
 	}
 
 	decodeCommand.Stderr = os.Stderr
-	decodeCommand.Stdout = os.Stdout
+	decodeCommand.Stdout = out
 
 	err = decodeCommand.Run()
 	if err == nil && isMissingSnapshot {
@@ -195,29 +197,13 @@ func jagDecode(ctx context.Context, base64Message string, forcePretty bool, forc
 	return err
 }
 
-func crashDecode(ctx context.Context, envelope string, backtrace string) error {
-	info := GetInfo(ctx)
+func crashDecode(ctx context.Context, out io.Writer, envelope string, backtrace string) error {
 	sdk, err := GetSDK(ctx)
 	if err != nil {
 		return err
 	}
 
-	if envelope == "" {
-		envelope = "esp32"
-	}
-
-	// If the given envelope is a path, just use it.
-	var envelopePath string
-	if _, err := os.Stat(envelope); err == nil {
-		envelopePath = envelope
-	} else {
-		envelopePath, err = GetCachedFirmwareEnvelopePath(ctx, info.Version, sdk.Version, envelope)
-		if err != nil {
-			return err
-		}
-	}
-
-	firmwareElf, err := ExtractFirmware(ctx, sdk, envelopePath, "elf", nil)
+	firmwareElf, err := extractFirmwareElf(ctx, sdk, envelope)
 	if err != nil {
 		return err
 	}
@@ -232,20 +218,79 @@ func crashDecode(ctx context.Context, envelope string, backtrace string) error {
 	}
 	stacktraceCommand := sdk.Stacktrace(ctx, "--objdump", objdump, "--backtrace", backtrace, firmwareElf.Name())
 	stacktraceCommand.Stderr = os.Stderr
-	stacktraceCommand.Stdout = os.Stdout
-	fmt.Println("Crash in native code:")
-	fmt.Println(backtrace)
+	stacktraceCommand.Stdout = out
+	fmt.Fprintln(out, "Crash in native code:")
+	fmt.Fprintln(out, backtrace)
 	return stacktraceCommand.Run()
 }
 
+// extractFirmwareElf extracts the ELF file of the firmware from the given
+// envelope. The envelope can be a path or the name of a published envelope,
+// and defaults to "esp32".
+func extractFirmwareElf(ctx context.Context, sdk *SDK, envelope string) (*os.File, error) {
+	info := GetInfo(ctx)
+
+	if envelope == "" {
+		envelope = "esp32"
+	}
+
+	// If the given envelope is a path, just use it.
+	var envelopePath string
+	if _, err := os.Stat(envelope); err == nil {
+		envelopePath = envelope
+	} else {
+		envelopePath, err = GetCachedFirmwareEnvelopePath(ctx, info.Version, sdk.Version, envelope)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ExtractFirmware(ctx, sdk, envelopePath, "elf", nil)
+}
+
 type Decoder struct {
 	scanner  *bufio.Scanner
 	context  context.Context
 	envelope string
+	out      io.Writer
+	filter   *lineFilter
+	// untilSeen is set when a line matched the filter's until pattern.
+	untilSeen bool
+	// disabled is non-zero when decoding is switched off, and messages are
+	// printed verbatim. It is accessed atomically.
+	disabled int32
 }
 
 func NewDecoder(scanner *bufio.Scanner, ctx context.Context, envelope string) *Decoder {
-	return &Decoder{scanner, ctx, envelope}
+	return &Decoder{
+		scanner:  scanner,
+		context:  ctx,
+		envelope: envelope,
+		out:      os.Stdout,
+	}
+}
+
+// SetOutput sets the writer the decoded output is written to. By default the
+// output is written to stdout.
+func (d *Decoder) SetOutput(out io.Writer) {
+	d.out = out
+}
+
+// ToggleDecoding switches the decoding of messages on or off, and returns
+// whether decoding is now enabled.
+func (d *Decoder) ToggleDecoding() bool {
+	for {
+		old := atomic.LoadInt32(&d.disabled)
+		if atomic.CompareAndSwapInt32(&d.disabled, old, 1-old) {
+			return old == 1
+		}
+	}
+}
+
+// SetFilter sets the filter that selects and highlights the lines that are
+// printed. Decoded messages are always printed.
+func (d *Decoder) SetFilter(filter *lineFilter) {
+	d.filter = filter
 }
 
 func (d *Decoder) decode(forcePretty bool, forcePlain bool) {
@@ -277,30 +322,39 @@ func (d *Decoder) decode(forcePretty bool, forcePlain bool) {
 			postponed = append(postponed, line)
 		} else {
 			separator := strings.Repeat("*", 78)
-			if strings.HasPrefix(line, "jag decode ") || strings.HasPrefix(line, "Backtrace:") {
-				fmt.Printf("\n" + separator + "\n")
+			decoding := atomic.LoadInt32(&d.disabled) == 0
+			if decoding && (strings.HasPrefix(line, "jag decode ") || strings.HasPrefix(line, "Backtrace:")) {
+				fmt.Fprintf(d.out, "\n"+separator+"\n")
 				if Version != "" {
-					fmt.Printf("Decoding by `jag`, device has version <%s>\n", Version)
-					fmt.Printf(separator + "\n")
+					fmt.Fprintf(d.out, "Decoding by `jag`, device has version <%s>\n", Version)
+					fmt.Fprintf(d.out, separator+"\n")
 				}
-				if err := serialDecode(d.context, d.envelope, line, forcePretty, forcePlain); err != nil {
+				if err := serialDecode(d.context, d.out, d.envelope, line, forcePretty, forcePlain); err != nil {
 					if len(postponed) != 0 {
-						fmt.Println(strings.Join(postponed, "\n"))
+						fmt.Fprintln(d.out, strings.Join(postponed, "\n"))
 						postponed = []string{}
 					}
-					fmt.Println(line)
-					fmt.Println("jag: Failed to decode line.")
+					fmt.Fprintln(d.out, line)
+					fmt.Fprintln(d.out, "jag: Failed to decode line.")
 				} else {
 					postponed = []string{}
 				}
-				fmt.Printf(separator + "\n\n")
+				fmt.Fprintf(d.out, separator+"\n\n")
 			} else {
 				if len(postponed) != 0 {
-					fmt.Println(strings.Join(postponed, "\n"))
+					fmt.Fprintln(d.out, strings.Join(postponed, "\n"))
 					postponed = []string{}
 				}
-				fmt.Println(line)
+				if d.filter == nil {
+					fmt.Fprintln(d.out, line)
+				} else if d.filter.accept(line) {
+					fmt.Fprintln(d.out, d.filter.highlight(line))
+				}
 			}
 		}
+		if d.filter != nil && d.filter.matchesUntil(line) {
+			d.untilSeen = true
+			return
+		}
 	}
 }
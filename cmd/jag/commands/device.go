@@ -21,6 +21,8 @@ const (
 	JaguarContainerTimeoutHeader  = "X-Jaguar-Container-Timeout"
 	JaguarContainerIntervalHeader = "X-Jaguar-Container-Interval"
 	JaguarCRC32Header             = "X-Jaguar-CRC32"
+	JaguarProgressHeader          = "X-Jaguar-Progress"
+	JaguarArgumentsHeader         = "X-Jaguar-Arguments"
 )
 
 type Device interface {
@@ -30,6 +32,9 @@ type Device interface {
 	SDKVersion() string
 	WordSize() int
 	Address() string
+	ProtocolVersion() int
+	Features() []string
+	HasFeature(feature string) bool
 	Short() string
 	String() string
 
@@ -64,6 +69,8 @@ type DeviceBase struct {
 	sdkVersion string
 	wordSize   int
 	address    string
+	// The capabilities the device announced.
+	capabilities deviceCapabilities
 }
 
 func (d DeviceBase) ID() string {
@@ -90,6 +97,18 @@ func (d DeviceBase) Address() string {
 	return d.address
 }
 
+func (d DeviceBase) ProtocolVersion() int {
+	return d.capabilities.ProtocolVersion
+}
+
+func (d DeviceBase) Features() []string {
+	return d.capabilities.Features
+}
+
+func (d DeviceBase) HasFeature(feature string) bool {
+	return d.capabilities.Has(feature)
+}
+
 func (d *DeviceBase) SetID(id string) {
 	d.id = id
 }
@@ -133,6 +152,28 @@ func stringOr(data map[string]interface{}, key string, def string) string {
 	return def
 }
 
+func stringsOr(data map[string]interface{}, key string, def []string) []string {
+	val, ok := data[key]
+	if !ok {
+		// Viper converts all keys to lowercase, so we need to check for that as well.
+		val, ok = data[strings.ToLower(key)]
+		if !ok {
+			return def
+		}
+	}
+	list, ok := val.([]interface{})
+	if !ok {
+		return def
+	}
+	result := []string{}
+	for _, element := range list {
+		if str, ok := element.(string); ok {
+			result = append(result, str)
+		}
+	}
+	return result
+}
+
 func intOr(data map[string]interface{}, key string, def int) int {
 	// Attempt to retrieve the value using the original key.
 	val, ok := data[key]
@@ -156,6 +197,16 @@ func intOr(data map[string]interface{}, key string, def int) int {
 }
 
 func GetDevice(ctx context.Context, sdk *SDK, checkPing bool, deviceSelect deviceSelect) (Device, error) {
+	if devices, ok := getDevices(ctx); ok {
+		d, err := pickDevice(devices, deviceSelect)
+		if err != nil {
+			return nil, err
+		}
+		if checkPing && !d.Ping(ctx, sdk) {
+			return nil, fmt.Errorf("failed to ping '%s'", d.Name())
+		}
+		return d, nil
+	}
 	deviceCfg, err := directory.GetDeviceConfig()
 	if err != nil {
 		return nil, err
@@ -204,3 +255,20 @@ func GetDevice(ctx context.Context, sdk *SDK, checkPing bool, deviceSelect devic
 	}
 	return d, nil
 }
+
+// pickDevice picks the selected device from the given devices, or the only
+// device if there is no selection.
+func pickDevice(devices []Device, deviceSelect deviceSelect) (Device, error) {
+	if deviceSelect == nil {
+		if len(devices) != 1 {
+			return nil, fmt.Errorf("found %d devices, select one with '--device'", len(devices))
+		}
+		return devices[0], nil
+	}
+	for _, d := range devices {
+		if deviceSelect.Match(d) {
+			return d, nil
+		}
+	}
+	return nil, fmt.Errorf("couldn't find %s", deviceSelect)
+}
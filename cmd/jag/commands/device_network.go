@@ -36,6 +36,10 @@ func NewDeviceNetworkFromJson(data map[string]interface{}) (*DeviceNetwork, erro
 			sdkVersion: stringOr(data, "sdkVersion", ""),
 			wordSize:   intOr(data, "wordSize", 4),
 			address:    stringOr(data, "address", ""),
+			capabilities: deviceCapabilities{
+				ProtocolVersion: intOr(data, "protocolVersion", 0),
+				Features:        stringsOr(data, "features", nil),
+			},
 		},
 		proxied: boolOr(data, "proxied", false),
 	}, nil
@@ -58,6 +62,10 @@ func (d DeviceNetwork) ToJson() map[string]interface{} {
 		"wordSize":   d.WordSize(),
 		"address":    d.Address(),
 		"proxied":    d.proxied,
+		// Keep the capabilities, so that a remembered device doesn't need to
+		// be identified again before using a feature.
+		"protocolVersion": d.ProtocolVersion(),
+		"features":        d.Features(),
 	}
 }
 
@@ -74,14 +82,10 @@ const (
 )
 
 func (d DeviceNetwork) newRequest(ctx context.Context, method string, path string, body io.Reader) (*http.Request, error) {
-	lanIp, err := getLanIp()
-	if err != nil {
-		return nil, err
-	}
 	// If the device is on the same machine (proxied) use "localhost" instead of the
 	// public IP. This is more stable on Windows machines.
 	address := d.Address()
-	if strings.HasPrefix(address, "http://"+lanIp+":") {
+	if lanIp, err := getLanIp(); err == nil && strings.HasPrefix(address, "http://"+lanIp+":") {
 		address = "http://localhost:" + strings.TrimPrefix(address, "http://"+lanIp+":")
 	}
 	return http.NewRequestWithContext(ctx, method, address+path, body)
@@ -186,24 +190,39 @@ func (d DeviceNetwork) ContainerUninstall(ctx context.Context, sdk *SDK, name st
 
 func (d DeviceNetwork) UpdateFirmware(ctx context.Context, sdk *SDK, b []byte) error {
 	var reader = NewProgressReader(bytes.NewReader(b), int64(len(b)))
-	req, err := d.newRequest(ctx, "PUT", "/firmware", reader)
+	// Proxies receive the firmware much faster than they can forward it to
+	// the device. If they can, let them report the progress of the device
+	// instead.
+	proxyProgress := d.HasFeature(featureProgress)
+	var body io.Reader = reader
+	if proxyProgress {
+		body = bytes.NewReader(b)
+	}
+	req, err := d.newRequest(ctx, "PUT", "/firmware", body)
 	if err != nil {
 		return err
 	}
 	req.ContentLength = int64(len(b))
 	req.Header.Set(JaguarDeviceIDHeader, d.ID())
 	req.Header.Set(JaguarSDKVersionHeader, sdk.Version)
+	if proxyProgress {
+		req.Header.Set(JaguarProgressHeader, "true")
+	}
 	defer fmt.Print("\n\n")
 	res, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return err
 	}
+	defer res.Body.Close()
 
-	io.ReadAll(res.Body) // Avoid closing connection prematurely.
 	if res.StatusCode != http.StatusOK {
+		io.ReadAll(res.Body) // Avoid closing connection prematurely.
 		return fmt.Errorf("got non-OK from device: %s", res.Status)
 	}
-
+	if proxyProgress {
+		return readProgressReport(res.Body, reader)
+	}
+	io.ReadAll(res.Body) // Avoid closing connection prematurely.
 	return nil
 }
 
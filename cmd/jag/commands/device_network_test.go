@@ -0,0 +1,136 @@
+// Copyright (C) 2026 Toit contributors.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/toitlang/jaguar/cmd/jag/fakedevice"
+)
+
+func newFakeDevice(t *testing.T, config fakedevice.Config) (*fakedevice.Device, Device) {
+	fake := fakedevice.New(config)
+	t.Cleanup(fake.Close)
+	device, err := NewDeviceFromJson(fake.Identity())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fake, device
+}
+
+func TestDeviceNetwork(t *testing.T) {
+	ctx := context.Background()
+	sdk := &SDK{Version: "v2.0.0"}
+	fake, device := newFakeDevice(t, fakedevice.Config{SDKVersion: sdk.Version})
+
+	if !device.Ping(ctx, sdk) {
+		t.Fatal("the device didn't answer the ping")
+	}
+
+	image := []byte("image")
+	if err := device.SendCode(ctx, sdk, "/install", image, map[string]string{JaguarContainerNameHeader: "app"}); err != nil {
+		t.Fatal(err)
+	}
+	containers, err := device.ContainerList(ctx, sdk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(containers) != 1 || string(fake.Image("app")) != "image" {
+		t.Errorf("got containers %v", containers)
+	}
+	if err := device.ContainerUninstall(ctx, sdk, "app"); err != nil {
+		t.Fatal(err)
+	}
+	if containers := fake.Containers(); len(containers) != 0 {
+		t.Errorf("got containers %v after uninstalling", containers)
+	}
+
+	// Every request identifies the device and the SDK.
+	requests := fake.Requests()
+	if len(requests) != 4 {
+		t.Fatalf("got %d requests", len(requests))
+	}
+	for _, request := range requests {
+		if request.Header.Get(JaguarDeviceIDHeader) != fake.ID() || request.Header.Get(JaguarSDKVersionHeader) != sdk.Version {
+			t.Errorf("got headers %v for '%s'", request.Header, request.Path)
+		}
+	}
+
+	fake.FailNext("/run", http.StatusServiceUnavailable)
+	err = device.SendCode(ctx, sdk, "/run", image, nil)
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("got %v for a failing device", err)
+	}
+	fake.FailNext("/ping", http.StatusInternalServerError)
+	if device.Ping(ctx, sdk) {
+		t.Error("the ping of a failing device succeeded")
+	}
+	fake.Fail("/run", fakedevice.Failure{Drop: true})
+	if err := device.SendCode(ctx, sdk, "/run", image, nil); err == nil {
+		t.Error("sending code over a dropped connection succeeded")
+	}
+
+	// The device rejects images for other SDKs.
+	err = device.SendCode(ctx, &SDK{Version: "v1.0.0"}, "/run", image, nil)
+	if err == nil || !strings.Contains(err.Error(), "406") {
+		t.Errorf("got %v for a different SDK", err)
+	}
+}
+
+func TestScanNetwork(t *testing.T) {
+	fake, _ := newFakeDevice(t, fakedevice.Config{Name: "scanned"})
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go fake.Broadcast(ctx, port, 20*time.Millisecond)
+
+	scanCtx, scanCancel := context.WithTimeout(ctx, 300*time.Millisecond)
+	defer scanCancel()
+	devices, err := ScanNetwork(scanCtx, nil, uint(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 1 || devices[0].Name() != "scanned" || devices[0].Address() != fake.Address() {
+		t.Errorf("got %v", devices)
+	}
+}
+
+func TestCommandsWithFakeDevices(t *testing.T) {
+	sdk := &SDK{Version: "v2.0.0"}
+	first, firstDevice := newFakeDevice(t, fakedevice.Config{Name: "first", SDKVersion: sdk.Version})
+	_, secondDevice := newFakeDevice(t, fakedevice.Config{Name: "second", SDKVersion: sdk.Version})
+	ctx := SetSDK(context.Background(), sdk)
+	ctx = SetDevices(ctx, firstDevice, secondDevice)
+
+	cmd := ContainerUninstallCmd()
+	cmd.SetArgs([]string{"app"})
+	cmd.SetOut(io.Discard)
+	cmd.SetErr(io.Discard)
+	if err := cmd.ExecuteContext(ctx); err == nil {
+		t.Error("picked a device without a selection")
+	}
+
+	cmd = ContainerUninstallCmd()
+	cmd.SetArgs([]string{"-d", "first", "app"})
+	if err := cmd.ExecuteContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	requests := first.Requests()
+	if len(requests) != 2 || requests[0].Path != "/ping" || requests[1].Path != "/uninstall" || requests[1].Header.Get(JaguarContainerNameHeader) != "app" {
+		t.Errorf("got requests %v", requests)
+	}
+}
@@ -50,6 +50,9 @@ func FlashCmd() *cobra.Command {
 				if err != nil {
 					return result, err
 				}
+				if isRemotePort(port) {
+					return result, nil
+				}
 				// Probing the chip type talks to the chip over serial, which resets
 				// it. Boards that use the ESP32's integrated USB peripheral (for
 				// example the ESP32-S2) are taken out of their manually-entered
@@ -75,7 +78,7 @@ func FlashCmd() *cobra.Command {
 
 				flashArguments := []string{
 					"flash",
-					"--port", port,
+					"--port", esptoolPort(port),
 					"--baud", strconv.Itoa(int(baud)),
 				}
 				flashArguments = append(flashArguments, partitionArgs...)
@@ -85,7 +88,7 @@ func FlashCmd() *cobra.Command {
 				// Windows, but on the other hand Windows has strange
 				// escaping rules for COM ports over 10 (COM10, COM11),
 				// which we don't want to deal with.
-				if os.PathSeparator != '\\' && !shouldSkipPortCheck {
+				if os.PathSeparator != '\\' && !shouldSkipPortCheck && !isRemotePort(port) {
 					// Check the port is writable first, to avoid the confusing error
 					// message from esptool in the common case where the port is owned
 					// by the dialout or uucp group.
@@ -107,7 +110,7 @@ func FlashCmd() *cobra.Command {
 		},
 	}
 
-	cmd.Flags().StringP("port", "p", ConfiguredPort(), "serial port to flash via")
+	cmd.Flags().StringP("port", "p", ConfiguredPort(), "serial port to flash via; can also be a remote port like 'rfc2217://host:port' or 'tcp://host:port'")
 	cmd.Flags().Uint("baud", 921600, "baud rate used for the serial flashing")
 	cmd.Flags().Bool("skip-port-check", false, "accept the given port without checking")
 	addFirmwareFlashFlags(cmd, "name for the device, if not set a name will be auto generated")
@@ -117,7 +120,7 @@ func FlashCmd() *cobra.Command {
 
 func ProbeChipType(ctx context.Context, port string, sdk *SDK) (string, error) {
 	// Get the esptool from the SDK.
-	cmd, err := sdk.EspTool(ctx, "--port", port, "chip_id")
+	cmd, err := sdk.EspTool(ctx, "--port", esptoolPort(port), "chip_id")
 	if err != nil {
 		return "", fmt.Errorf("failed to retrieve esptool command: %w", err)
 	}
@@ -24,6 +24,8 @@ type ctxKey string
 
 const (
 	ctxKeyInfo          ctxKey = "info"
+	ctxKeySDK           ctxKey = "sdk"
+	ctxKeyDevices       ctxKey = "devices"
 	noAnalyticsFlagName string = "no-analytics"
 )
 
@@ -41,6 +43,25 @@ func GetInfo(ctx context.Context) Info {
 	return ctx.Value(ctxKeyInfo).(Info)
 }
 
+// SetSDK makes the commands use the given SDK instead of the one that
+// was downloaded by 'jag setup'.
+func SetSDK(ctx context.Context, sdk *SDK) context.Context {
+	return context.WithValue(ctx, ctxKeySDK, sdk)
+}
+
+// SetDevices makes the commands pick from the given devices instead of
+// scanning for devices, and leaves the device configuration alone. Tests
+// use it with fake devices.
+func SetDevices(ctx context.Context, devices ...Device) context.Context {
+	return context.WithValue(ctx, ctxKeyDevices, devices)
+}
+
+// getDevices returns the devices that were set with SetDevices.
+func getDevices(ctx context.Context) ([]Device, bool) {
+	devices, ok := ctx.Value(ctxKeyDevices).([]Device)
+	return devices, ok
+}
+
 func JagCmd(info Info, isReleaseBuild bool) *cobra.Command {
 	configCmd := ConfigCmd(info)
 
@@ -78,13 +99,17 @@ func JagCmd(info Info, isReleaseBuild bool) *cobra.Command {
 		ContainerCmd(),
 		PingCmd(),
 		RunCmd(),
+		TestCmd(),
 		CompileCmd(),
 		SimulateCmd(),
 		DecodeCmd(),
+		CoredumpCmd(),
 		SetupCmd(info),
 		FlashCmd(),
 		FirmwareCmd(),
 		MonitorCmd(),
+		SerialServerCmd(),
+		ProxyCmd(),
 		WatchCmd(),
 		PortCmd(),
 		ToitCmd(),
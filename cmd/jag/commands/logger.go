@@ -0,0 +1,91 @@
+// Copyright (C) 2026 Toit contributors.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	logLevelDebug = 0
+	logLevelInfo  = 1
+	logLevelWarn  = 2
+	logLevelError = 3
+	logLevelFatal = 4
+)
+
+var logLevelNames = map[int]string{
+	logLevelDebug: "DEBUG",
+	logLevelInfo:  "INFO",
+	logLevelWarn:  "WARN",
+	logLevelError: "ERROR",
+	logLevelFatal: "FATAL",
+}
+
+// logger writes log lines in the same format as the devices, for example
+// "[jaguar.uart] INFO: running Jaguar device 'foo'".
+// Loggers derived with named share the output and its lock.
+type logger struct {
+	name       string
+	out        io.Writer
+	mu         *sync.Mutex
+	level      int
+	timestamps bool
+}
+
+func newLogger(name string, out io.Writer, level int) *logger {
+	return &logger{
+		name:  name,
+		out:   out,
+		mu:    &sync.Mutex{},
+		level: level,
+	}
+}
+
+// withTimestamps returns a logger that prefixes every line with the time.
+func (l *logger) withTimestamps() *logger {
+	result := *l
+	result.timestamps = true
+	return &result
+}
+
+// named returns a logger for a part of this logger's component.
+func (l *logger) named(name string) *logger {
+	result := *l
+	result.name = l.name + "." + name
+	return &result
+}
+
+func (l *logger) log(level int, format string, args ...interface{}) {
+	if level < l.level {
+		return
+	}
+	line := fmt.Sprintf("[%s] %s: %s\n", l.name, logLevelNames[level], fmt.Sprintf(format, args...))
+	if l.timestamps {
+		line = time.Now().Format("2006-01-02T15:04:05.000Z07:00 ") + line
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	io.WriteString(l.out, line)
+}
+
+func (l *logger) Debugf(format string, args ...interface{}) {
+	l.log(logLevelDebug, format, args...)
+}
+
+func (l *logger) Infof(format string, args ...interface{}) {
+	l.log(logLevelInfo, format, args...)
+}
+
+func (l *logger) Warnf(format string, args ...interface{}) {
+	l.log(logLevelWarn, format, args...)
+}
+
+func (l *logger) Errorf(format string, args ...interface{}) {
+	l.log(logLevelError, format, args...)
+}
@@ -17,62 +17,191 @@ import (
 
 	"github.com/spf13/cobra"
 	"go.bug.st/serial"
+	"golang.org/x/term"
 )
 
 func MonitorCmd() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:          "monitor",
-		Short:        "Monitor the serial output of an ESP32",
+		Use:   "monitor",
+		Short: "Monitor the serial output of an ESP32",
+		Long: "Monitor the serial output of an ESP32.\n" +
+			"Multiple devices can be monitored at the same time by repeating --port, or\n" +
+			"with --all. Each line is then prefixed with the name of its port.",
 		Args:         cobra.NoArgs,
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			ctx, cancel := context.WithCancel(cmd.Context())
 			defer cancel()
 
-			port, err := cmd.Flags().GetString("port")
+			ports, err := cmd.Flags().GetStringArray("port")
 			if err != nil {
 				return err
 			}
+			all, err := cmd.Flags().GetBool("all")
+			if err != nil {
+				return err
+			}
+			if all {
+				if cmd.Flags().Changed("port") {
+					return fmt.Errorf("--all and --port can't be used together")
+				}
+				available, err := getPorts(false)
+				if err != nil {
+					return err
+				}
+				if available.Len() == 0 {
+					return fmt.Errorf("no serial ports detected")
+				}
+				ports = nil
+				for _, p := range available.Ports {
+					ports = append(ports, string(p))
+				}
+			} else if !cmd.Flags().Changed("port") {
+				port, err := checkPort(ConfiguredPort(), false)
+				if err != nil {
+					return err
+				}
+				ports = []string{port}
+			}
 
-			if !cmd.Flags().Changed("port") {
-				if port, err = checkPort(port, false); err != nil {
+			envelopes, err := cmd.Flags().GetStringArray("envelope")
+			if err != nil {
+				return err
+			}
+			if len(envelopes) > 1 && len(envelopes) != len(ports) {
+				return fmt.Errorf("got %d envelopes for %d ports; pass a single --envelope or one per port", len(envelopes), len(ports))
+			}
+
+			opts := &monitorOptions{}
+			opts.baud, err = cmd.Flags().GetUint("baud")
+			if err != nil {
+				return err
+			}
+			opts.proxy, err = cmd.Flags().GetBool("proxy")
+			if err != nil {
+				return err
+			}
+			if opts.proxy && !cmd.Flags().Changed("baud") {
+				opts.baud = defaultProxyBaudRate
+			}
+			if opts.proxy {
+				opts.network, err = getProxyNetwork(cmd)
+				if err != nil {
+					return err
+				}
+				opts.chunkSize, opts.window, err = getUartTransferFlags(cmd)
+				if err != nil {
 					return err
 				}
 			}
 
-			baud, err := cmd.Flags().GetUint("baud")
+			opts.attach, err = cmd.Flags().GetBool("attach")
 			if err != nil {
 				return err
 			}
-			shouldProxy, err := cmd.Flags().GetBool("proxy")
+
+			opts.pretty, err = cmd.Flags().GetBool("force-pretty")
 			if err != nil {
 				return err
 			}
-			if shouldProxy && !cmd.Flags().Changed("baud") {
-				baud = defaultProxyBaudRate
+
+			opts.plain, err = cmd.Flags().GetBool("force-plain")
+			if err != nil {
+				return err
 			}
 
-			attach, err := cmd.Flags().GetBool("attach")
+			logFile, err := cmd.Flags().GetString("log-file")
+			if err != nil {
+				return err
+			}
+			opts.rawLogFile, err = cmd.Flags().GetString("raw-log-file")
+			if err != nil {
+				return err
+			}
+			logMaxSize, err := cmd.Flags().GetUint("log-max-size")
+			if err != nil {
+				return err
+			}
+			opts.logMaxSize = int64(logMaxSize) * 1024 * 1024
+			opts.logRotateInterval, err = cmd.Flags().GetDuration("log-rotate-interval")
+			if err != nil {
+				return err
+			}
+			opts.logMaxFiles, err = cmd.Flags().GetInt("log-max-files")
 			if err != nil {
 				return err
 			}
 
-			pretty, err := cmd.Flags().GetBool("force-pretty")
+			grep, err := cmd.Flags().GetStringArray("grep")
+			if err != nil {
+				return err
+			}
+			exclude, err := cmd.Flags().GetStringArray("exclude")
+			if err != nil {
+				return err
+			}
+			level, err := cmd.Flags().GetString("level")
+			if err != nil {
+				return err
+			}
+			colorMode, err := cmd.Flags().GetString("color")
+			if err != nil {
+				return err
+			}
+			opts.color, err = useColor(colorMode)
+			if err != nil {
+				return err
+			}
+			opts.until, err = cmd.Flags().GetString("until")
+			if err != nil {
+				return err
+			}
+			opts.filter, err = newLineFilter(grep, exclude, level, opts.color, opts.until)
 			if err != nil {
 				return err
 			}
 
-			plain, err := cmd.Flags().GetBool("force-plain")
+			opts.inputMode, err = cmd.Flags().GetString("input")
 			if err != nil {
 				return err
 			}
+			switch opts.inputMode {
+			case "", "line":
+			case "raw":
+				if !term.IsTerminal(int(os.Stdin.Fd())) {
+					return fmt.Errorf("raw input mode requires a terminal")
+				}
+			default:
+				return fmt.Errorf("invalid input mode '%s'; must be 'line' or 'raw'", opts.inputMode)
+			}
+			if opts.inputMode != "" && len(ports) > 1 {
+				return fmt.Errorf("--input can only be used when monitoring a single port")
+			}
 
-			fmt.Printf("Starting serial monitor of port '%s' ...\n", port)
-			dev, err := serialOpen(port, int(baud))
+			opts.reconnect, err = cmd.Flags().GetBool("reconnect")
 			if err != nil {
 				return err
 			}
-			defer dev.Close()
+
+			var terminal io.Writer = os.Stdout
+			if opts.inputMode == "raw" {
+				oldState, err := term.MakeRaw(int(os.Stdin.Fd()))
+				if err != nil {
+					return err
+				}
+				defer term.Restore(int(os.Stdin.Fd()), oldState)
+				terminal = crlfWriter{os.Stdout}
+			}
+
+			out := terminal
+			if logFile != "" {
+				log, err := newRotatingFile(logFile, opts.logMaxSize, opts.logRotateInterval, opts.logMaxFiles)
+				if err != nil {
+					return err
+				}
+				defer log.Close()
+				out = io.MultiWriter(terminal, newTimestampWriter(log))
+			}
 
 			signalChan := make(chan os.Signal, 1)
 			signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
@@ -80,62 +209,214 @@ func MonitorCmd() *cobra.Command {
 			// Handle signals in a separate goroutine.
 			go func() {
 				<-signalChan
-				fmt.Printf("\nInterrupt received, shutting down gracefully...\n")
+				fmt.Fprintf(terminal, "\nInterrupt received, shutting down gracefully...\n")
 				cancel()
 			}()
 
-			if !attach {
-				dev.Reboot()
-			}
-
-			var logReader io.Reader = dev
-
-			if shouldProxy {
-				ch1, ch2 := multiplexReader(dev)
-				logReader = ch1
-				go func() {
-					if err := runUartProxy(dev, ch2); err != nil {
-						fmt.Printf("[jaguar.uart] ERROR: proxy failed: %v\n", err)
-					}
-				}()
+			if len(ports) == 1 {
+				envelope := ""
+				if len(envelopes) == 1 {
+					envelope = envelopes[0]
+				}
+				return monitorSerialPort(ctx, opts, ports[0], envelope, terminal, out)
 			}
 
-			scanner := bufio.NewScanner(logReader)
-
-			envelope, err := cmd.Flags().GetString("envelope")
-			if err != nil {
-				return err
+			// Lines of the different ports must not be mixed.
+			sharedOut := &lockedWriter{w: out}
+			errc := make(chan error, len(ports))
+			for i, port := range ports {
+				envelope := ""
+				if len(envelopes) == 1 {
+					envelope = envelopes[0]
+				} else if len(envelopes) > 1 {
+					envelope = envelopes[i]
+				}
+				portOpts := *opts
+				portOpts.rawLogFile = portLogPath(opts.rawLogFile, port)
+				portOut := newPrefixWriter(sharedOut, portPrefix(port, i, opts.color))
+				go func(port string, envelope string) {
+					errc <- monitorSerialPort(ctx, &portOpts, port, envelope, portOut, portOut)
+				}(port, envelope)
 			}
-
-			// Create a context-aware decoder that can be interrupted.
-			decoder := NewDecoder(scanner, ctx, envelope)
-			done := make(chan error, 1)
-			go func() {
-				decoder.decode(pretty, plain)
-				done <- scanner.Err()
-			}()
-
-			// Wait for either completion or context cancellation.
-			select {
-			case err := <-done:
-				return err
-			case <-ctx.Done():
-				return ctx.Err()
+			// The session ends as soon as one of the ports is done.
+			err = <-errc
+			cancel()
+			for i := 1; i < len(ports); i++ {
+				<-errc
 			}
+			return err
 		},
 	}
 
-	cmd.Flags().StringP("port", "p", ConfiguredPort(), "port to monitor")
+	cmd.Flags().StringArrayP("port", "p", []string{ConfiguredPort()}, "port to monitor; can be repeated to monitor multiple ports, and can be a remote port like 'rfc2217://host:port' or 'tcp://host:port'")
+	cmd.Flags().Bool("all", false, "monitor all available serial ports")
 	cmd.Flags().BoolP("attach", "a", false, "attach to the serial output without rebooting it")
 	cmd.Flags().BoolP("force-pretty", "r", false, "force output to use terminal graphics")
 	cmd.Flags().BoolP("force-plain", "l", false, "force output to use plain ASCII text")
 	cmd.Flags().Uint("baud", 115200, "the baud rate for serial monitoring; defaults to 921600 in proxy mode")
-	cmd.Flags().Bool("proxy", false, "proxy the connected device to the local network")
-	cmd.Flags().String("envelope", "", "name or path of the firmware envelope")
+	cmd.Flags().Bool("proxy", false, "proxy the connected devices to the local network")
+	addProxyNetworkFlags(cmd)
+	addUartTransferFlags(cmd)
+	cmd.Flags().StringArray("envelope", nil, "name or path of the firmware envelope; can be given once per port")
+	cmd.Flags().StringArray("grep", nil, "only show lines matching this regular expression; can be repeated")
+	cmd.Flags().StringArray("exclude", nil, "hide lines matching this regular expression; can be repeated")
+	cmd.Flags().String("level", "", "hide log lines below this level (debug, info, warn, error, or fatal)")
+	cmd.Flags().String("color", "auto", "highlight log lines (auto, always, or never)")
+	cmd.Flags().String("until", "", "exit successfully once a line matches this regular expression")
+	cmd.Flags().Bool("reconnect", true, "wait for the port to come back when the device disconnects")
+	cmd.Flags().String("input", "", "forward the terminal input to the device, either by 'line' or 'raw' keystrokes")
+	cmd.Flags().String("log-file", "", "also write the decoded output, with host timestamps, to this file")
+	cmd.Flags().String("raw-log-file", "", "also write the raw serial stream to this file; with multiple ports the port name is added to the file name")
+	cmd.Flags().Uint("log-max-size", 0, "rotate log files when they exceed this size in MB; 0 disables size-based rotation")
+	cmd.Flags().Duration("log-rotate-interval", 0, "rotate log files after this interval, for example '1h'; 0 disables time-based rotation")
+	cmd.Flags().Int("log-max-files", 10, "the number of rotated log files to keep; 0 keeps all of them")
 	return cmd
 }
 
+// monitorOptions are the settings of a monitor session that apply to all
+// monitored ports.
+type monitorOptions struct {
+	baud              uint
+	proxy             bool
+	network           *proxyNetwork
+	chunkSize         int
+	window            int
+	attach            bool
+	reconnect         bool
+	pretty            bool
+	plain             bool
+	color             bool
+	filter            *lineFilter
+	until             string
+	inputMode         string
+	rawLogFile        string
+	logMaxSize        int64
+	logRotateInterval time.Duration
+	logMaxFiles       int
+}
+
+// monitorSerialPort monitors a single port until the context is canceled,
+// the output ends, or the user quits.
+// Status messages are written to terminal, the device output to out.
+func monitorSerialPort(ctx context.Context, opts *monitorOptions, port string, envelope string, terminal io.Writer, out io.Writer) error {
+	fmt.Fprintf(terminal, "Starting serial monitor of port '%s' ...\n", port)
+	var dev monitorPort
+	var reconnected chan struct{}
+	if opts.reconnect {
+		reconnectingDev, err := openReconnectingPort(port, int(opts.baud), terminal)
+		if err != nil {
+			return err
+		}
+		reconnected = make(chan struct{}, 1)
+		reconnectingDev.OnReconnect(func() {
+			select {
+			case reconnected <- struct{}{}:
+			default:
+			}
+		})
+		dev = reconnectingDev
+	} else {
+		serialDev, err := serialOpen(port, int(opts.baud))
+		if err != nil {
+			return err
+		}
+		dev = serialDev
+	}
+	defer dev.Close()
+	// Proxy packets and keyboard input share the port.
+	devWriter := &lockedWriter{w: dev}
+
+	var rawReader io.Reader = dev
+	if opts.rawLogFile != "" {
+		rawLog, err := newRotatingFile(opts.rawLogFile, opts.logMaxSize, opts.logRotateInterval, opts.logMaxFiles)
+		if err != nil {
+			return err
+		}
+		defer rawLog.Close()
+		rawReader = io.TeeReader(dev, rawLog)
+	}
+
+	if !opts.attach {
+		dev.Reboot()
+	}
+
+	logReader := rawReader
+
+	if opts.proxy {
+		ch1, ch2 := multiplexReader(rawReader)
+		// The dashboard of the proxy shows the output of the device.
+		logs := newLogHub()
+		logReader = io.TeeReader(ch1, logs)
+		log := newLogger("jaguar.uart", terminal, logLevelInfo)
+		go func() {
+			config := &uartProxyConfig{
+				log:         log,
+				network:     opts.network,
+				serialPort:  port,
+				chunkSize:   opts.chunkSize,
+				window:      opts.window,
+				reconnected: reconnected,
+				logs:        logs,
+			}
+			if err := runUartProxy(ctx, devWriter, ch2, config); err != nil {
+				log.Errorf("proxy failed: %v", err)
+			}
+		}()
+	}
+
+	scanner := bufio.NewScanner(logReader)
+
+	// Create a context-aware decoder that can be interrupted.
+	decoder := NewDecoder(scanner, ctx, envelope)
+	decoder.SetOutput(out)
+	decoder.SetFilter(opts.filter)
+	done := make(chan error, 1)
+	go func() {
+		decoder.decode(opts.pretty, opts.plain)
+		done <- scanner.Err()
+	}()
+
+	quit := make(chan struct{})
+	if opts.inputMode != "" {
+		fmt.Fprint(terminal, monitorInputHelp)
+		input := &monitorInput{
+			device:         devWriter,
+			out:            terminal,
+			reboot:         dev.Reboot,
+			toggleDecoding: decoder.ToggleDecoding,
+			quit:           func() { close(quit) },
+			lineMode:       opts.inputMode == "line",
+		}
+		go func() {
+			if err := input.run(os.Stdin); err != nil {
+				fmt.Fprintf(terminal, "--- Failed to forward input: %v\n", err)
+			}
+		}()
+	}
+
+	// Wait for either completion, the quit command, or context
+	// cancellation.
+	select {
+	case <-quit:
+		return nil
+	case err := <-done:
+		if err == nil && opts.until != "" && !decoder.untilSeen {
+			return fmt.Errorf("the output of '%s' ended without matching '%s'", port, opts.until)
+		}
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func serialOpen(port string, baud int) (*serialPort, error) {
+	if isRemotePort(port) {
+		dev, err := openRemotePort(port, baud)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open port '%s': %w", port, err)
+		}
+		return &serialPort{dev}, nil
+	}
 	mode := &serial.Mode{BaudRate: baud}
 	if !strings.HasPrefix(port, "/dev/pts/") {
 		// Make sure we don't accidentally reset the device on open. Pseudo
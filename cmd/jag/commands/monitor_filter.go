@@ -0,0 +1,164 @@
+// Copyright (C) 2026 Toit contributors.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"regexp"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// Log lines from the device look like "[toit] INFO: ..." or
+// "[jaguar.http] WARN: ...". The name in brackets is the name of the
+// logger, which for programs is typically the container name.
+var logLineRegexp = regexp.MustCompile(`^\[([^\]]+)\] (DEBUG|INFO|WARN|WARNING|ERROR|FATAL)\b`)
+
+var logLevels = map[string]int{
+	"DEBUG":   logLevelDebug,
+	"INFO":    logLevelInfo,
+	"WARN":    logLevelWarn,
+	"WARNING": logLevelWarn,
+	"ERROR":   logLevelError,
+	"FATAL":   logLevelFatal,
+}
+
+var ansiEscapeRegexp = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+const (
+	ansiReset = "\x1b[0m"
+	ansiBold  = "\x1b[1m"
+)
+
+// Colors used for logger names. Red and yellow are reserved for levels.
+var ansiNameColors = []string{"\x1b[32m", "\x1b[34m", "\x1b[35m", "\x1b[36m", "\x1b[92m", "\x1b[94m", "\x1b[95m", "\x1b[96m"}
+
+var ansiLevelColors = map[int]string{
+	logLevelDebug: "\x1b[2m",
+	logLevelWarn:  "\x1b[33m",
+	logLevelError: "\x1b[31m",
+	logLevelFatal: "\x1b[1;31m",
+}
+
+// lineFilter decides which lines of the device output are shown and how
+// they are highlighted.
+type lineFilter struct {
+	grep     []*regexp.Regexp
+	exclude  []*regexp.Regexp
+	minLevel int
+	color    bool
+	until    *regexp.Regexp
+}
+
+func newLineFilter(grep []string, exclude []string, level string, color bool, until string) (*lineFilter, error) {
+	result := &lineFilter{color: color}
+	for _, pattern := range grep {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --grep pattern '%s': %w", pattern, err)
+		}
+		result.grep = append(result.grep, re)
+	}
+	for _, pattern := range exclude {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --exclude pattern '%s': %w", pattern, err)
+		}
+		result.exclude = append(result.exclude, re)
+	}
+	if level != "" {
+		minLevel, ok := logLevels[strings.ToUpper(level)]
+		if !ok {
+			return nil, fmt.Errorf("invalid level '%s'; must be one of debug, info, warn, error, or fatal", level)
+		}
+		result.minLevel = minLevel
+	}
+	if until != "" {
+		re, err := regexp.Compile(until)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --until pattern '%s': %w", until, err)
+		}
+		result.until = re
+	}
+	return result, nil
+}
+
+// useColor returns whether output should be highlighted for the given
+// --color mode.
+func useColor(mode string) (bool, error) {
+	switch mode {
+	case "always":
+		return true, nil
+	case "never":
+		return false, nil
+	case "auto":
+		return term.IsTerminal(int(os.Stdout.Fd())) && os.Getenv("NO_COLOR") == "", nil
+	}
+	return false, fmt.Errorf("invalid color mode '%s'; must be one of auto, always, or never", mode)
+}
+
+// accept returns whether the line should be shown.
+// Lines without a level, like the output of print, are never filtered by
+// level.
+func (f *lineFilter) accept(line string) bool {
+	if match := logLineRegexp.FindStringSubmatch(line); match != nil {
+		if logLevels[match[2]] < f.minLevel {
+			return false
+		}
+	}
+	for _, re := range f.exclude {
+		if re.MatchString(line) {
+			return false
+		}
+	}
+	if len(f.grep) == 0 {
+		return true
+	}
+	for _, re := range f.grep {
+		if re.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesUntil returns whether the line matches the --until pattern.
+func (f *lineFilter) matchesUntil(line string) bool {
+	return f.until != nil && f.until.MatchString(line)
+}
+
+// highlight colors the logger name and level of log lines.
+func (f *lineFilter) highlight(line string) string {
+	if !f.color {
+		return line
+	}
+	match := logLineRegexp.FindStringSubmatchIndex(line)
+	if match == nil {
+		return line
+	}
+	name := line[match[2]:match[3]]
+	level := line[match[4]:match[5]]
+	hash := fnv.New32a()
+	hash.Write([]byte(name))
+	nameColor := ansiNameColors[hash.Sum32()%uint32(len(ansiNameColors))]
+
+	var result strings.Builder
+	result.WriteString("[" + nameColor + name + ansiReset + "] ")
+	levelColor, hasLevelColor := ansiLevelColors[logLevels[level]]
+	if hasLevelColor {
+		result.WriteString(levelColor + level + ansiReset)
+	} else {
+		result.WriteString(ansiBold + level + ansiReset)
+	}
+	rest := line[match[1]:]
+	if hasLevelColor && logLevels[level] >= logLevelError {
+		rest = levelColor + rest + ansiReset
+	}
+	result.WriteString(rest)
+	return result.String()
+}
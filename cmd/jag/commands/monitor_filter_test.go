@@ -0,0 +1,78 @@
+// Copyright (C) 2026 Toit contributors.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestLineFilter(t *testing.T) {
+	filter, err := newLineFilter([]string{"sensor", "jaguar"}, []string{"noisy"}, "warn", false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]bool{
+		"[sensor] INFO: reading 12":       false,
+		"[sensor] WARN: reading too high": true,
+		"[jaguar] ERROR: install failed":  true,
+		"[jaguar] ERROR: noisy failure":   false,
+		"sensor value 12":                 true,
+		"unrelated output":                false,
+	}
+	for line, want := range tests {
+		if got := filter.accept(line); got != want {
+			t.Errorf("accept(%q) = %v, want %v", line, got, want)
+		}
+	}
+
+	if _, err := newLineFilter(nil, nil, "verbose", false, ""); err == nil {
+		t.Error("accepted an invalid level")
+	}
+	if _, err := newLineFilter([]string{"("}, nil, "", false, ""); err == nil {
+		t.Error("accepted an invalid regular expression")
+	}
+}
+
+func TestLineFilterHighlight(t *testing.T) {
+	filter, err := newLineFilter(nil, nil, "", true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := "[toit] ERROR: out of memory"
+	highlighted := filter.highlight(line)
+	if highlighted == line || !strings.Contains(highlighted, "\x1b[31m") {
+		t.Fatalf("error line not highlighted: %q", highlighted)
+	}
+	if stripped := ansiEscapeRegexp.ReplaceAllString(highlighted, ""); stripped != line {
+		t.Fatalf("highlighting changed the text: %q", stripped)
+	}
+	if plain := filter.highlight("hello"); plain != "hello" {
+		t.Fatalf("plain line changed: %q", plain)
+	}
+}
+
+func TestDecoderUntil(t *testing.T) {
+	filter, err := newLineFilter(nil, []string{"boot"}, "", false, "^TEST (PASSED|FAILED)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := "boot\nrunning\nTEST PASSED\nafter\n"
+	var out bytes.Buffer
+	decoder := NewDecoder(bufio.NewScanner(strings.NewReader(input)), context.Background(), "")
+	decoder.SetOutput(&out)
+	decoder.SetFilter(filter)
+	decoder.decode(false, true)
+
+	if !decoder.untilSeen {
+		t.Fatal("until pattern not seen")
+	}
+	if out.String() != "running\nTEST PASSED\n" {
+		t.Fatalf("unexpected output %q", out.String())
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright (C) 2026 Toit contributors.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// The key that starts a monitor command when typed in the terminal.
+const monitorEscapeKey = 0x14 // Ctrl-T.
+
+const monitorInputHelp = "--- Ctrl-T r: reboot, Ctrl-T d: toggle decoding, Ctrl-T q: quit, Ctrl-T Ctrl-T: send Ctrl-T\n"
+
+// lockedWriter serializes writes to the underlying writer.
+// Every call to Write writes all of the given data before another writer
+// gets access. This keeps proxy packets and terminal input from being
+// interleaved on the serial port.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(data []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	written := 0
+	for written < len(data) {
+		n, err := l.w.Write(data[written:])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// crlfWriter converts '\n' to "\r\n".
+// In raw terminal mode the terminal doesn't do this conversion itself.
+type crlfWriter struct {
+	w io.Writer
+}
+
+func (c crlfWriter) Write(data []byte) (int, error) {
+	if _, err := c.w.Write(bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// monitorInput forwards the keyboard input to the device and handles the
+// escape-key commands of the monitor.
+type monitorInput struct {
+	// device receives the input that isn't a monitor command.
+	device io.Writer
+	// out receives status messages.
+	out io.Writer
+
+	reboot         func()
+	toggleDecoding func() bool
+	quit           func()
+
+	// lineMode is set when the terminal sends complete lines. The end of
+	// a line that contains a command is then not forwarded.
+	lineMode bool
+
+	escaped      bool
+	afterCommand bool
+}
+
+// run forwards the given input until it ends or the quit command is
+// given.
+func (m *monitorInput) run(input io.Reader) error {
+	buf := make([]byte, 256)
+	for {
+		n, err := input.Read(buf)
+		if n > 0 {
+			quit, writeErr := m.process(buf[:n])
+			if writeErr != nil {
+				return writeErr
+			}
+			if quit {
+				return nil
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// process handles a chunk of input and returns whether the user asked to
+// quit.
+func (m *monitorInput) process(data []byte) (bool, error) {
+	var forward []byte
+	flush := func() error {
+		if len(forward) == 0 {
+			return nil
+		}
+		_, err := m.device.Write(forward)
+		forward = nil
+		return err
+	}
+
+	for _, b := range data {
+		if m.afterCommand {
+			m.afterCommand = false
+			if b == '\n' || b == '\r' {
+				continue
+			}
+		}
+		if !m.escaped {
+			if b == monitorEscapeKey {
+				m.escaped = true
+			} else {
+				forward = append(forward, b)
+			}
+			continue
+		}
+		m.escaped = false
+		m.afterCommand = m.lineMode && b != monitorEscapeKey
+		switch b {
+		case monitorEscapeKey:
+			forward = append(forward, b)
+		case 'r', 'R', 0x12: // Ctrl-R.
+			if err := flush(); err != nil {
+				return false, err
+			}
+			fmt.Fprintln(m.out, "--- Rebooting device")
+			m.reboot()
+		case 'd', 'D', 0x04: // Ctrl-D.
+			if m.toggleDecoding() {
+				fmt.Fprintln(m.out, "--- Decoding enabled")
+			} else {
+				fmt.Fprintln(m.out, "--- Decoding disabled")
+			}
+		case 'q', 'Q', 'x', 'X', 0x11, 0x18: // Ctrl-Q, Ctrl-X.
+			if err := flush(); err != nil {
+				return false, err
+			}
+			m.quit()
+			return true, nil
+		default:
+			fmt.Fprint(m.out, monitorInputHelp)
+		}
+	}
+	return false, flush()
+}
@@ -0,0 +1,60 @@
+// Copyright (C) 2026 Toit contributors.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMonitorInput(t *testing.T) {
+	var device, out bytes.Buffer
+	reboots := 0
+	decoding := true
+	quit := false
+	input := &monitorInput{
+		device:         &device,
+		out:            &out,
+		reboot:         func() { reboots++ },
+		toggleDecoding: func() bool { decoding = !decoding; return decoding },
+		quit:           func() { quit = true },
+	}
+
+	// The escape key can be split across reads.
+	if err := input.run(strings.NewReader("abc\x14")); err != nil {
+		t.Fatal(err)
+	}
+	if err := input.run(strings.NewReader("rdef\x14\x14\x14d\x14qignored")); err != nil {
+		t.Fatal(err)
+	}
+
+	if device.String() != "abcdef\x14" {
+		t.Fatalf("device received %q", device.String())
+	}
+	if reboots != 1 || decoding || !quit {
+		t.Fatalf("reboots: %d, decoding: %v, quit: %v", reboots, decoding, quit)
+	}
+}
+
+func TestMonitorInputLineMode(t *testing.T) {
+	var device, out bytes.Buffer
+	toggled := false
+	input := &monitorInput{
+		device:         &device,
+		out:            &out,
+		toggleDecoding: func() bool { toggled = true; return false },
+		lineMode:       true,
+	}
+	if err := input.run(strings.NewReader("hello\n\x14d\nworld\n\x14?\n")); err != nil {
+		t.Fatal(err)
+	}
+	if device.String() != "hello\nworld\n" {
+		t.Fatalf("device received %q", device.String())
+	}
+	if !toggled || !strings.Contains(out.String(), "Ctrl-T q") {
+		t.Fatalf("unexpected output %q", out.String())
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright (C) 2026 Toit contributors.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const rotatedLogTimeFormat = "20060102-150405"
+
+// rotatingFile writes to a log file and moves it aside once it grows
+// beyond maxSize bytes or has been open for longer than maxAge.
+// Rotated files are named after the original file with the time of
+// rotation appended. At most maxFiles rotated files are kept.
+// A zero maxSize, maxAge or maxFiles disables the corresponding limit.
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxAge   time.Duration
+	maxFiles int
+	now      func() time.Time
+
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func newRotatingFile(path string, maxSize int64, maxAge time.Duration, maxFiles int) (*rotatingFile, error) {
+	f := &rotatingFile{
+		path:     path,
+		maxSize:  maxSize,
+		maxAge:   maxAge,
+		maxFiles: maxFiles,
+		now:      time.Now,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file '%s': %w", f.path, err)
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = stat.Size()
+	f.opened = f.now()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.shouldRotate(len(p)) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) shouldRotate(pending int) bool {
+	if f.size == 0 {
+		return false
+	}
+	if f.maxSize > 0 && f.size+int64(pending) > f.maxSize {
+		return true
+	}
+	return f.maxAge > 0 && f.now().Sub(f.opened) >= f.maxAge
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+
+	ext := filepath.Ext(f.path)
+	base := f.path[:len(f.path)-len(ext)]
+	stamp := f.now().Format(rotatedLogTimeFormat)
+	rotated := base + "-" + stamp + ext
+	for i := 1; ; i++ {
+		if _, err := os.Stat(rotated); os.IsNotExist(err) {
+			break
+		}
+		rotated = fmt.Sprintf("%s-%s.%d%s", base, stamp, i, ext)
+	}
+	if err := os.Rename(f.path, rotated); err != nil {
+		return fmt.Errorf("failed to rotate log file '%s': %w", f.path, err)
+	}
+	if err := f.prune(base, ext); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+// rotatedLog is a rotated log file. Files rotated within the same second
+// are told apart by their index.
+type rotatedLog struct {
+	path  string
+	time  time.Time
+	index int
+}
+
+// parseRotatedLog parses the path of a file that was rotated from
+// base+ext. It returns false if the path isn't a rotated log file.
+func parseRotatedLog(path string, base string, ext string) (rotatedLog, bool) {
+	stamp := path[len(base)+1 : len(path)-len(ext)]
+	if len(stamp) < len(rotatedLogTimeFormat) {
+		return rotatedLog{}, false
+	}
+	rotatedAt, err := time.Parse(rotatedLogTimeFormat, stamp[:len(rotatedLogTimeFormat)])
+	if err != nil {
+		return rotatedLog{}, false
+	}
+	index := 0
+	if suffix := stamp[len(rotatedLogTimeFormat):]; suffix != "" {
+		if !strings.HasPrefix(suffix, ".") {
+			return rotatedLog{}, false
+		}
+		index, err = strconv.Atoi(suffix[1:])
+		if err != nil || index <= 0 {
+			return rotatedLog{}, false
+		}
+	}
+	return rotatedLog{path: path, time: rotatedAt, index: index}, true
+}
+
+// prune removes the oldest rotated files so that at most maxFiles remain.
+func (f *rotatingFile) prune(base string, ext string) error {
+	if f.maxFiles <= 0 {
+		return nil
+	}
+	matches, err := filepath.Glob(base + "-*" + ext)
+	if err != nil {
+		return err
+	}
+	var rotated []rotatedLog
+	for _, match := range matches {
+		if log, ok := parseRotatedLog(match, base, ext); ok {
+			rotated = append(rotated, log)
+		}
+	}
+	if len(rotated) <= f.maxFiles {
+		return nil
+	}
+	sort.Slice(rotated, func(i, j int) bool {
+		if !rotated[i].time.Equal(rotated[j].time) {
+			return rotated[i].time.Before(rotated[j].time)
+		}
+		return rotated[i].index < rotated[j].index
+	})
+	for _, log := range rotated[:len(rotated)-f.maxFiles] {
+		if err := os.Remove(log.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// timestampWriter prefixes every line written to it with the host time.
+// Terminal color codes are removed, so they don't end up in log files.
+type timestampWriter struct {
+	mu          sync.Mutex
+	w           io.Writer
+	now         func() time.Time
+	atLineStart bool
+}
+
+func newTimestampWriter(w io.Writer) *timestampWriter {
+	return &timestampWriter{
+		w:           w,
+		now:         time.Now,
+		atLineStart: true,
+	}
+}
+
+func (t *timestampWriter) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var out []byte
+	for _, b := range ansiEscapeRegexp.ReplaceAll(p, nil) {
+		if t.atLineStart {
+			out = append(out, t.now().Format("2006-01-02T15:04:05.000Z07:00 ")...)
+			t.atLineStart = false
+		}
+		out = append(out, b)
+		if b == '\n' {
+			t.atLineStart = true
+		}
+	}
+	if _, err := t.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
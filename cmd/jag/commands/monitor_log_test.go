@@ -0,0 +1,110 @@
+// Copyright (C) 2026 Toit contributors.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestTimestampWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := newTimestampWriter(&buf)
+	now := time.Date(2026, 1, 2, 3, 4, 5, 6000000, time.UTC)
+	w.now = func() time.Time { return now }
+
+	w.Write([]byte("first\nsec"))
+	w.Write([]byte("ond\n"))
+	w.Write([]byte("\n"))
+
+	stamp := "2026-01-02T03:04:05.006Z "
+	want := stamp + "first\n" + stamp + "second\n" + stamp + "\n"
+	if buf.String() != want {
+		t.Fatalf("got %q, want %q", buf.String(), want)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "monitor.log")
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	f, err := newRotatingFile(path, 10, time.Hour, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.now = func() time.Time { return now }
+
+	// Exceeding the size limit rotates.
+	f.Write([]byte("0123456789"))
+	f.Write([]byte("abc"))
+	// Exceeding the age limit rotates.
+	now = now.Add(time.Hour)
+	f.Write([]byte("def"))
+	// A third rotation drops the oldest file.
+	f.Write([]byte("0123456789"))
+
+	matches, err := filepath.Glob(filepath.Join(dir, "monitor-*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(matches)
+	want := []string{
+		filepath.Join(dir, "monitor-20260102-040405.log"),
+		filepath.Join(dir, "monitor-20260102-040405.1.log"),
+	}
+	sort.Strings(want)
+	if len(matches) != 2 || matches[0] != want[0] || matches[1] != want[1] {
+		t.Fatalf("got rotated files %v, want %v", matches, want)
+	}
+
+	current, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(current) != "0123456789" {
+		t.Fatalf("current log contains %q", current)
+	}
+}
+
+func TestRotatingFileWithinOneSecond(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "monitor.log")
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	f, err := newRotatingFile(path, 10, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.now = func() time.Time { return now }
+
+	// An older file that must be dropped first.
+	f.Write([]byte("0123456789"))
+	f.Write([]byte("0123456789"))
+	// Three more rotations within the same second keep the two newest.
+	now = now.Add(time.Minute)
+	for i := 0; i < 3; i++ {
+		f.Write([]byte("0123456789"))
+	}
+
+	matches, err := filepath.Glob(filepath.Join(dir, "monitor-*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(matches)
+	want := []string{
+		filepath.Join(dir, "monitor-20260102-030505.1.log"),
+		filepath.Join(dir, "monitor-20260102-030505.2.log"),
+	}
+	if len(matches) != 2 || matches[0] != want[0] || matches[1] != want[1] {
+		t.Fatalf("got rotated files %v, want %v", matches, want)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright (C) 2026 Toit contributors.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"sync"
+)
+
+// prefixWriter prefixes every line with a fixed string.
+// It only passes complete lines to the underlying writer, so the lines of
+// different writers that share an output aren't mixed.
+type prefixWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	prefix  []byte
+	pending []byte
+}
+
+func newPrefixWriter(w io.Writer, prefix string) *prefixWriter {
+	return &prefixWriter{
+		w:      w,
+		prefix: []byte(prefix),
+	}
+}
+
+func (p *prefixWriter) Write(data []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.pending = append(p.pending, data...)
+	end := bytes.LastIndexByte(p.pending, '\n')
+	if end < 0 {
+		return len(data), nil
+	}
+	lines := p.pending[:end+1]
+	var out []byte
+	for len(lines) > 0 {
+		i := bytes.IndexByte(lines, '\n')
+		out = append(out, p.prefix...)
+		out = append(out, lines[:i+1]...)
+		lines = lines[i+1:]
+	}
+	p.pending = append([]byte{}, p.pending[end+1:]...)
+	if _, err := p.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// portLabel returns the short name of a port, like "ttyUSB0" for
+// "/dev/ttyUSB0".
+func portLabel(port string) string {
+	return filepath.Base(port)
+}
+
+// portPrefix returns the prefix for the lines of the index'th monitored
+// port.
+func portPrefix(port string, index int, color bool) string {
+	return labelPrefix(portLabel(port), index, color)
+}
+
+// labelPrefix returns the prefix for the lines of the index'th of several
+// outputs, like ports or simulators.
+func labelPrefix(label string, index int, color bool) string {
+	prefix := "[" + label + "] "
+	if !color {
+		return prefix
+	}
+	return ansiNameColors[index%len(ansiNameColors)] + prefix + ansiReset
+}
+
+// portLogPath returns the log file for the given port by adding the port's
+// label to the given path.
+func portLogPath(path string, port string) string {
+	if path == "" {
+		return ""
+	}
+	ext := filepath.Ext(path)
+	return path[:len(path)-len(ext)] + "-" + portLabel(port) + ext
+}
@@ -0,0 +1,36 @@
+// Copyright (C) 2026 Toit contributors.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPrefixWriter(t *testing.T) {
+	var out bytes.Buffer
+	shared := &lockedWriter{w: &out}
+	first := newPrefixWriter(shared, "[ttyUSB0] ")
+	second := newPrefixWriter(shared, "[ttyUSB1] ")
+
+	first.Write([]byte("hello "))
+	second.Write([]byte("one\ntwo\nthr"))
+	first.Write([]byte("world\n"))
+	second.Write([]byte("ee\n"))
+
+	want := "[ttyUSB1] one\n[ttyUSB1] two\n[ttyUSB0] hello world\n[ttyUSB1] three\n"
+	if out.String() != want {
+		t.Fatalf("got %q, want %q", out.String(), want)
+	}
+}
+
+func TestPortLogPath(t *testing.T) {
+	if got := portLogPath("logs/soak.raw", "/dev/ttyUSB0"); got != "logs/soak-ttyUSB0.raw" {
+		t.Fatalf("got %q", got)
+	}
+	if got := portLogPath("", "/dev/ttyUSB0"); got != "" {
+		t.Fatalf("got %q", got)
+	}
+}
@@ -136,6 +136,10 @@ func CheckPort(port string) (string, error) {
 }
 
 func checkPort(port string, explicitlySet bool) (string, error) {
+	if isRemotePort(port) {
+		// Remote ports are only checked when they are opened.
+		return port, nil
+	}
 	exists, err := PortExists(port)
 	if err != nil {
 		return "", err
@@ -0,0 +1,198 @@
+// Copyright (C) 2026 Toit contributors.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"go.bug.st/serial/enumerator"
+)
+
+const reconnectPollInterval = 500 * time.Millisecond
+
+// monitorPort is the serial connection used by 'jag monitor'.
+type monitorPort interface {
+	io.ReadWriteCloser
+	Reboot()
+}
+
+// reconnectingPort is a serial port that survives the device disappearing,
+// for example when it is unplugged, or when it resets into the ROM
+// bootloader and re-enumerates on USB.
+// When reading fails, Read waits until the port, or a port with the same USB
+// serial number, reappears, reopens it, and continues reading.
+// Writes while the device is gone fail.
+type reconnectingPort struct {
+	baud         int
+	serialNumber string
+	// out receives status messages.
+	out io.Writer
+	// listPorts lists the serial ports of the system.
+	listPorts func() ([]*enumerator.PortDetails, error)
+
+	mu          sync.Mutex
+	path        string
+	port        *serialPort
+	closed      bool
+	closedc     chan struct{}
+	onReconnect []func()
+}
+
+func openReconnectingPort(path string, baud int, out io.Writer) (*reconnectingPort, error) {
+	port, err := serialOpen(path, baud)
+	if err != nil {
+		return nil, err
+	}
+	return &reconnectingPort{
+		baud:         baud,
+		serialNumber: usbSerialNumber(path),
+		out:          out,
+		listPorts:    enumerator.GetDetailedPortsList,
+		path:         path,
+		port:         port,
+		closedc:      make(chan struct{}),
+	}, nil
+}
+
+// usbSerialNumber returns the USB serial number of the given port, or ""
+// if the port isn't a USB device or the serial number isn't known.
+func usbSerialNumber(path string) string {
+	ports, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return ""
+	}
+	for _, p := range ports {
+		if p.Name == path && p.IsUSB {
+			return p.SerialNumber
+		}
+	}
+	return ""
+}
+
+// OnReconnect registers a function that is called, in its own goroutine,
+// whenever the port has been reopened.
+func (r *reconnectingPort) OnReconnect(f func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onReconnect = append(r.onReconnect, f)
+}
+
+func (r *reconnectingPort) current() *serialPort {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.port
+}
+
+func (r *reconnectingPort) Read(buf []byte) (int, error) {
+	for {
+		port := r.current()
+		n, err := port.Read(buf)
+		if err == nil {
+			return n, nil
+		}
+		if err := r.reconnect(port, err); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (r *reconnectingPort) Write(data []byte) (int, error) {
+	return r.current().Write(data)
+}
+
+func (r *reconnectingPort) Reboot() {
+	r.current().Reboot()
+}
+
+func (r *reconnectingPort) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	close(r.closedc)
+	return r.port.Close()
+}
+
+// reconnect waits for the device to come back after reading from the
+// failed port returned the given error.
+// Returns the error if the port was closed instead.
+func (r *reconnectingPort) reconnect(failed *serialPort, cause error) error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return cause
+	}
+	path := r.path
+	r.mu.Unlock()
+
+	// Closing the failed port makes writes fail until the port is back.
+	failed.Close()
+	fmt.Fprintf(r.out, "--- Lost connection to '%s' (%v); waiting for it to come back ...\n", path, cause)
+
+	for {
+		select {
+		case <-r.closedc:
+			return cause
+		case <-time.After(reconnectPollInterval):
+		}
+
+		name := r.findPort(path)
+		if name == "" {
+			continue
+		}
+		port, err := serialOpen(name, r.baud)
+		if err != nil {
+			// The port might not be ready yet. Try again.
+			continue
+		}
+
+		r.mu.Lock()
+		if r.closed {
+			r.mu.Unlock()
+			port.Close()
+			return cause
+		}
+		r.path = name
+		r.port = port
+		callbacks := r.onReconnect
+		r.mu.Unlock()
+
+		fmt.Fprintf(r.out, "--- Reconnected to '%s'\n", name)
+		for _, f := range callbacks {
+			go f()
+		}
+		return nil
+	}
+}
+
+// findPort returns the name of the port the device is connected to, or ""
+// if it isn't connected.
+// Devices with a USB serial number are found by that number, since they
+// might reappear under a different name.
+func (r *reconnectingPort) findPort(path string) string {
+	if isRemotePort(path) {
+		return path
+	}
+	if r.serialNumber != "" {
+		ports, err := r.listPorts()
+		if err == nil {
+			for _, p := range ports {
+				if p.IsUSB && p.SerialNumber == r.serialNumber {
+					return p.Name
+				}
+			}
+			return ""
+		}
+	}
+	if exists, err := PortExists(path); err == nil && exists {
+		return path
+	}
+	return ""
+}
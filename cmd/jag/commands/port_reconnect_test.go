@@ -0,0 +1,74 @@
+// Copyright (C) 2026 Toit contributors.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"go.bug.st/serial/enumerator"
+)
+
+func TestReconnectAfterClose(t *testing.T) {
+	cause := errors.New("device gone")
+	r := &reconnectingPort{
+		out:     io.Discard,
+		path:    "/jaguar-test-port-that-does-not-exist",
+		port:    &serialPort{},
+		closedc: make(chan struct{}),
+	}
+
+	// Closing the port while waiting for it to come back ends the wait.
+	result := make(chan error)
+	go func() {
+		result <- r.reconnect(&serialPort{}, cause)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	r.Close()
+	select {
+	case err := <-result:
+		if err != cause {
+			t.Errorf("got %v, want %v", err, cause)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reconnecting didn't stop after closing the port")
+	}
+
+	// Once closed, the port doesn't try to reconnect at all.
+	if err := r.reconnect(&serialPort{}, cause); err != cause {
+		t.Errorf("got %v, want %v", err, cause)
+	}
+}
+
+func TestFindPort(t *testing.T) {
+	ports := []*enumerator.PortDetails{
+		{Name: "/dev/ttyUSB0", IsUSB: true, SerialNumber: "OTHER"},
+		{Name: "/dev/ttyUSB1", IsUSB: true, SerialNumber: "ABC123"},
+	}
+	r := &reconnectingPort{
+		serialNumber: "ABC123",
+		listPorts: func() ([]*enumerator.PortDetails, error) {
+			return ports, nil
+		},
+	}
+
+	// The device reappeared under a different name.
+	if got := r.findPort("/dev/ttyUSB0"); got != "/dev/ttyUSB1" {
+		t.Errorf("got '%s', want '/dev/ttyUSB1'", got)
+	}
+
+	// A different device under the old name isn't the device.
+	ports = ports[:1]
+	if got := r.findPort("/dev/ttyUSB0"); got != "" {
+		t.Errorf("got '%s' for a port with another serial number", got)
+	}
+
+	// Remote ports are always reconnected under their address.
+	if got := r.findPort("rfc2217://localhost:4000"); got != "rfc2217://localhost:4000" {
+		t.Errorf("got '%s' for a remote port", got)
+	}
+}
@@ -5,7 +5,12 @@
 package commands
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"time"
+
+	"github.com/spf13/cobra"
 )
 
 // A small HTTP server that can be used to communicate with the device through
@@ -20,20 +25,132 @@ func uartName(name string) string {
 	return name + "-uart"
 }
 
-func runUartProxy(dev *serialPort, reader HasDataReader) error {
-	ud := newUartDevice(dev, reader)
+func addUartTransferFlags(cmd *cobra.Command) {
+	cmd.Flags().Uint("uart-chunk-size", legacyUartChunkSize, "the size of the chunks when streaming images to the device")
+	cmd.Flags().Uint("uart-window", 0, "the maximum number of unacknowledged bytes when streaming images; 0 uses the device's limit")
+}
+
+func getUartTransferFlags(cmd *cobra.Command) (chunkSize int, window int, err error) {
+	chunk, err := cmd.Flags().GetUint("uart-chunk-size")
+	if err != nil {
+		return 0, 0, err
+	}
+	if chunk == 0 || chunk > 65535 {
+		return 0, 0, fmt.Errorf("invalid chunk size %d; must be between 1 and 65535", chunk)
+	}
+	win, err := cmd.Flags().GetUint("uart-window")
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(chunk), int(win), nil
+}
+
+// uartProxyConfig configures a UART proxy.
+type uartProxyConfig struct {
+	log *logger
+	// network configures how the proxy is reachable. If it is nil, the
+	// proxy listens on all interfaces and broadcasts its address.
+	network *proxyNetwork
+	// serialPort is the port the device is connected to. It is only used
+	// for reporting.
+	serialPort string
+	// chunkSize and window configure how data is streamed to the device.
+	// They are limited by what the device supports. Zero values use the
+	// device's limits.
+	chunkSize int
+	window    int
+	// syncTimeout bounds the initial synchronization with the device.
+	// If it is zero, the default synchronization timeout is used.
+	syncTimeout time.Duration
+	// reconnected receives a value whenever the serial port has been
+	// reopened. The proxy then synchronizes with the device again.
+	reconnected <-chan struct{}
+	// onIdentified, if not nil, is called once the device has identified
+	// itself.
+	onIdentified func(identity *uartIdentity)
+	// logs, if not nil, receives the output of the device, which the
+	// dashboard shows.
+	logs *logHub
+	// getSDK returns the SDK for running snapshots from the dashboard.
+	// If it is nil, the SDK of jag is used.
+	getSDK func(ctx context.Context) (*SDK, error)
+}
 
-	err := ud.Sync()
+// runUartProxy serves the device connected through the given writer and
+// reader on the local network until the context is done.
+func runUartProxy(ctx context.Context, writer io.Writer, reader HasDataReader, config *uartProxyConfig) error {
+	ud := newUartDevice(ctx, writer, reader)
+	defer ud.Close()
+
+	syncTimeout := config.syncTimeout
+	if syncTimeout == 0 {
+		syncTimeout = syncTimeoutSeconds * time.Second
+	}
+	err := ud.SyncWithin(syncTimeout)
 	if err != nil {
 		return err
 	}
 
 	identity, err := ud.Identify()
 	if err != nil {
-		// TODO(florian): this print should be a log.
-		fmt.Println("Identify error")
+		config.log.Errorf("failed to identify the device: %v", err)
 		return err
 	}
 
-	return runProxyServer(ud, identity)
+	configureUartDevice(ud, identity, config)
+
+	if config.onIdentified != nil {
+		config.onIdentified(identity)
+	}
+
+	// The device identifies again when it reboots, for example after a
+	// firmware update. The proxy then serves the new identity.
+	identityChanged := make(chan struct{}, 1)
+	ud.OnIdentityChange(func(identity *uartIdentity) {
+		configureUartDevice(ud, identity, config)
+		select {
+		case identityChanged <- struct{}{}:
+		default:
+			// The server hasn't handled the previous change yet.
+		}
+	})
+
+	if config.reconnected != nil {
+		go func() {
+			for range config.reconnected {
+				resyncUartProxy(ud, config)
+			}
+		}()
+	}
+
+	return runProxyServer(ctx, ud, identityChanged, config)
+}
+
+// resyncUartProxy synchronizes with the device after the serial port was
+// reopened, and identifies it again, as a different device might be
+// connected now.
+func resyncUartProxy(ud *uartDevice, config *uartProxyConfig) {
+	log := config.log
+	if err := ud.Sync(); err != nil {
+		log.Warnf("failed to synchronize after reconnecting: %v", err)
+		return
+	}
+	if _, err := ud.Reidentify(); err != nil {
+		log.Warnf("failed to identify after reconnecting: %v", err)
+	}
+}
+
+// configureUartDevice adapts the proxy to the capabilities of the device.
+func configureUartDevice(ud *uartDevice, identity *uartIdentity, config *uartProxyConfig) {
+	capabilities, err := ud.Capabilities(identity)
+	if err != nil {
+		config.log.Warnf("failed to get the capabilities of the device: %v", err)
+		// Fall back to what all firmware supports.
+		capabilities, _ = ud.Capabilities(&uartIdentity{})
+	}
+	ud.SetCrc(capabilities.has(featureUartCrc))
+	ud.SetTransferOptions(capabilities, config.chunkSize, config.window)
+	chunkSize, window := ud.TransferOptions()
+	config.log.Debugf("protocol version %d, features %v", capabilities.ProtocolVersion, capabilities.Features)
+	config.log.Debugf("streaming in chunks of %d bytes with a window of %d bytes", chunkSize, window)
 }
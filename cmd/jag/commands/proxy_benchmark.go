@@ -0,0 +1,120 @@
+// Copyright (C) 2026 Toit contributors.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func ProxyBenchmarkCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "benchmark",
+		Short: "Measure the throughput of a device's UART endpoint",
+		Long: "Measure the throughput of a device's UART endpoint.\n" +
+			"Streams data to the device, which drops it, once with the transfer settings\n" +
+			"of older firmware and once with the configured chunk size and window.\n" +
+			"The port must not be used by a proxy or monitor at the same time.",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			port, err := cmd.Flags().GetString("port")
+			if err != nil {
+				return err
+			}
+			port, err = checkPort(port, false)
+			if err != nil {
+				return err
+			}
+			baud, err := cmd.Flags().GetUint("baud")
+			if err != nil {
+				return err
+			}
+			size, err := cmd.Flags().GetUint("size")
+			if err != nil {
+				return err
+			}
+			if size == 0 {
+				return fmt.Errorf("the size must be positive")
+			}
+			chunkSize, window, err := getUartTransferFlags(cmd)
+			if err != nil {
+				return err
+			}
+
+			dev, err := serialOpen(port, int(baud))
+			if err != nil {
+				return err
+			}
+			defer dev.Close()
+
+			logs, packets := multiplexReader(dev)
+			go io.Copy(io.Discard, logs)
+
+			ud := newUartDevice(ctx, &lockedWriter{w: dev}, packets)
+			defer ud.Close()
+			fmt.Printf("Synchronizing with the device on '%s' ...\n", port)
+			if err := ud.SyncWithin(15 * time.Second); err != nil {
+				return fmt.Errorf("the device didn't answer: %w", err)
+			}
+			identity, err := ud.Identify()
+			if err != nil {
+				return err
+			}
+			capabilities, err := ud.Capabilities(identity)
+			if err != nil {
+				return err
+			}
+			if !capabilities.has(featureUartDiscard) {
+				return &FirmwareTooOldError{Device: identity.Name, Feature: featureUartDiscard}
+			}
+			ud.SetCrc(capabilities.has(featureUartCrc))
+
+			data := make([]byte, size)
+			rand.Read(data)
+			// The link transfers 10 bits per byte: a start bit, 8 data bits,
+			// and a stop bit.
+			linkRate := float64(baud) / 10
+
+			run := func(description string, capabilities *uartCapabilities, chunkSize int, window int) error {
+				ud.SetTransferOptions(capabilities, chunkSize, window)
+				chunkSize, window = ud.TransferOptions()
+				start := time.Now()
+				if err := ud.Discard(data); err != nil {
+					return err
+				}
+				elapsed := time.Since(start)
+				rate := float64(len(data)) / elapsed.Seconds()
+				fmt.Printf("%-8s chunk %5d, window %6d: %8.1f KiB/s (%.0f%% of %d baud) in %v\n",
+					description, chunkSize, window, rate/1024, 100*rate/linkRate, baud, elapsed.Round(time.Millisecond))
+				return nil
+			}
+
+			fmt.Printf("Streaming %d bytes to '%s' (device window: %d bytes)\n", len(data), identity.Name, capabilities.Window)
+			if err := run("legacy", &uartCapabilities{}, 0, 0); err != nil {
+				return err
+			}
+			if err := run("windowed", capabilities, chunkSize, window); err != nil {
+				return err
+			}
+			stats := ud.Stats()
+			fmt.Printf("Packets: %d sent, %d received, %d NAKs, %d corrupted, %d retransmitted\n",
+				stats.PacketsSent, stats.PacketsReceived, stats.Naks, stats.CorruptPackets, stats.Retransmissions)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringP("port", "p", ConfiguredPort(), "port of the device")
+	cmd.Flags().Uint("baud", defaultProxyBaudRate, "the baud rate of the device's UART endpoint")
+	cmd.Flags().Uint("size", 256*1024, "the number of bytes to send per measurement")
+	addUartTransferFlags(cmd)
+	return cmd
+}
@@ -0,0 +1,312 @@
+// Copyright (C) 2026 Toit contributors.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func ProxyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "proxy",
+		Short: "Proxy all Jaguar devices connected over serial to the local network",
+		Long: "Proxy all Jaguar devices that are connected over serial to the local network.\n" +
+			"The serial ports are scanned continuously. Every port with a device that runs\n" +
+			"Jaguar's UART endpoint gets its own proxy, just like 'jag monitor --proxy'.\n" +
+			"Devices that are plugged in later are picked up automatically, and proxies of\n" +
+			"devices that disappear are stopped.",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			ports, err := cmd.Flags().GetStringArray("port")
+			if err != nil {
+				return err
+			}
+			all, err := cmd.Flags().GetBool("all")
+			if err != nil {
+				return err
+			}
+			baud, err := cmd.Flags().GetUint("baud")
+			if err != nil {
+				return err
+			}
+			pollInterval, err := cmd.Flags().GetDuration("poll-interval")
+			if err != nil {
+				return err
+			}
+			identifyTimeout, err := cmd.Flags().GetDuration("identify-timeout")
+			if err != nil {
+				return err
+			}
+			retryInterval, err := cmd.Flags().GetDuration("retry-interval")
+			if err != nil {
+				return err
+			}
+			showOutput, err := cmd.Flags().GetBool("output")
+			if err != nil {
+				return err
+			}
+			verbose, err := cmd.Flags().GetBool("verbose")
+			if err != nil {
+				return err
+			}
+			timestamps, err := cmd.Flags().GetBool("timestamps")
+			if err != nil {
+				return err
+			}
+
+			level := logLevelInfo
+			if verbose {
+				level = logLevelDebug
+			}
+			log := newLogger("jaguar.proxy", os.Stdout, level)
+			if timestamps {
+				log = log.withTimestamps()
+			}
+
+			listPorts := func() ([]string, error) {
+				if len(ports) > 0 {
+					// Only the given ports that are currently present.
+					var result []string
+					for _, port := range ports {
+						if exists, err := PortExists(port); err == nil && exists {
+							result = append(result, port)
+						}
+					}
+					return result, nil
+				}
+				available, err := getPorts(all)
+				if err != nil {
+					return nil, err
+				}
+				var result []string
+				for _, port := range available.Ports {
+					result = append(result, string(port))
+				}
+				return result, nil
+			}
+
+			network, err := getProxyNetwork(cmd)
+			if err != nil {
+				return err
+			}
+			chunkSize, window, err := getUartTransferFlags(cmd)
+			if err != nil {
+				return err
+			}
+
+			daemon := &proxyDaemon{
+				log:             log,
+				network:         network,
+				chunkSize:       chunkSize,
+				window:          window,
+				baud:            int(baud),
+				identifyTimeout: identifyTimeout,
+				retryInterval:   retryInterval,
+				active:          map[string]*proxiedPort{},
+				failed:          map[string]time.Time{},
+			}
+			if showOutput {
+				daemon.output = &lockedWriter{w: os.Stdout}
+			}
+			return daemon.run(ctx, listPorts, pollInterval)
+		},
+	}
+
+	cmd.AddCommand(ProxyBenchmarkCmd())
+
+	cmd.Flags().StringArrayP("port", "p", nil, "only proxy the given port; can be repeated")
+	cmd.Flags().Bool("all", false, "also consider ports that don't look like ESP32 devices")
+	cmd.Flags().Uint("baud", defaultProxyBaudRate, "the baud rate of the devices' UART endpoints")
+	cmd.Flags().Duration("poll-interval", 2*time.Second, "how often to look for new serial ports")
+	cmd.Flags().Duration("identify-timeout", 15*time.Second, "how long to wait for a device to answer on a new port")
+	cmd.Flags().Duration("retry-interval", 30*time.Second, "how long to wait before trying a port again that didn't answer")
+	cmd.Flags().Bool("output", false, "print the serial output of the devices, prefixed with their port")
+	addProxyNetworkFlags(cmd)
+	addUartTransferFlags(cmd)
+	cmd.Flags().BoolP("verbose", "v", false, "log debug messages")
+	cmd.Flags().Bool("timestamps", false, "prefix log messages with the time")
+	return cmd
+}
+
+// proxyDaemon runs a UART proxy for every serial port with a Jaguar device.
+type proxyDaemon struct {
+	log             *logger
+	network         *proxyNetwork
+	chunkSize       int
+	window          int
+	baud            int
+	identifyTimeout time.Duration
+	retryInterval   time.Duration
+	// output receives the serial output of the devices, if not nil.
+	output io.Writer
+
+	mu sync.Mutex
+	// active contains the ports that are currently served.
+	active map[string]*proxiedPort
+	// failed contains the time of the last failed attempt for ports without
+	// Jaguar device.
+	failed map[string]time.Time
+}
+
+type proxiedPort struct {
+	// cancel stops serving the port.
+	cancel context.CancelFunc
+}
+
+// run scans for ports until the context is done.
+func (d *proxyDaemon) run(ctx context.Context, listPorts func() ([]string, error), pollInterval time.Duration) error {
+	d.log.Infof("looking for Jaguar devices on the serial ports")
+	for {
+		ports, err := listPorts()
+		if err != nil {
+			d.log.Warnf("failed to list the serial ports: %v", err)
+		} else {
+			d.update(ctx, ports)
+		}
+
+		select {
+		case <-ctx.Done():
+			d.mu.Lock()
+			for _, p := range d.active {
+				p.cancel()
+			}
+			d.mu.Unlock()
+			return nil
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// update starts proxies for new ports and stops the proxies of ports that
+// disappeared.
+func (d *proxyDaemon) update(ctx context.Context, ports []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	present := map[string]bool{}
+	for _, port := range ports {
+		present[port] = true
+	}
+	var removed []string
+	for port := range d.active {
+		if !present[port] {
+			removed = append(removed, port)
+		}
+	}
+	sort.Strings(removed)
+	for _, port := range removed {
+		d.log.Infof("port '%s' disappeared", port)
+		d.active[port].cancel()
+		delete(d.active, port)
+	}
+	for port := range d.failed {
+		if !present[port] {
+			// Try again right away if the port comes back.
+			delete(d.failed, port)
+		}
+	}
+
+	for _, port := range ports {
+		if _, ok := d.active[port]; ok {
+			continue
+		}
+		if last, ok := d.failed[port]; ok && time.Since(last) < d.retryInterval {
+			continue
+		}
+		portCtx, cancel := context.WithCancel(ctx)
+		p := &proxiedPort{cancel: cancel}
+		d.active[port] = p
+		go d.serve(portCtx, p, port)
+	}
+}
+
+// serve runs the proxy for the device on the given port until the context
+// is done, or the device stops answering.
+func (d *proxyDaemon) serve(ctx context.Context, p *proxiedPort, port string) {
+	cancel := p.cancel
+	log := d.log.named(portLabel(port))
+	identified := false
+	defer func() {
+		cancel()
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		// The port might have been removed and added again in the meantime.
+		if d.active[port] == p {
+			delete(d.active, port)
+			if !identified {
+				d.failed[port] = time.Now()
+			}
+		}
+	}()
+
+	log.Debugf("probing port '%s'", port)
+	dev, err := serialOpen(port, d.baud)
+	if err != nil {
+		log.Debugf("%v", err)
+		return
+	}
+	defer dev.Close()
+	go func() {
+		<-ctx.Done()
+		// Closing the port ends the reads.
+		dev.Close()
+	}()
+
+	logs, packets := multiplexReader(dev)
+	// The dashboard of the proxy shows the output of the device.
+	hub := newLogHub()
+	go func() {
+		var out io.Writer = io.Discard
+		if d.output != nil {
+			out = newPrefixWriter(d.output, "["+portLabel(port)+"] ")
+		}
+		scanner := bufio.NewScanner(io.TeeReader(logs, hub))
+		for scanner.Scan() {
+			fmt.Fprintln(out, scanner.Text())
+		}
+		// The port failed or was closed.
+		cancel()
+	}()
+
+	config := &uartProxyConfig{
+		log:         log,
+		network:     d.network,
+		serialPort:  port,
+		chunkSize:   d.chunkSize,
+		window:      d.window,
+		syncTimeout: d.identifyTimeout,
+		logs:        hub,
+	}
+	config.onIdentified = func(identity *uartIdentity) {
+		identified = true
+		log.Infof("found Jaguar device '%s' on port '%s'", identity.Name, port)
+	}
+	err = runUartProxy(ctx, &lockedWriter{w: dev}, packets, config)
+	if ctx.Err() != nil {
+		if identified {
+			log.Infof("stopped proxying port '%s'", port)
+		}
+		return
+	}
+	if err != nil {
+		if identified {
+			log.Errorf("proxy for port '%s' failed: %v", port, err)
+		} else {
+			log.Debugf("no Jaguar device answered on port '%s': %v", port, err)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright (C) 2026 Toit contributors.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProxyDaemon(t *testing.T) {
+	const missing = "/jaguar-test-port-that-does-not-exist"
+	daemon := &proxyDaemon{
+		log:           newLogger("jaguar.proxy", io.Discard, logLevelInfo),
+		retryInterval: time.Hour,
+		active:        map[string]*proxiedPort{},
+		failed:        map[string]time.Time{},
+	}
+
+	// A port that is served, but disappears with the first scan.
+	goneCtx, goneCancel := context.WithCancel(context.Background())
+	daemon.active["gone"] = &proxiedPort{cancel: goneCancel}
+
+	var mu sync.Mutex
+	ports := []string{missing}
+	listPorts := func() ([]string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, ports...), nil
+	}
+	setPorts := func(list ...string) {
+		mu.Lock()
+		defer mu.Unlock()
+		ports = list
+	}
+	failedAt := func() (time.Time, bool) {
+		daemon.mu.Lock()
+		defer daemon.mu.Unlock()
+		last, ok := daemon.failed[missing]
+		return last, ok
+	}
+	waitFor := func(description string, condition func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !condition() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting until %s", description)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- daemon.run(ctx, listPorts, 5*time.Millisecond)
+	}()
+
+	select {
+	case <-goneCtx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the proxy of a port that disappeared wasn't stopped")
+	}
+
+	// The port can't be opened, so it waits for the retry interval.
+	waitFor("the port failed", func() bool {
+		_, ok := failedAt()
+		return ok
+	})
+	first, _ := failedAt()
+	time.Sleep(50 * time.Millisecond)
+	if last, ok := failedAt(); !ok || last != first {
+		t.Error("a failed port was tried again before the retry interval")
+	}
+
+	// A port that comes back is tried again right away.
+	setPorts()
+	waitFor("the failed port was forgotten", func() bool {
+		_, ok := failedAt()
+		return !ok
+	})
+	setPorts(missing)
+	waitFor("the port was tried again", func() bool {
+		last, ok := failedAt()
+		return ok && last.After(first)
+	})
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the daemon didn't stop")
+	}
+}
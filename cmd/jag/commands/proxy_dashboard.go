@@ -0,0 +1,271 @@
+// Copyright (C) 2026 Toit contributors.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/toitware/ubjson"
+)
+
+// The dashboard of a proxied device is served from embedded files, so that
+// it works without internet access. The page uses the JSON API below the
+// '/api/' path.
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// The number of log lines the dashboard shows when it connects.
+const logHubHistory = 500
+
+// logHub keeps the recent output of a device and passes new lines to
+// subscribers, like the log view of the dashboard.
+type logHub struct {
+	mu          sync.Mutex
+	partial     []byte
+	lines       []string
+	subscribers map[chan string]struct{}
+}
+
+func newLogHub() *logHub {
+	return &logHub{subscribers: map[chan string]struct{}{}}
+}
+
+// Write splits the output into lines and passes them on.
+// Write never blocks; subscribers that don't keep up lose lines.
+func (h *logHub) Write(p []byte) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, b := range p {
+		if b != '\n' {
+			h.partial = append(h.partial, b)
+			continue
+		}
+		line := string(h.partial)
+		if len(line) > 0 && line[len(line)-1] == '\r' {
+			line = line[:len(line)-1]
+		}
+		h.partial = h.partial[:0]
+		h.lines = append(h.lines, line)
+		if len(h.lines) > logHubHistory {
+			h.lines = h.lines[len(h.lines)-logHubHistory:]
+		}
+		for ch := range h.subscribers {
+			select {
+			case ch <- line:
+			default:
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// subscribe returns the recent lines, and a channel that receives the
+// lines that are written from now on.
+func (h *logHub) subscribe() ([]string, chan string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ch := make(chan string, 100)
+	h.subscribers[ch] = struct{}{}
+	return append([]string{}, h.lines...), ch
+}
+
+func (h *logHub) unsubscribe(ch chan string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subscribers, ch)
+}
+
+// dashboard serves the web interface of a proxied device.
+type dashboard struct {
+	ctx        context.Context
+	ud         *uartDevice
+	address    string
+	serialPort string
+	// logs is the output of the device, or nil if it isn't available.
+	logs *logHub
+	// getSDK returns the SDK that builds images from uploaded snapshots.
+	getSDK func(ctx context.Context) (*SDK, error)
+	log    *logger
+}
+
+func (d *dashboard) register(mux *http.ServeMux) {
+	files, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		panic(err)
+	}
+	fileServer := http.FileServer(http.FS(files))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if r.URL.Path == "/favicon.ico" {
+			http.Redirect(w, r, "/chip.svg", http.StatusFound)
+			return
+		}
+		fileServer.ServeHTTP(w, r)
+	})
+	mux.HandleFunc("/api/device", d.handleDevice)
+	mux.HandleFunc("/api/containers", d.handleContainers)
+	mux.HandleFunc("/api/logs", d.handleLogs)
+	mux.HandleFunc("/api/run", d.handleRun)
+}
+
+func writeJson(w http.ResponseWriter, value interface{}) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(encoded)
+}
+
+func (d *dashboard) handleDevice(w http.ResponseWriter, r *http.Request) {
+	identity := d.ud.Identity()
+	chunkSize, window := d.ud.TransferOptions()
+	features := identity.Features
+	if features == nil {
+		features = []string{}
+	}
+	writeJson(w, map[string]interface{}{
+		"name":            identity.Name,
+		"id":              identity.Id,
+		"chip":            identity.Chip,
+		"sdkVersion":      identity.SdkVersion,
+		"protocolVersion": identity.ProtocolVersion,
+		"features":        features,
+		"address":         d.address,
+		"serialPort":      d.serialPort,
+		"chunkSize":       chunkSize,
+		"window":          window,
+		"stats":           d.ud.Stats(),
+	})
+}
+
+type dashboardContainer struct {
+	Name string `json:"name"`
+	Id   string `json:"id"`
+}
+
+func (d *dashboard) handleContainers(w http.ResponseWriter, r *http.Request) {
+	encoded, err := d.ud.ListContainers()
+	if err != nil {
+		d.log.Warnf("failed to list the containers: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var containers map[string]string
+	if err := ubjson.Unmarshal(encoded, &containers); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	result := []dashboardContainer{}
+	for id, name := range containers {
+		result = append(result, dashboardContainer{Name: name, Id: id})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	writeJson(w, map[string]interface{}{"containers": result})
+}
+
+// handleLogs streams the output of the device as server-sent events.
+func (d *dashboard) handleLogs(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if d.logs == nil || !ok {
+		// Tells the browser not to reconnect.
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	history, lines := d.logs.subscribe()
+	defer d.logs.unsubscribe(lines)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	// Clients that follow the output of a program only want new lines.
+	if r.URL.Query().Get("history") != "false" {
+		for _, line := range history {
+			fmt.Fprintf(w, "data: %s\n\n", line)
+		}
+	}
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-d.ctx.Done():
+			return
+		case line := <-lines:
+			fmt.Fprintf(w, "data: %s\n\n", line)
+			flusher.Flush()
+		}
+	}
+}
+
+// handleRun builds an image from the uploaded snapshot and runs it on the
+// device.
+// Like the device's own '/run', it only accepts PUT. Browsers don't send PUT
+// requests from other origins without a CORS preflight, which the proxy
+// doesn't answer, so other web pages can't run code on the device.
+func (d *dashboard) handleRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	fail := func(status int, err error) {
+		d.log.Warnf("failed to run the uploaded snapshot: %v", err)
+		w.WriteHeader(status)
+		w.Write([]byte(err.Error() + "\n"))
+	}
+	identity := d.ud.Identity()
+	sdk, err := d.getSDK(d.ctx)
+	if err != nil {
+		fail(http.StatusInternalServerError, err)
+		return
+	}
+	if sdk.Version != identity.SdkVersion {
+		fail(http.StatusNotAcceptable, fmt.Errorf("the device has SDK version '%s', but the proxy has '%s'", identity.SdkVersion, sdk.Version))
+		return
+	}
+
+	snapshot, err := ioutil.TempFile("", "jag-dashboard-*.snapshot")
+	if err != nil {
+		fail(http.StatusInternalServerError, err)
+		return
+	}
+	defer os.Remove(snapshot.Name())
+	_, err = io.Copy(snapshot, r.Body)
+	snapshot.Close()
+	if err != nil {
+		fail(http.StatusBadRequest, err)
+		return
+	}
+	if !IsSnapshot(snapshot.Name()) {
+		fail(http.StatusBadRequest, fmt.Errorf("the uploaded file is not a snapshot"))
+		return
+	}
+
+	image, err := sdk.BuildImage(d.ctx, identity.wordSize(), snapshot.Name(), "")
+	if err != nil {
+		fail(http.StatusBadRequest, fmt.Errorf("failed to build the image: %w", err))
+		return
+	}
+	if err := d.ud.Run(map[string]interface{}{}, newUartUpload(image)); err != nil {
+		fail(http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,149 @@
+// Copyright (C) 2026 Toit contributors.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/toitware/ubjson"
+)
+
+func TestLogHub(t *testing.T) {
+	hub := newLogHub()
+	hub.Write([]byte("first\r\nsec"))
+	history, lines := hub.subscribe()
+	defer hub.unsubscribe(lines)
+	if len(history) != 1 || history[0] != "first" {
+		t.Errorf("got history %q", history)
+	}
+	hub.Write([]byte("ond\n"))
+	if line := <-lines; line != "second" {
+		t.Errorf("got %q", line)
+	}
+
+	for i := 0; i < logHubHistory+10; i++ {
+		fmt.Fprintf(hub, "line %d\n", i)
+	}
+	history, _ = hub.subscribe()
+	if len(history) != logHubHistory || history[len(history)-1] != fmt.Sprintf("line %d", logHubHistory+9) {
+		t.Errorf("got %d lines, ending with %q", len(history), history[len(history)-1])
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	responses := &chunkReader{ch: make(chan []byte, 10)}
+	respond := writerFunc(func(p []byte) (int, error) {
+		var response []byte
+		switch command := p[2]; command {
+		case commandIdentify:
+			encoded, err := ubjson.Marshal(map[string]interface{}{"name": "dev", "id": "1234", "sdkVersion": "v2.0.0"})
+			if err != nil {
+				return 0, err
+			}
+			response = append([]byte{command}, encoded...)
+		case commandListContainers:
+			encoded, err := ubjson.Marshal(map[string]string{"id-b": "b", "id-a": "a"})
+			if err != nil {
+				return 0, err
+			}
+			response = append([]byte{command}, encoded...)
+		default:
+			return len(p), nil
+		}
+		packet := appendUint16Le(nil, uint16(len(response)))
+		packet = append(packet, response...)
+		responses.ch <- append(packet, '\n')
+		return len(p), nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ud := newUartDevice(ctx, respond, responses)
+	defer ud.Close()
+	if _, err := ud.Identify(); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	d := &dashboard{
+		ctx:     ctx,
+		ud:      ud,
+		address: "http://127.0.0.1:1234",
+		logs:    newLogHub(),
+		getSDK: func(ctx context.Context) (*SDK, error) {
+			return &SDK{Version: "v1.0.0"}, nil
+		},
+		log: newLogger("test", ioutil.Discard, logLevelFatal),
+	}
+	d.register(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	get := func(path string) (int, string) {
+		res, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode, string(body)
+	}
+
+	// The page and its assets are embedded.
+	for _, path := range []string{"/", "/style.css", "/dashboard.css", "/dashboard.js", "/chip.svg"} {
+		if status, _ := get(path); status != http.StatusOK {
+			t.Errorf("got status %d for '%s'", status, path)
+		}
+	}
+
+	status, body := get("/api/device")
+	var device map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &device); err != nil || status != http.StatusOK {
+		t.Fatalf("got %d: %s", status, body)
+	}
+	if device["name"] != "dev" || device["id"] != "1234" || device["address"] != "http://127.0.0.1:1234" {
+		t.Errorf("got %v", device)
+	}
+
+	status, body = get("/api/containers")
+	if status != http.StatusOK || body != `{"containers":[{"name":"a","id":"id-a"},{"name":"b","id":"id-b"}]}` {
+		t.Errorf("got %d: %s", status, body)
+	}
+
+	// Other web pages can send POST requests without a CORS preflight, so
+	// programs can only be run with PUT.
+	res, err := http.Post(server.URL+"/api/run", "application/octet-stream", strings.NewReader("snapshot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("got status %s for a POST request", res.Status)
+	}
+
+	// Snapshots must be built with the SDK of the device.
+	req, err := http.NewRequest(http.MethodPut, server.URL+"/api/run", strings.NewReader("snapshot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotAcceptable {
+		t.Errorf("got status %s for a different SDK", res.Status)
+	}
+}
@@ -8,10 +8,12 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/toitware/ubjson"
@@ -27,10 +29,31 @@ const (
 	commandFirmware       = 5
 	commandInstall        = 6
 	commandRun            = 7
+	commandDiscard        = 8
+	commandCapabilities   = 9
+	// Sent by the device when it received a corrupted request.
+	commandNak = 126
 
 	responseAck = 255
 
+	// Packets with this bit set in their command byte end with the CRC32 of
+	// the command and payload.
+	packetCrcFlag = 0x80
+	// The number of times a request is retransmitted after it was corrupted.
+	maxPacketRetries = 3
+	// When the device doesn't answer in time, the proxy assumes the request
+	// was corrupted.
+	responseTimeout = 10 * time.Second
+
 	syncTimeoutSeconds = 600
+
+	// How often the device is synchronized and identified again while it
+	// is idle.
+	uartKeepaliveInterval = 5 * time.Second
+
+	// Transfers to devices that don't advertise a receive window send one
+	// chunk of this size at a time and wait for it to be acknowledged.
+	legacyUartChunkSize = 512
 )
 
 type HasDataReader interface {
@@ -38,122 +61,295 @@ type HasDataReader interface {
 	HasData() bool
 }
 
+// uartReader reads from the underlying reader of a uartDevice in the
+// background, so that reads can give up without losing data.
+type uartReader struct {
+	underlying HasDataReader
+	chunks     chan []byte
+	// err is the error of the underlying reader. It is set before chunks is
+	// closed.
+	err error
+	// pending is the rest of a chunk that didn't fit into the last read.
+	pending []byte
+	// ctx ends reads that wait for data once it is done.
+	ctx context.Context
+}
+
+func newUartReader(ctx context.Context, underlying HasDataReader) *uartReader {
+	r := &uartReader{
+		underlying: underlying,
+		chunks:     make(chan []byte, 16),
+		ctx:        ctx,
+	}
+	go r.pump(ctx)
+	return r
+}
+
+// pump moves the data of the underlying reader to the chunks until the
+// context is done or the underlying reader fails.
+func (r *uartReader) pump(ctx context.Context) {
+	defer close(r.chunks)
+	for {
+		buffer := make([]byte, 1024)
+		count, err := r.underlying.Read(buffer)
+		if count > 0 {
+			select {
+			case r.chunks <- buffer[:count]:
+			case <-ctx.Done():
+				r.err = ctx.Err()
+				return
+			}
+		}
+		if err != nil {
+			r.err = err
+			return
+		}
+	}
+}
+
+func (r *uartReader) Read(p []byte) (int, error) {
+	if len(r.pending) == 0 {
+		select {
+		case data, ok := <-r.chunks:
+			if !ok {
+				return 0, r.err
+			}
+			r.pending = data
+		case <-r.ctx.Done():
+			return 0, r.ctx.Err()
+		}
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// HasData returns whether there is data that can be read without waiting.
+func (r *uartReader) HasData() bool {
+	return len(r.pending) > 0 || len(r.chunks) > 0 || r.underlying.HasData()
+}
+
+// discard drops the data that has been received so far.
+func (r *uartReader) discard() {
+	r.pending = nil
+	for {
+		select {
+		case _, ok := <-r.chunks:
+			if !ok {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
 type uartDevice struct {
-	lock             sync.Mutex
-	writer           io.Writer
-	underlyingReader HasDataReader
-	bufferedReader   *bufio.Reader
-	syncId           int
+	lock           sync.Mutex
+	writer         io.Writer
+	reader         *uartReader
+	bufferedReader *bufio.Reader
+	// syncId is the id of the last sync request. It is updated atomically.
+	syncId int32
+	// chunkSize is the size of the writes when streaming data.
+	chunkSize int
+	// window is the maximum number of streamed bytes that haven't been
+	// acknowledged yet.
+	window int
+	// crc is whether packets are protected by a CRC.
+	crc bool
+	// needsSync is set when the device might not be ready for the next
+	// request.
+	needsSync bool
+	stats     uartStats
+
+	// ctx is canceled when the device is closed.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// done is closed once the keepalive goroutine has stopped.
+	done chan struct{}
+	// identity is the last identity of the device, or nil if the device
+	// hasn't been identified yet.
+	identity *uartIdentity
+	// onIdentityChange, if not nil, is called when the device identifies
+	// differently than before, for example after a firmware update.
+	onIdentityChange func(identity *uartIdentity)
 }
 
-func newUartDevice(writer io.Writer, reader HasDataReader) *uartDevice {
+var (
+	errUartClosed  = errors.New("the UART device is closed")
+	errUartNak     = errors.New("the device received a corrupted request")
+	errUartCorrupt = errors.New("received a corrupted response")
+)
+
+// uartStats counts the packets and transmission errors of a uartDevice.
+// The fields are updated atomically.
+type uartStats struct {
+	PacketsSent     uint64 `json:"packetsSent"`
+	PacketsReceived uint64 `json:"packetsReceived"`
+	Naks            uint64 `json:"naks"`
+	CorruptPackets  uint64 `json:"corruptPackets"`
+	Timeouts        uint64 `json:"timeouts"`
+	Retransmissions uint64 `json:"retransmissions"`
+	Syncs           uint64 `json:"syncs"`
+}
+
+// Stats returns a snapshot of the packet and error counters.
+func (d *uartDevice) Stats() uartStats {
+	return uartStats{
+		PacketsSent:     atomic.LoadUint64(&d.stats.PacketsSent),
+		PacketsReceived: atomic.LoadUint64(&d.stats.PacketsReceived),
+		Naks:            atomic.LoadUint64(&d.stats.Naks),
+		CorruptPackets:  atomic.LoadUint64(&d.stats.CorruptPackets),
+		Timeouts:        atomic.LoadUint64(&d.stats.Timeouts),
+		Retransmissions: atomic.LoadUint64(&d.stats.Retransmissions),
+		Syncs:           atomic.LoadUint64(&d.stats.Syncs),
+	}
+}
+
+// newUartDevice creates a device that communicates through the given
+// writer and reader.
+// The device is kept synchronized in the background until the context is
+// done or the device is closed. Once it has been identified, it is also
+// identified again, so that a reboot into different firmware is noticed.
+func newUartDevice(ctx context.Context, writer io.Writer, reader HasDataReader) *uartDevice {
+	ctx, cancel := context.WithCancel(ctx)
+	// Closing the device ends the reads, so that a device that doesn't
+	// answer can't keep a request, and with it Close, waiting.
+	uartReader := newUartReader(ctx, reader)
 	result := &uartDevice{
-		writer:           writer,
-		underlyingReader: reader,
-		bufferedReader:   bufio.NewReader(reader),
+		writer:         writer,
+		reader:         uartReader,
+		bufferedReader: bufio.NewReader(uartReader),
+		chunkSize:      legacyUartChunkSize,
+		window:         legacyUartChunkSize,
+		ctx:            ctx,
+		cancel:         cancel,
+		done:           make(chan struct{}),
 	}
-	go func() {
-		for {
-			// Synchronize every 5 seconds.
-			time.Sleep(5 * time.Second)
-			result.Sync()
-		}
-	}()
+	go result.keepalive()
 	return result
 }
 
+// Close stops the background synchronization and makes further requests
+// fail. A request that is in progress fails as well.
+func (d *uartDevice) Close() error {
+	d.cancel()
+	<-d.done
+	return nil
+}
+
+// OnIdentityChange registers a function that is called when the device
+// identifies differently than before.
+// The function is called without holding the device lock, so it may send
+// requests to the device.
+func (d *uartDevice) OnIdentityChange(f func(identity *uartIdentity)) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.onIdentityChange = f
+}
+
+func (d *uartDevice) keepalive() {
+	defer close(d.done)
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-time.After(uartKeepaliveInterval):
+		}
+		if err := d.Sync(); err != nil {
+			continue
+		}
+		d.lock.Lock()
+		identified := d.identity != nil
+		d.lock.Unlock()
+		if identified {
+			d.Reidentify()
+		}
+	}
+}
+
 // Sync synchronizes the device with the server.
 // The server repeatedly sends a sync request to the device, and the device
 // responds with a sync response.
 func (d *uartDevice) Sync() error {
+	return d.SyncWithin(syncTimeoutSeconds * time.Second)
+}
+
+// SyncWithin synchronizes like Sync, but gives up after the given timeout.
+func (d *uartDevice) SyncWithin(timeout time.Duration) error {
 	d.lock.Lock()
 	defer d.lock.Unlock()
-	return d.sync()
+	return d.syncWithin(timeout)
 }
 
 func (d *uartDevice) hasIncomingData() bool {
-	return d.underlyingReader.HasData() || d.bufferedReader.Buffered() > 0
+	return d.reader.HasData() || d.bufferedReader.Buffered() > 0
 }
 
 func (d *uartDevice) sync() error {
-	ctx, cancel := context.WithTimeout(context.Background(), syncTimeoutSeconds*time.Second)
+	return d.syncWithin(syncTimeoutSeconds * time.Second)
+}
+
+func (d *uartDevice) syncWithin(timeout time.Duration) error {
+	if d.ctx.Err() != nil {
+		return errUartClosed
+	}
+	atomic.AddUint64(&d.stats.Syncs, 1)
+	ctx, cancel := context.WithTimeout(d.ctx, timeout)
 	defer cancel()
 
 	// Drain any data that is buffered so far.
-	for d.underlyingReader.HasData() {
-		_, err := d.underlyingReader.Read(nil)
-		if err != nil {
-			return err
-		}
-	}
-	if d.bufferedReader.Buffered() > 0 {
-		d.bufferedReader.Reset(d.underlyingReader)
-	}
+	d.reader.discard()
+	d.bufferedReader.Reset(d.reader)
 
-	errc := make(chan error)
-	successc := make(chan struct{})
-	stopc := make(chan struct{})
-	done := false
+	// Reads give up when the sync does, so that none of them outlives it.
+	d.reader.ctx = ctx
+	defer func() { d.reader.ctx = d.ctx }()
 
+	// Send sync requests until the sync is over.
+	writeErrc := make(chan error, 1)
+	stopc := make(chan struct{})
+	var writers sync.WaitGroup
+	writers.Add(1)
 	go func() {
-		for !done {
-			// Use the '\n' of messages to align the reader.
-			data, err := d.bufferedReader.ReadBytes('\n')
-			if err != nil {
-				errc <- err
+		defer writers.Done()
+		for {
+			// Increment before building, so that the reader can use the id without adjustments.
+			syncRequest := buildSyncRequest(int(atomic.AddInt32(&d.syncId, 1)))
+			if err := d.writeAll(syncRequest); err != nil {
+				writeErrc <- err
+				cancel()
 				return
 			}
-			if len(data) == 0 {
-				continue
-			}
-			expectedSyncPacket := buildExpectedSyncResponse(d.syncId)
-			if !bytes.Equal(data, expectedSyncPacket) {
-				// Discard the data.
-				continue
-			}
-			successc <- struct{}{}
-			return
-		}
-	}()
-
-	go func() {
-		for {
 			select {
-			case <-ctx.Done():
-				errc <- ctx.Err()
-				return
 			case <-stopc:
 				return
-			default:
-				// Send a sync request.
-				// Increment before building, so that the read function can use the id without adjustments.
-				d.syncId++
-				syncRequest := buildSyncRequest(d.syncId)
-				err := d.writeAll(syncRequest)
-				if err != nil {
-					errc <- err
-					return
-				}
-				time.Sleep(2 * time.Second)
+			case <-time.After(2 * time.Second):
 			}
 		}
 	}()
+	defer func() {
+		close(stopc)
+		writers.Wait()
+	}()
 
 	for {
-		select {
-		case <-ctx.Done():
-			done = true
-			stopc <- struct{}{}
-			return ctx.Err()
-		case err := <-errc:
-			done = true
-			stopc <- struct{}{}
-			return err
-		case <-successc:
-			done = true
-			stopc <- struct{}{}
+		// Use the '\n' of messages to align the reader.
+		data, err := d.bufferedReader.ReadBytes('\n')
+		if err != nil {
+			select {
+			case writeErr := <-writeErrc:
+				return writeErr
+			default:
+				return err
+			}
+		}
+		expectedSyncPacket := buildExpectedSyncResponse(int(atomic.LoadInt32(&d.syncId)))
+		if bytes.Equal(data, expectedSyncPacket) {
 			return nil
 		}
+		// Discard the data.
 	}
 }
 
@@ -175,11 +371,145 @@ type uartIdentity struct {
 	Id         string `json:"id"`
 	Chip       string `json:"chip"`
 	SdkVersion string `json:"sdkVersion"`
+	// Window is the number of streamed bytes the device can buffer before
+	// acknowledging them. Older firmware doesn't send it.
+	Window int `json:"window"`
+	// Crc is whether the device supports packets with a CRC.
+	Crc bool `json:"crc"`
+	// ProtocolVersion is 0 for firmware that doesn't announce it.
+	ProtocolVersion int      `json:"protocolVersion"`
+	Features        []string `json:"features"`
+	// WordSize is the size of a word on the device in bytes. Older firmware
+	// only runs on 32-bit devices and doesn't send it.
+	WordSize int `json:"wordSize"`
+}
+
+// wordSize returns the word size of the device in bytes.
+func (i *uartIdentity) wordSize() int {
+	if i.WordSize == 0 {
+		return 4
+	}
+	return i.WordSize
+}
+
+// uartCapabilities describes what the UART endpoint of a device supports.
+type uartCapabilities struct {
+	ProtocolVersion int      `json:"protocolVersion"`
+	Features        []string `json:"features"`
+	// Window is the number of streamed bytes the device can buffer before
+	// acknowledging them, or 0 if it only supports one chunk at a time.
+	Window int `json:"window"`
+}
+
+// sameAs returns whether the two identities are equal.
+func (i *uartIdentity) sameAs(other *uartIdentity) bool {
+	if i.Name != other.Name || i.Id != other.Id || i.Chip != other.Chip ||
+		i.SdkVersion != other.SdkVersion || i.Window != other.Window || i.Crc != other.Crc ||
+		i.ProtocolVersion != other.ProtocolVersion || i.WordSize != other.WordSize || len(i.Features) != len(other.Features) {
+		return false
+	}
+	for j, feature := range i.Features {
+		if other.Features[j] != feature {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *uartCapabilities) has(feature string) bool {
+	return c.capabilities().Has(feature)
+}
+
+func (c *uartCapabilities) capabilities() deviceCapabilities {
+	return deviceCapabilities{ProtocolVersion: c.ProtocolVersion, Features: c.Features}
+}
+
+// Capabilities returns the capabilities of the identified device.
+// Devices that announce a protocol version are asked with the capabilities
+// command. For older firmware the capabilities are derived from the
+// identity.
+func (d *uartDevice) Capabilities(identity *uartIdentity) (*uartCapabilities, error) {
+	if identity.ProtocolVersion < 1 {
+		result := &uartCapabilities{Window: identity.Window, Features: []string{}}
+		if identity.Window > 0 {
+			result.Features = append(result.Features, featureUartWindow, featureUartDiscard)
+		}
+		if identity.Crc {
+			result.Features = append(result.Features, featureUartCrc)
+		}
+		return result, nil
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	response, err := d.sendRequest(commandCapabilities, []byte{})
+	if err != nil {
+		return nil, err
+	}
+	var result uartCapabilities
+	err = ubjson.Unmarshal(response, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// SetCrc enables or disables the CRC of packets.
+// Only enable it for devices that announce support in their identity.
+func (d *uartDevice) SetCrc(enabled bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.crc = enabled
+}
+
+// SetTransferOptions configures how data is streamed to the device.
+// The chunk size and window are limited by the window the device
+// advertises in its capabilities. A window of 0 uses the device's window.
+// Devices that don't advertise a window only support one chunk of
+// legacyUartChunkSize at a time.
+func (d *uartDevice) SetTransferOptions(capabilities *uartCapabilities, chunkSize int, window int) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	deviceWindow := capabilities.Window
+	if !capabilities.has(featureUartWindow) {
+		deviceWindow = 0
+	}
+	if deviceWindow <= 0 {
+		d.chunkSize = legacyUartChunkSize
+		d.window = legacyUartChunkSize
+		return
+	}
+	if window <= 0 || window > deviceWindow {
+		window = deviceWindow
+	}
+	if chunkSize <= 0 || chunkSize > window {
+		chunkSize = window
+	}
+	d.chunkSize = chunkSize
+	d.window = window
+}
+
+// TransferOptions returns the chunk size and window used for streaming.
+func (d *uartDevice) TransferOptions() (chunkSize int, window int) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.chunkSize, d.window
 }
 
 func (d *uartDevice) Identify() (*uartIdentity, error) {
 	d.lock.Lock()
 	defer d.lock.Unlock()
+	return d.identify()
+}
+
+// Identity returns the last identity of the device, or nil if it hasn't
+// been identified yet.
+func (d *uartDevice) Identity() *uartIdentity {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.identity
+}
+
+func (d *uartDevice) identify() (*uartIdentity, error) {
 	response, err := d.sendRequest(commandIdentify, []byte{})
 	if err != nil {
 		return nil, err
@@ -189,9 +519,40 @@ func (d *uartDevice) Identify() (*uartIdentity, error) {
 	if err != nil {
 		return nil, err
 	}
+	d.identity = &identity
 	return &identity, nil
 }
 
+// Reidentify identifies the device again, for example after it rebooted.
+// The device might run different firmware now, so if identifying fails
+// with CRCs, it is tried again without them.
+// If the identity changed, or CRCs had to be disabled, the registered
+// identity-change function is called.
+func (d *uartDevice) Reidentify() (*uartIdentity, error) {
+	d.lock.Lock()
+	previous := d.identity
+	identity, err := d.identify()
+	changed := false
+	if err != nil && d.crc {
+		d.crc = false
+		d.needsSync = true
+		identity, err = d.identify()
+		changed = true
+	}
+	onIdentityChange := d.onIdentityChange
+	d.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if previous != nil && !identity.sameAs(previous) {
+		changed = true
+	}
+	if changed && onIdentityChange != nil {
+		onIdentityChange(identity)
+	}
+	return identity, nil
+}
+
 func (d *uartDevice) ListContainers() ([]byte, error) {
 	d.lock.Lock()
 	defer d.lock.Unlock()
@@ -205,19 +566,40 @@ func (d *uartDevice) Uninstall(containerName string) error {
 	return err
 }
 
-func (d *uartDevice) Firmware(newFirmware []byte) error {
+// uartUpload is data that is streamed to the device.
+type uartUpload struct {
+	reader io.Reader
+	size   int
+	crc32  uint32
+	// progress, if not nil, is called with the number of bytes the device
+	// has acknowledged so far.
+	progress func(acked int)
+}
+
+func newUartUpload(data []byte) *uartUpload {
+	return &uartUpload{
+		reader: bytes.NewReader(data),
+		size:   len(data),
+		crc32:  crc32.ChecksumIEEE(data),
+	}
+}
+
+func (d *uartDevice) Firmware(newFirmware *uartUpload) error {
 	d.lock.Lock()
 	defer d.lock.Unlock()
 	payload := []byte{}
-	payload = appendUint32Le(payload, uint32(len(newFirmware)))
+	payload = appendUint32Le(payload, uint32(newFirmware.size))
 	_, err := d.sendRequest(commandFirmware, payload)
 	if err != nil {
 		return err
 	}
-	return d.streamChunked(newFirmware)
+	err = d.streamChunked(newFirmware)
+	// The device reboots into the new firmware.
+	d.needsSync = true
+	return err
 }
 
-func (d *uartDevice) Install(containerName string, defines map[string]interface{}, containerImage []byte) error {
+func (d *uartDevice) Install(containerName string, defines map[string]interface{}, containerImage *uartUpload) error {
 	d.lock.Lock()
 	defer d.lock.Unlock()
 	encodedDefines, err := ubjson.Marshal(defines)
@@ -225,8 +607,8 @@ func (d *uartDevice) Install(containerName string, defines map[string]interface{
 		return err
 	}
 	payload := []byte{}
-	payload = appendUint32Le(payload, uint32(len(containerImage)))
-	payload = appendUint32Le(payload, crc32.ChecksumIEEE(containerImage))
+	payload = appendUint32Le(payload, uint32(containerImage.size))
+	payload = appendUint32Le(payload, containerImage.crc32)
 	payload = appendUint16Le(payload, uint16(len(containerName)))
 	payload = append(payload, containerName...)
 	payload = append(payload, encodedDefines...)
@@ -238,7 +620,7 @@ func (d *uartDevice) Install(containerName string, defines map[string]interface{
 	return d.streamChunked(containerImage)
 }
 
-func (d *uartDevice) Run(defines map[string]interface{}, image []byte) error {
+func (d *uartDevice) Run(defines map[string]interface{}, image *uartUpload) error {
 	d.lock.Lock()
 	defer d.lock.Unlock()
 	encodedDefines, err := ubjson.Marshal(defines)
@@ -246,8 +628,8 @@ func (d *uartDevice) Run(defines map[string]interface{}, image []byte) error {
 		return err
 	}
 	payload := []byte{}
-	payload = appendUint32Le(payload, uint32(len(image)))
-	payload = appendUint32Le(payload, crc32.ChecksumIEEE(image))
+	payload = appendUint32Le(payload, uint32(image.size))
+	payload = appendUint32Le(payload, image.crc32)
 	payload = append(payload, encodedDefines...)
 
 	_, err = d.sendRequest(commandRun, payload)
@@ -257,6 +639,20 @@ func (d *uartDevice) Run(defines map[string]interface{}, image []byte) error {
 	return d.streamChunked(image)
 }
 
+// Discard streams the given data to the device, which drops it.
+// It is used to measure the throughput of the connection.
+func (d *uartDevice) Discard(data []byte) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	payload := []byte{}
+	payload = appendUint32Le(payload, uint32(len(data)))
+	_, err := d.sendRequest(commandDiscard, payload)
+	if err != nil {
+		return err
+	}
+	return d.streamChunked(newUartUpload(data))
+}
+
 func appendUint16Le(data []byte, value uint16) []byte {
 	data = append(data, byte(value&0xff))
 	data = append(data, byte(value>>8))
@@ -271,51 +667,163 @@ func appendUint32Le(data []byte, value uint32) []byte {
 	return data
 }
 
-func (d *uartDevice) streamChunked(data []byte) error {
-	length := len(data)
-	// Start sending the image in chunks of 512 bytes.
-	// Expect a response for each chunk.
+// streamChunked sends the data in chunks, keeping at most a window of
+// bytes unacknowledged. The device acknowledges the bytes as it consumes
+// them.
+// If the upload fails halfway, the device still waits for the rest of the
+// data, so the next request synchronizes first.
+func (d *uartDevice) streamChunked(upload *uartUpload) error {
+	err := d.streamChunkedData(upload)
+	if err != nil {
+		d.needsSync = true
+	}
+	return err
+}
+
+func (d *uartDevice) streamChunkedData(upload *uartUpload) error {
+	length := upload.size
 	written := 0
-	for written < int(length) {
-		chunkSize := 512
-		if written+chunkSize > int(length) {
-			chunkSize = int(length) - written
-		}
-		chunk := data[written : written+chunkSize]
-		d.writeAll(chunk)
-		written += chunkSize
-		consumed := 0
-		for consumed < chunkSize {
-			// Read the Ack. 3 bytes.
-			buffer := make([]byte, 3)
-			_, err := io.ReadFull(d.bufferedReader, buffer)
-			if err != nil {
-				return err
+	acked := 0
+	buffer := make([]byte, 3)
+	chunk := make([]byte, d.chunkSize)
+	for acked < length {
+		// Fill the window with complete chunks.
+		for written < length {
+			chunkSize := d.chunkSize
+			if written+chunkSize > length {
+				chunkSize = length - written
+			}
+			if written-acked+chunkSize > d.window {
+				break
 			}
-			if buffer[0] != responseAck {
-				return fmt.Errorf("invalid ack")
+			_, err := io.ReadFull(upload.reader, chunk[:chunkSize])
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
 			}
-			consumed += int(buffer[1]) | (int(buffer[2]) << 8)
-			if consumed > chunkSize {
-				return fmt.Errorf("invalid ack")
+			if err != nil {
+				return fmt.Errorf("failed to read the data after %d of %d bytes: %w", written, length, err)
 			}
+			err = d.writeAll(chunk[:chunkSize])
+			if err != nil {
+				return err
+			}
+			written += chunkSize
+		}
+		// Read the Ack. 3 bytes.
+		_, err := io.ReadFull(d.bufferedReader, buffer)
+		if err != nil {
+			return err
+		}
+		if buffer[0] != responseAck {
+			return fmt.Errorf("invalid ack")
+		}
+		acked += int(buffer[1]) | (int(buffer[2]) << 8)
+		if acked > written {
+			return fmt.Errorf("invalid ack")
+		}
+		if upload.progress != nil {
+			upload.progress(acked)
 		}
 	}
 	return nil
 }
 
+// sendRequest sends the request and returns the payload of the response.
+// Requests that the device reports as corrupted are sent again, as are
+// requests without side effects whose response was corrupted.
 func (d *uartDevice) sendRequest(command byte, payload []byte) ([]byte, error) {
-	// There should be no data in the reader. If there is, we sync first.
-	if d.hasIncomingData() {
-		err := d.sync()
+	if d.ctx.Err() != nil {
+		return nil, errUartClosed
+	}
+	for attempt := 0; ; attempt++ {
+		// There should be no data in the reader. If there is, we sync first.
+		if d.needsSync || d.hasIncomingData() {
+			err := d.sync()
+			if err != nil {
+				return nil, err
+			}
+			d.needsSync = false
+		}
+		err := d.writeRequest(command, payload)
 		if err != nil {
 			return nil, err
 		}
+		response, err := d.receiveResponse(command)
+		if err == nil {
+			return response, nil
+		}
+		if d.ctx.Err() != nil {
+			return nil, errUartClosed
+		}
+		retry := false
+		if errors.Is(err, errUartNak) {
+			atomic.AddUint64(&d.stats.Naks, 1)
+			retry = true
+		} else if errors.Is(err, errUartCorrupt) {
+			atomic.AddUint64(&d.stats.CorruptPackets, 1)
+			retry = isIdempotentCommand(command)
+		}
+		if !retry || attempt >= maxPacketRetries {
+			return nil, err
+		}
+		atomic.AddUint64(&d.stats.Retransmissions, 1)
+		// Realign with the device before sending the request again.
+		if err := d.sync(); err != nil {
+			return nil, err
+		}
 	}
-	err := d.WritePacket(append([]byte{command}, payload...))
-	if err != nil {
-		return nil, err
+}
+
+// isIdempotentCommand returns whether the command can be sent again when
+// its response was lost.
+func isIdempotentCommand(command byte) bool {
+	return command == commandPing || command == commandIdentify || command == commandListContainers
+}
+
+// writeRequest writes the request packet, with a CRC if it is enabled.
+func (d *uartDevice) writeRequest(command byte, payload []byte) error {
+	atomic.AddUint64(&d.stats.PacketsSent, 1)
+	if !d.crc {
+		return d.WritePacket(append([]byte{command}, payload...))
 	}
+	packet := make([]byte, 0, len(payload)+5)
+	packet = append(packet, command|packetCrcFlag)
+	packet = append(packet, payload...)
+	packet = appendUint32Le(packet, crc32.ChecksumIEEE(packet))
+	return d.WritePacket(packet)
+}
+
+// receiveResponse receives the response to the given command.
+// With CRCs enabled, a device that doesn't answer in time is assumed to
+// wait for the rest of a request whose length was corrupted. The proxy then
+// sends sync requests until the device reaches the end of the packet and
+// reports the error.
+func (d *uartDevice) receiveResponse(command byte) ([]byte, error) {
+	if !d.crc {
+		return d.ReceiveResponse(command)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-done:
+			return
+		case <-time.After(responseTimeout):
+		}
+		atomic.AddUint64(&d.stats.Timeouts, 1)
+		ticker := time.NewTicker(200 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := d.writeAll(buildSyncRequest(0)); err != nil {
+					return
+				}
+			}
+		}
+	}()
 	return d.ReceiveResponse(command)
 }
 
@@ -326,16 +834,13 @@ func (d *uartDevice) WritePacket(data []byte) error {
 	if len(data) > 65535 {
 		return io.ErrShortBuffer
 	}
-	length := len(data)
-	err := d.writeAll([]byte{byte(length & 0xff), byte(length >> 8)})
-	if err != nil {
-		return err
-	}
-	err = d.writeAll(data)
-	if err != nil {
-		return err
-	}
-	return d.writeAll([]byte{'\n'})
+	// Write the packet with a single write, so that other writers to the
+	// same port can't end up in the middle of it.
+	packet := make([]byte, 0, len(data)+3)
+	packet = appendUint16Le(packet, uint16(len(data)))
+	packet = append(packet, data...)
+	packet = append(packet, '\n')
+	return d.writeAll(packet)
 }
 
 func (d *uartDevice) writeAll(data []byte) error {
@@ -351,6 +856,8 @@ func (d *uartDevice) writeAll(data []byte) error {
 
 // ReceiveResponse receives a response to the given command.
 // The returned data is the payload of the response, without the command byte.
+// Responses with a CRC are verified. Corrupted responses return an error
+// wrapping errUartCorrupt, and NAKs of the device return errUartNak.
 func (d *uartDevice) ReceiveResponse(command byte) ([]byte, error) {
 	lengthLsb, err := d.bufferedReader.ReadByte()
 	if err != nil {
@@ -372,13 +879,28 @@ func (d *uartDevice) ReceiveResponse(command byte) ([]byte, error) {
 		return nil, err
 	}
 	if b != '\n' {
-		return nil, fmt.Errorf("invalid packet terminator")
+		return nil, fmt.Errorf("invalid packet terminator: %w", errUartCorrupt)
 	}
 	if len(payload) == 0 {
-		return nil, fmt.Errorf("empty payload")
+		return nil, fmt.Errorf("empty payload: %w", errUartCorrupt)
+	}
+	atomic.AddUint64(&d.stats.PacketsReceived, 1)
+	if payload[0]&packetCrcFlag != 0 {
+		if len(payload) < 5 {
+			return nil, fmt.Errorf("packet too short for its CRC: %w", errUartCorrupt)
+		}
+		end := len(payload) - 4
+		expected := uint32(payload[end]) | uint32(payload[end+1])<<8 | uint32(payload[end+2])<<16 | uint32(payload[end+3])<<24
+		if crc32.ChecksumIEEE(payload[:end]) != expected {
+			return nil, fmt.Errorf("CRC mismatch: %w", errUartCorrupt)
+		}
+		payload = append([]byte{payload[0] &^ packetCrcFlag}, payload[1:end]...)
+		if payload[0] == commandNak {
+			return nil, errUartNak
+		}
 	}
 	if payload[0] != command {
-		return nil, fmt.Errorf("unmatched response")
+		return nil, fmt.Errorf("unmatched response: %w", errUartCorrupt)
 	}
 	return payload[1:], nil
 }
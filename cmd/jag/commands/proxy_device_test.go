@@ -0,0 +1,463 @@
+// Copyright (C) 2026 Toit contributors.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/toitware/ubjson"
+)
+
+// chunkReader feeds the packets written to it to the uartDevice, like the
+// packet side of multiplexReader.
+type chunkReader struct {
+	ch chan []byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	data, ok := <-r.ch
+	if !ok {
+		return 0, io.EOF
+	}
+	return copy(p, data), nil
+}
+
+func (r *chunkReader) HasData() bool { return len(r.ch) > 0 }
+
+// streamRecorder records streamed data and the largest number of
+// unacknowledged bytes. Like the device, it acknowledges the data
+// asynchronously, in pieces.
+type streamRecorder struct {
+	mu             sync.Mutex
+	responses      *chunkReader
+	received       []byte
+	acked          int
+	maxOutstanding int
+}
+
+func (r *streamRecorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.received = append(r.received, p...)
+	if outstanding := len(r.received) - r.acked; outstanding > r.maxOutstanding {
+		r.maxOutstanding = outstanding
+	}
+	return len(p), nil
+}
+
+func (r *streamRecorder) ackLoop(ctx context.Context) {
+	for ctx.Err() == nil {
+		time.Sleep(time.Millisecond)
+		r.mu.Lock()
+		count := len(r.received) - r.acked
+		if count > 300 {
+			count = 300
+		}
+		if count > 0 {
+			r.acked += count
+			r.responses.ch <- []byte{responseAck, byte(count), byte(count >> 8)}
+		}
+		r.mu.Unlock()
+	}
+}
+
+func TestStreamChunked(t *testing.T) {
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	tests := []struct {
+		identity   *uartIdentity
+		chunkSize  int
+		window     int
+		wantChunk  int
+		wantWindow int
+	}{
+		{&uartIdentity{}, 4096, 4096, legacyUartChunkSize, legacyUartChunkSize},
+		{&uartIdentity{Window: 2048}, 512, 0, 512, 2048},
+		{&uartIdentity{Window: 2048}, 4096, 1500, 1500, 1500},
+	}
+	for _, test := range tests {
+		responses := &chunkReader{ch: make(chan []byte, 1000)}
+		recorder := &streamRecorder{responses: responses}
+		ctx, cancel := context.WithCancel(context.Background())
+		ud := newUartDevice(ctx, recorder, responses)
+		capabilities, err := ud.Capabilities(test.identity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ud.SetTransferOptions(capabilities, test.chunkSize, test.window)
+		chunkSize, window := ud.TransferOptions()
+		if chunkSize != test.wantChunk || window != test.wantWindow {
+			t.Errorf("got chunk %d and window %d, want %d and %d", chunkSize, window, test.wantChunk, test.wantWindow)
+		}
+
+		go recorder.ackLoop(ctx)
+		err = ud.streamChunked(newUartUpload(data))
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		recorder.mu.Lock()
+		if !bytes.Equal(recorder.received, data) {
+			t.Errorf("received data differs")
+		}
+		if recorder.maxOutstanding > window {
+			t.Errorf("had %d bytes outstanding with a window of %d", recorder.maxOutstanding, window)
+		}
+		if window > chunkSize && recorder.maxOutstanding <= chunkSize {
+			t.Errorf("never had more than one chunk outstanding")
+		}
+		recorder.mu.Unlock()
+	}
+}
+
+func TestIdentityWindow(t *testing.T) {
+	encoded, err := ubjson.Marshal(map[string]interface{}{
+		"name":       "dev",
+		"id":         "1234",
+		"chip":       "esp32",
+		"sdkVersion": "v2.0.0",
+		"window":     2048,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var identity uartIdentity
+	if err := ubjson.Unmarshal(encoded, &identity); err != nil {
+		t.Fatal(err)
+	}
+	if identity.Window != 2048 {
+		t.Errorf("got window %d, want 2048", identity.Window)
+	}
+}
+
+func TestProxyIdentityWordSize(t *testing.T) {
+	tests := []struct {
+		identity map[string]interface{}
+		want     int
+	}{
+		{map[string]interface{}{"name": "sim", "id": "1234", "wordSize": 8}, 8},
+		{map[string]interface{}{"name": "dev", "id": "1234", "wordSize": 4}, 4},
+		// Older firmware doesn't send its word size.
+		{map[string]interface{}{"name": "old", "id": "1234"}, 4},
+	}
+	for _, test := range tests {
+		encoded, err := ubjson.Marshal(test.identity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var identity uartIdentity
+		if err := ubjson.Unmarshal(encoded, &identity); err != nil {
+			t.Fatal(err)
+		}
+		payload, err := createIdentityPayload(&identity, "127.0.0.1", 4000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var message struct {
+			Payload map[string]interface{} `json:"payload"`
+		}
+		if err := json.Unmarshal(payload, &message); err != nil {
+			t.Fatal(err)
+		}
+		device, err := NewDeviceFromJson(message.Payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if device.WordSize() != test.want {
+			t.Errorf("got word size %d for %v, want %d", device.WordSize(), test.identity, test.want)
+		}
+	}
+}
+
+// fakeUartEndpoint answers requests like the device's UART endpoint with
+// CRCs. It NAKs the first naks requests, and corrupts the first corrupt
+// responses.
+type fakeUartEndpoint struct {
+	mu        sync.Mutex
+	responses *chunkReader
+	naks      int
+	corrupt   int
+	requests  []byte
+}
+
+func (e *fakeUartEndpoint) Write(p []byte) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	// Requests are written with a single write.
+	payload := p[2 : len(p)-1]
+	command := payload[0]
+	if command == commandSync {
+		e.responses.ch <- buildExpectedSyncResponse(int(payload[1]) | int(payload[2])<<8)
+		return len(p), nil
+	}
+	end := len(payload) - 4
+	if crc32.ChecksumIEEE(payload[:end]) != binary.LittleEndian.Uint32(payload[end:]) {
+		panic("request with invalid CRC")
+	}
+	command &^= packetCrcFlag
+	e.requests = append(e.requests, command)
+	response := []byte{command | packetCrcFlag}
+	if e.naks > 0 {
+		e.naks--
+		response = []byte{commandNak | packetCrcFlag}
+	} else if command == commandListContainers {
+		response = append(response, "containers"...)
+	}
+	response = appendUint32Le(response, crc32.ChecksumIEEE(response))
+	if e.corrupt > 0 && response[0] != commandNak|packetCrcFlag {
+		e.corrupt--
+		response[len(response)-1] ^= 1
+	}
+	packet := appendUint16Le(nil, uint16(len(response)))
+	packet = append(packet, response...)
+	e.responses.ch <- append(packet, '\n')
+	return len(p), nil
+}
+
+func TestUartRetransmission(t *testing.T) {
+	newDevice := func(endpoint *fakeUartEndpoint) (*uartDevice, context.CancelFunc) {
+		endpoint.responses = &chunkReader{ch: make(chan []byte, 100)}
+		ctx, cancel := context.WithCancel(context.Background())
+		ud := newUartDevice(ctx, endpoint, endpoint.responses)
+		ud.SetCrc(true)
+		return ud, cancel
+	}
+
+	endpoint := &fakeUartEndpoint{naks: 2}
+	ud, cancel := newDevice(endpoint)
+	containers, err := ud.ListContainers()
+	cancel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(containers) != "containers" {
+		t.Errorf("got %q", containers)
+	}
+	if stats := ud.Stats(); stats.Naks != 2 || stats.Retransmissions != 2 {
+		t.Errorf("got %+v", stats)
+	}
+
+	endpoint = &fakeUartEndpoint{naks: maxPacketRetries + 1}
+	ud, cancel = newDevice(endpoint)
+	err = ud.Ping()
+	cancel()
+	if !errors.Is(err, errUartNak) {
+		t.Errorf("got %v, want a NAK error", err)
+	}
+
+	// Corrupted responses are only retried for requests without side
+	// effects.
+	endpoint = &fakeUartEndpoint{corrupt: 1}
+	ud, cancel = newDevice(endpoint)
+	if err := ud.Ping(); err != nil {
+		t.Errorf("ping failed: %v", err)
+	}
+	cancel()
+
+	endpoint = &fakeUartEndpoint{corrupt: 1}
+	ud, cancel = newDevice(endpoint)
+	err = ud.Uninstall("foo")
+	cancel()
+	if !errors.Is(err, errUartCorrupt) {
+		t.Errorf("got %v, want a corruption error", err)
+	}
+	if len(endpoint.requests) != 1 {
+		t.Errorf("uninstall was sent %d times", len(endpoint.requests))
+	}
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+func TestUartCapabilities(t *testing.T) {
+	responses := &chunkReader{ch: make(chan []byte, 10)}
+	// The response to the next request.
+	var response []byte
+	respond := writerFunc(func(p []byte) (int, error) {
+		packet := appendUint16Le(nil, uint16(len(response)))
+		packet = append(packet, response...)
+		responses.ch <- append(packet, '\n')
+		return len(p), nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ud := newUartDevice(ctx, respond, responses)
+
+	// Older firmware announces its features through the identity.
+	capabilities, err := ud.Capabilities(&uartIdentity{Window: 2048, Crc: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !capabilities.has(featureUartWindow) || !capabilities.has(featureUartCrc) || capabilities.Window != 2048 {
+		t.Errorf("got %+v", capabilities)
+	}
+	capabilities, err = ud.Capabilities(&uartIdentity{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(capabilities.Features) != 0 {
+		t.Errorf("got %+v", capabilities)
+	}
+
+	// Newer firmware answers the capabilities command.
+	encoded, err := ubjson.Marshal(map[string]interface{}{
+		"protocolVersion": 1,
+		"features":        []string{featureUartCrc},
+		"window":          4096,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response = append([]byte{commandCapabilities}, encoded...)
+	capabilities, err = ud.Capabilities(&uartIdentity{ProtocolVersion: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if capabilities.ProtocolVersion != 1 || !capabilities.has(featureUartCrc) || capabilities.has(featureUartWindow) || capabilities.Window != 4096 {
+		t.Errorf("got %+v", capabilities)
+	}
+
+	// Without the feature, the window is ignored.
+	ud.SetTransferOptions(capabilities, 0, 0)
+	if chunkSize, window := ud.TransferOptions(); chunkSize != legacyUartChunkSize || window != legacyUartChunkSize {
+		t.Errorf("got chunk %d and window %d", chunkSize, window)
+	}
+}
+
+func TestUartReidentify(t *testing.T) {
+	responses := &chunkReader{ch: make(chan []byte, 10)}
+	var mu sync.Mutex
+	id := "1234"
+	respond := writerFunc(func(p []byte) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		encoded, err := ubjson.Marshal(map[string]interface{}{"name": "dev", "id": id})
+		if err != nil {
+			return 0, err
+		}
+		response := append([]byte{commandIdentify}, encoded...)
+		packet := appendUint16Le(nil, uint16(len(response)))
+		packet = append(packet, response...)
+		responses.ch <- append(packet, '\n')
+		return len(p), nil
+	})
+	ud := newUartDevice(context.Background(), respond, responses)
+
+	var changes []string
+	ud.OnIdentityChange(func(identity *uartIdentity) {
+		changes = append(changes, identity.Id)
+	})
+	if _, err := ud.Identify(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ud.Reidentify(); err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("unchanged identity reported as %v", changes)
+	}
+
+	// A firmware update gives the device a new id.
+	mu.Lock()
+	id = "5678"
+	mu.Unlock()
+	if _, err := ud.Reidentify(); err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0] != "5678" || ud.Identity().Id != "5678" {
+		t.Errorf("got changes %v and identity %+v", changes, ud.Identity())
+	}
+
+	if err := ud.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ud.Identify(); !errors.Is(err, errUartClosed) {
+		t.Errorf("got %v, want errUartClosed", err)
+	}
+}
+
+func TestUartSyncTimeout(t *testing.T) {
+	responses := &chunkReader{ch: make(chan []byte, 10)}
+	// The device doesn't answer sync requests, but answers pings.
+	respond := writerFunc(func(p []byte) (int, error) {
+		if p[2] == commandPing {
+			responses.ch <- []byte{1, 0, commandPing, '\n'}
+		}
+		return len(p), nil
+	})
+	ud := newUartDevice(context.Background(), respond, responses)
+	defer ud.Close()
+
+	if err := ud.SyncWithin(50 * time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+
+	// Nothing of the failed sync reads the response to the next request.
+	result := make(chan error)
+	go func() {
+		result <- ud.Ping()
+	}()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the response to the ping got lost")
+	}
+}
+
+func TestUartCloseDuringRequest(t *testing.T) {
+	responses := &chunkReader{ch: make(chan []byte, 10)}
+	requested := make(chan struct{}, 1)
+	// The device never answers.
+	respond := writerFunc(func(p []byte) (int, error) {
+		select {
+		case requested <- struct{}{}:
+		default:
+		}
+		return len(p), nil
+	})
+	ud := newUartDevice(context.Background(), respond, responses)
+
+	result := make(chan error)
+	go func() {
+		result <- ud.Ping()
+	}()
+	<-requested
+
+	closed := make(chan struct{})
+	go func() {
+		ud.Close()
+		close(closed)
+	}()
+	select {
+	case err := <-result:
+		if !errors.Is(err, errUartClosed) {
+			t.Errorf("got %v, want errUartClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("closing the device didn't end the request")
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("closing the device didn't return")
+	}
+}
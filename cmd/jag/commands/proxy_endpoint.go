@@ -0,0 +1,269 @@
+// Copyright (C) 2026 Toit contributors.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	// The number of consecutive TCP ports that are tried when the proxy
+	// listens on a fixed port that is already taken.
+	maxProxyListenPorts = 64
+
+	// The --broadcast value that disables the UDP announcements.
+	broadcastNone = "none"
+)
+
+// proxyNetwork configures how UART proxies are reachable on the network.
+type proxyNetwork struct {
+	// bind is the host the proxies listen on. Empty means all interfaces.
+	bind string
+	// listenPort is the TCP port of the first proxy. Further proxies use
+	// the following free ports. If it is 0 the ports are chosen by the
+	// system.
+	listenPort int
+	// loopback restricts the proxies to this machine.
+	loopback bool
+	// broadcast is the target of the UDP announcements: empty for the
+	// default broadcast address, broadcastNone, an IP address, or the name
+	// of a network interface.
+	broadcast string
+	// endpoints, if not nil, records the running proxies.
+	endpoints *endpointReport
+}
+
+func addProxyNetworkFlags(cmd *cobra.Command) {
+	cmd.Flags().String("bind", "", "the address the proxy listens on; defaults to all interfaces")
+	cmd.Flags().Uint("listen-port", 0, "the TCP port of the proxy; further devices use the following free ports; 0 picks a free port")
+	cmd.Flags().Bool("loopback", false, "only make the proxy reachable from this machine")
+	cmd.Flags().String("broadcast", "", "where to announce the proxy: an IP address, a network interface, or 'none'; defaults to 255.255.255.255")
+	cmd.Flags().String("endpoint-file", "", "keep a JSON description of the running proxies in this file")
+}
+
+func getProxyNetwork(cmd *cobra.Command) (*proxyNetwork, error) {
+	bind, err := cmd.Flags().GetString("bind")
+	if err != nil {
+		return nil, err
+	}
+	listenPort, err := cmd.Flags().GetUint("listen-port")
+	if err != nil {
+		return nil, err
+	}
+	loopback, err := cmd.Flags().GetBool("loopback")
+	if err != nil {
+		return nil, err
+	}
+	broadcast, err := cmd.Flags().GetString("broadcast")
+	if err != nil {
+		return nil, err
+	}
+	endpointFile, err := cmd.Flags().GetString("endpoint-file")
+	if err != nil {
+		return nil, err
+	}
+
+	if listenPort > 65535 {
+		return nil, fmt.Errorf("invalid listen port %d", listenPort)
+	}
+	if bind != "" && net.ParseIP(bind) == nil {
+		return nil, fmt.Errorf("invalid bind address '%s'; must be an IP address", bind)
+	}
+	if loopback {
+		if bind != "" && !net.ParseIP(bind).IsLoopback() {
+			return nil, fmt.Errorf("--loopback can't be used with the non-loopback address '%s'", bind)
+		}
+		if broadcast != "" && broadcast != broadcastNone {
+			return nil, fmt.Errorf("--loopback can't be used with --broadcast '%s'", broadcast)
+		}
+	}
+	if broadcast != "" && broadcast != broadcastNone && net.ParseIP(broadcast) == nil {
+		if _, err := net.InterfaceByName(broadcast); err != nil {
+			return nil, fmt.Errorf("invalid broadcast target '%s'; must be an IP address, a network interface, or 'none'", broadcast)
+		}
+	}
+
+	result := &proxyNetwork{
+		bind:       bind,
+		listenPort: int(listenPort),
+		loopback:   loopback,
+		broadcast:  broadcast,
+	}
+	if endpointFile != "" {
+		result.endpoints = newEndpointReport(endpointFile)
+		if err := result.endpoints.write(); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (n *proxyNetwork) bindHost() string {
+	if n.loopback && n.bind == "" {
+		return "127.0.0.1"
+	}
+	return n.bind
+}
+
+// listen opens the listener for a proxy.
+func (n *proxyNetwork) listen() (net.Listener, error) {
+	host := n.bindHost()
+	if n.listenPort == 0 {
+		return net.Listen("tcp", net.JoinHostPort(host, "0"))
+	}
+	var lastErr error
+	for port := n.listenPort; port < n.listenPort+maxProxyListenPorts && port <= 65535; port++ {
+		listener, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err == nil {
+			return listener, nil
+		}
+		lastErr = err
+	}
+	return nil, fmt.Errorf("no free TCP port starting at %d: %w", n.listenPort, lastErr)
+}
+
+// advertisedIP returns the IP address that is announced for the proxies.
+func (n *proxyNetwork) advertisedIP() (string, error) {
+	host := n.bindHost()
+	if host != "" && !net.ParseIP(host).IsUnspecified() {
+		return host, nil
+	}
+	if n.broadcast != "" && n.broadcast != broadcastNone && net.ParseIP(n.broadcast) == nil {
+		ipNet, err := interfaceIPv4(n.broadcast)
+		if err != nil {
+			return "", err
+		}
+		return ipNet.IP.String(), nil
+	}
+	return getLanIp()
+}
+
+// broadcastAddress returns the target of the UDP announcements, or the
+// empty string if the proxies aren't announced.
+func (n *proxyNetwork) broadcastAddress() (string, error) {
+	switch {
+	case n.broadcast == broadcastNone:
+		return "", nil
+	case n.broadcast == "" && n.loopback:
+		return "127.0.0.1", nil
+	case n.broadcast == "":
+		return udpIdentifyAddress, nil
+	case net.ParseIP(n.broadcast) != nil:
+		return n.broadcast, nil
+	}
+	ipNet, err := interfaceIPv4(n.broadcast)
+	if err != nil {
+		return "", err
+	}
+	ip := ipNet.IP.To4()
+	broadcast := make(net.IP, len(ip))
+	for i := range ip {
+		broadcast[i] = ip[i] | ^ipNet.Mask[len(ipNet.Mask)-len(ip)+i]
+	}
+	return broadcast.String(), nil
+}
+
+// interfaceIPv4 returns the first IPv4 network of the named interface.
+func interfaceIPv4(name string) (*net.IPNet, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			return ipNet, nil
+		}
+	}
+	return nil, fmt.Errorf("network interface '%s' has no IPv4 address", name)
+}
+
+// proxyEndpoint describes a running proxy in the endpoint file.
+type proxyEndpoint struct {
+	Name       string `json:"name"`
+	Id         string `json:"id"`
+	Chip       string `json:"chip"`
+	SdkVersion string `json:"sdkVersion"`
+	Address    string `json:"address"`
+	SerialPort string `json:"serialPort,omitempty"`
+}
+
+// endpointReport keeps a JSON file up to date with the running proxies, so
+// that scripts can find them without scanning.
+type endpointReport struct {
+	path      string
+	mu        sync.Mutex
+	endpoints map[string]proxyEndpoint
+}
+
+func newEndpointReport(path string) *endpointReport {
+	return &endpointReport{
+		path:      path,
+		endpoints: map[string]proxyEndpoint{},
+	}
+}
+
+func (r *endpointReport) add(endpoint proxyEndpoint) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.endpoints[endpoint.Address] = endpoint
+	return r.writeLocked()
+}
+
+func (r *endpointReport) remove(address string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.endpoints, address)
+	return r.writeLocked()
+}
+
+func (r *endpointReport) write() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.writeLocked()
+}
+
+func (r *endpointReport) writeLocked() error {
+	endpoints := []proxyEndpoint{}
+	for _, endpoint := range r.endpoints {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Slice(endpoints, func(i, j int) bool {
+		return endpoints[i].Address < endpoints[j].Address
+	})
+	content, err := json.MarshalIndent(map[string]interface{}{"endpoints": endpoints}, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first, so that readers never see a partial
+	// file.
+	tmp, err := ioutil.TempFile(filepath.Dir(r.path), filepath.Base(r.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(append(content, '\n')); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), r.path)
+}
@@ -0,0 +1,103 @@
+// Copyright (C) 2026 Toit contributors.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestProxyNetworkListen(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	takenPort := taken.Addr().(*net.TCPAddr).Port
+
+	network := &proxyNetwork{listenPort: takenPort, loopback: true}
+	listener, err := network.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	addr := listener.Addr().(*net.TCPAddr)
+	if !addr.IP.IsLoopback() {
+		t.Errorf("listening on %v, want a loopback address", addr.IP)
+	}
+	if addr.Port <= takenPort || addr.Port >= takenPort+maxProxyListenPorts {
+		t.Errorf("listening on port %d, want a port after %d", addr.Port, takenPort)
+	}
+
+	ip, err := network.advertisedIP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip != "127.0.0.1" {
+		t.Errorf("advertised %s, want 127.0.0.1", ip)
+	}
+}
+
+func TestProxyNetworkBroadcastAddress(t *testing.T) {
+	tests := []struct {
+		network *proxyNetwork
+		want    string
+	}{
+		{&proxyNetwork{}, udpIdentifyAddress},
+		{&proxyNetwork{broadcast: broadcastNone}, ""},
+		{&proxyNetwork{loopback: true}, "127.0.0.1"},
+		{&proxyNetwork{broadcast: "192.168.1.255"}, "192.168.1.255"},
+	}
+	for _, test := range tests {
+		got, err := test.network.broadcastAddress()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("broadcastAddress() of %+v = %q, want %q", test.network, got, test.want)
+		}
+	}
+}
+
+func TestEndpointReport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "endpoints.json")
+	report := newEndpointReport(path)
+
+	read := func() []proxyEndpoint {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded struct {
+			Endpoints []proxyEndpoint `json:"endpoints"`
+		}
+		if err := json.Unmarshal(content, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		return decoded.Endpoints
+	}
+
+	if err := report.add(proxyEndpoint{Name: "b", Address: "http://127.0.0.1:2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := report.add(proxyEndpoint{Name: "a", Address: "http://127.0.0.1:1"}); err != nil {
+		t.Fatal(err)
+	}
+	endpoints := read()
+	if len(endpoints) != 2 || endpoints[0].Name != "a" || endpoints[1].Name != "b" {
+		t.Fatalf("got %+v", endpoints)
+	}
+
+	if err := report.remove("http://127.0.0.1:1"); err != nil {
+		t.Fatal(err)
+	}
+	endpoints = read()
+	if len(endpoints) != 1 || endpoints[0].Name != "b" {
+		t.Fatalf("got %+v", endpoints)
+	}
+}
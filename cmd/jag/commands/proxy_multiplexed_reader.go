@@ -105,9 +105,21 @@ func multiplexReader(input io.Reader) (reader1, reader2 *chanReader) {
 type chanReader struct {
 	ch   <-chan []byte
 	errc <-chan error
+	// pending is the rest of a chunk that didn't fit into the last read.
+	pending []byte
 }
 
 func (cr *chanReader) Read(p []byte) (n int, err error) {
+	if len(cr.pending) > 0 {
+		if p == nil {
+			n = len(cr.pending)
+			cr.pending = nil
+			return n, nil
+		}
+		n = copy(p, cr.pending)
+		cr.pending = cr.pending[n:]
+		return n, nil
+	}
 	data, ok := <-cr.ch
 	if !ok {
 		return 0, io.EOF
@@ -117,17 +129,17 @@ func (cr *chanReader) Read(p []byte) (n int, err error) {
 		if cr.errc == nil {
 			return 0, io.EOF
 		}
-		println("Error")
 		return 0, <-cr.errc
 	}
 
 	if p == nil {
 		return len(data), nil
 	}
-	copy(p, data)
-	return len(data), nil
+	n = copy(p, data)
+	cr.pending = data[n:]
+	return n, nil
 }
 
 func (cr *chanReader) HasData() bool {
-	return len(cr.ch) > 0
+	return len(cr.pending) > 0 || len(cr.ch) > 0
 }
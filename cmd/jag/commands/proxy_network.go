@@ -5,13 +5,11 @@
 package commands
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
-	"io"
 	"net"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 )
 
@@ -19,69 +17,82 @@ import (
 // the UART.
 
 const (
-	// The URL for the favicon.
-	faviconURL = "https://toitlang.github.io/jaguar/device-files/chip.svg"
-	// The URL for the chip image.
-	chipURL = "https://toitlang.github.io/jaguar/device-files/chip.svg"
-	// The URL for the style sheet.
-	styleURL = "https://toitlang.github.io/jaguar/device-files/style.css"
-
 	headerDeviceId          = "X-Jaguar-Device-ID"
 	headerSdkVersion        = "X-Jaguar-SDK-Version"
 	headerWifiDisabled      = "X-Jaguar-Wifi-Disabled"
 	headerContainerName     = "X-Jaguar-Container-Name"
 	headerContainerTimeout  = "X-Jaguar-Container-Timeout"
 	headerContainerInterval = "X-Jaguar-Container-Interval"
+	headerCrc32             = "X-Jaguar-CRC32"
+	headerProgress          = "X-Jaguar-Progress"
+	headerArguments         = "X-Jaguar-Arguments"
 
-	defineJagDisabled = "jag.disabled"
-	defineJagWifi     = "jag.wifi"
-	defineJagTimeout  = "jag.timeout"
-	defineJagInterval = "jag.interval"
+	defineJagDisabled  = "jag.disabled"
+	defineJagWifi      = "jag.wifi"
+	defineJagTimeout   = "jag.timeout"
+	defineJagInterval  = "jag.interval"
+	defineJagArguments = "jag.arguments"
 
 	udpIdentifyPort = 1990
 	// Broadcast.
 	udpIdentifyAddress = "255.255.255.255"
 )
 
-func runProxyServer(ud *uartDevice, identity *uartIdentity) error {
-	listener, err := net.Listen("tcp", ":0")
+// runProxyServer serves the device on the network until the context is done.
+// The server always uses the latest identity of the device. Whenever the
+// identity changes, identityChanged receives a value, and the server updates
+// the endpoint file.
+func runProxyServer(ctx context.Context, ud *uartDevice, identityChanged <-chan struct{}, config *uartProxyConfig) error {
+	log := config.log
+	serialPort := config.serialPort
+	network := config.network
+	if network == nil {
+		network = &proxyNetwork{}
+	}
+	listener, err := network.listen()
 	if err != nil {
 		return err
 	}
 	defer listener.Close()
 
-	// Get the local IP and the dynamically assigned port.
+	// Get the local IP and the assigned port.
 	localAddr := listener.Addr().(*net.TCPAddr)
-	localIP, err := getLanIp()
+	localIP, err := network.advertisedIP()
 	if err != nil {
 		return err
 	}
 	localPort := localAddr.Port
-
-	identityPayload, err := createIdentityPayload(identity, localIP, localPort)
+	broadcastAddress, err := network.broadcastAddress()
 	if err != nil {
 		return err
 	}
 
+	identityPayload := func() ([]byte, error) {
+		return createIdentityPayload(ud.Identity(), localIP, localPort)
+	}
+	if _, err := identityPayload(); err != nil {
+		return err
+	}
+
 	checkValidDeviceId := func(w http.ResponseWriter, r *http.Request) bool {
+		identity := ud.Identity()
 		deviceId := r.Header.Get(headerDeviceId)
 		if deviceId != "" && deviceId != identity.Id {
 			w.WriteHeader(http.StatusForbidden)
 			w.Write([]byte("Device has id '" + identity.Id + "', jag is trying to talk to '" + deviceId + "'.\n"))
-			// TODO(florian): this print should be a log.
-			fmt.Println("Denied request: Header '" + headerDeviceId + "' has value '" + deviceId + "' but expected '" + identity.Id + "'.")
+			log.Warnf("denied request: header '%s' has value '%s' but expected '%s'", headerDeviceId, deviceId, identity.Id)
 			return false
 		}
 		return true
 	}
 
 	checkSameSDK := func(w http.ResponseWriter, r *http.Request) bool {
+		identity := ud.Identity()
 		sdkVersion := r.Header.Get(headerSdkVersion)
 		if sdkVersion != "" && sdkVersion != identity.SdkVersion {
 			w.WriteHeader(http.StatusNotAcceptable)
 			w.Write([]byte("Device has SDK version '" + identity.SdkVersion + "', jag has '" + sdkVersion + "'.\n"))
-			// TODO(florian): this print should be a log.
-			fmt.Println("Denied request: Header '" + headerSdkVersion + "' has value '" + sdkVersion + "' but expected '" + identity.SdkVersion + "'.")
+			log.Warnf("denied request: header '%s' has value '%s' but expected '%s'", headerSdkVersion, sdkVersion, identity.SdkVersion)
 			return false
 		}
 		return true
@@ -95,19 +106,15 @@ func runProxyServer(ud *uartDevice, identity *uartIdentity) error {
 		return true
 	}
 
-	readBody := func(body io.Reader, length int64) ([]byte, error) {
-		result := make([]byte, length)
-		_, err := io.ReadFull(body, result)
-		if err != nil {
-			return nil, err
-		}
-		return result, nil
-	}
-
 	mux := http.NewServeMux()
 	mux.HandleFunc("/identify", func(w http.ResponseWriter, r *http.Request) {
+		payload, err := identityPayload()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
 		w.Header().Add("Content-Type", "application/json")
-		w.Write(identityPayload)
+		w.Write(payload)
 	})
 	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
 		if !checkValidDeviceId(w, r) {
@@ -133,6 +140,15 @@ func runProxyServer(ud *uartDevice, identity *uartIdentity) error {
 		w.Header().Add("Content-Length", strconv.Itoa(len(encodedContainers)))
 		w.Write(encodedContainers)
 	})
+	mux.HandleFunc("/uart-stats", func(w http.ResponseWriter, r *http.Request) {
+		encoded, err := json.Marshal(ud.Stats())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(encoded)
+	})
 	mux.HandleFunc("/uninstall", func(w http.ResponseWriter, r *http.Request) {
 		if !checkValidDeviceId(w, r) || !checkIsPut(w, r) {
 			return
@@ -153,17 +169,7 @@ func runProxyServer(ud *uartDevice, identity *uartIdentity) error {
 		if !checkValidDeviceId(w, r) || !checkIsPut(w, r) {
 			return
 		}
-		firmwareImage, err := readBody(r.Body, r.ContentLength)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		err = ud.Firmware(firmwareImage)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		w.WriteHeader(http.StatusOK)
+		handleUpload(w, r, false, log, ud.Firmware)
 	})
 	mux.HandleFunc("/install", func(w http.ResponseWriter, r *http.Request) {
 		if !checkValidDeviceId(w, r) || !checkSameSDK(w, r) || !checkIsPut(w, r) {
@@ -175,54 +181,97 @@ func runProxyServer(ud *uartDevice, identity *uartIdentity) error {
 			return
 		}
 		defines := extractDefines(r)
-		containerImage, err := readBody(r.Body, r.ContentLength)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		err = ud.Install(containerName, defines, containerImage)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		w.WriteHeader(http.StatusOK)
+		handleUpload(w, r, true, log, func(containerImage *uartUpload) error {
+			return ud.Install(containerName, defines, containerImage)
+		})
 	})
 	mux.HandleFunc("/run", func(w http.ResponseWriter, r *http.Request) {
 		if !checkValidDeviceId(w, r) || !checkSameSDK(w, r) || !checkIsPut(w, r) {
 			return
 		}
 		defines := extractDefines(r)
-		image, err := readBody(r.Body, r.ContentLength)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+		handleUpload(w, r, true, log, func(image *uartUpload) error {
+			return ud.Run(defines, image)
+		})
+	})
+
+	address := "http://" + net.JoinHostPort(localIP, strconv.Itoa(localPort))
+	getSDK := config.getSDK
+	if getSDK == nil {
+		getSDK = GetSDK
+	}
+	dashboard := &dashboard{
+		ctx:        ctx,
+		ud:         ud,
+		address:    address,
+		serialPort: serialPort,
+		logs:       config.logs,
+		getSDK:     getSDK,
+		log:        log,
+	}
+	dashboard.register(mux)
+
+	identity := ud.Identity()
+	log.Infof("running Jaguar device '%s' (id: '%s'), proxied through '%s'.", identity.Name, identity.Id, address)
+	updateEndpoint := func(identity *uartIdentity) {
+		if network.endpoints == nil {
 			return
 		}
-		err = ud.Run(defines, image)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+		endpoint := proxyEndpoint{
+			Name:       identity.Name,
+			Id:         identity.Id,
+			Chip:       identity.Chip,
+			SdkVersion: identity.SdkVersion,
+			Address:    address,
+			SerialPort: serialPort,
 		}
-		w.WriteHeader(http.StatusOK)
-	})
-
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		// Catchall handler.
-		if strings.HasSuffix(r.URL.Path, ".html") ||
-			strings.HasSuffix(r.URL.Path, ".css") ||
-			strings.HasSuffix(r.URL.Path, ".ico") {
-			serveBrowser(identity, w, r)
-		} else {
-			w.WriteHeader(http.StatusNotFound)
+		if err := network.endpoints.add(endpoint); err != nil {
+			log.Warnf("failed to update the endpoint file: %v", err)
 		}
-	})
-
-	// Simulate a log print from the device.
-	fmt.Printf("[jaguar.uart] INFO: running Jaguar device '%s' (id: '%s'), proxied through 'http://%s:%d'.\n", identity.Name, identity.Id, localIP, localPort)
-	err = broadcastIdentity(identityPayload)
-	if err != nil {
-		return err
 	}
-	return http.Serve(listener, mux)
+	updateEndpoint(identity)
+	if network.endpoints != nil {
+		defer func() {
+			if err := network.endpoints.remove(address); err != nil {
+				log.Warnf("failed to update the endpoint file: %v", err)
+			}
+		}()
+	}
+	// Stop watching the identity before the endpoint is removed.
+	watchCtx, stopWatching := context.WithCancel(ctx)
+	watching := make(chan struct{})
+	defer func() {
+		stopWatching()
+		<-watching
+	}()
+	go func() {
+		defer close(watching)
+		for {
+			select {
+			case <-watchCtx.Done():
+				return
+			case <-identityChanged:
+			}
+			identity := ud.Identity()
+			log.Infof("device identified again as '%s' (id: '%s', SDK: '%s').", identity.Name, identity.Id, identity.SdkVersion)
+			updateEndpoint(identity)
+		}
+	}()
+	if broadcastAddress == "" {
+		log.Debugf("not announcing the device")
+	} else {
+		broadcastIdentity(ctx, identityPayload, broadcastAddress, log)
+	}
+	server := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	err = server.Serve(listener)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
 }
 
 func createIdentityPayload(identity *uartIdentity, localIP string, localPort int) ([]byte, error) {
@@ -234,19 +283,36 @@ func createIdentityPayload(identity *uartIdentity, localIP string, localPort int
 			"chip":       identity.Chip,
 			"sdkVersion": identity.SdkVersion,
 			"address":    "http://" + localIP + ":" + strconv.Itoa(localPort),
-			"wordSize":   4,
+			"wordSize":   identity.wordSize(),
 			"proxied":    true,
+			// The proxy implements the HTTP protocol itself, so it announces
+			// its own version and features.
+			"protocolVersion": protocolVersion,
+			"features":        proxyFeatures(identity),
 		},
 	}
 	return json.Marshal(jsonIdentity)
 }
 
-func broadcastIdentity(identityPayload []byte) error {
+// proxyFeatures returns the features the proxy announces for the device.
+// Some of them need support from the device.
+func proxyFeatures(identity *uartIdentity) []string {
+	result := []string{featureUartStats, featureProgress}
+	device := deviceCapabilities{ProtocolVersion: identity.ProtocolVersion, Features: identity.Features}
+	if device.Has(featureArguments) {
+		result = append(result, featureArguments)
+	}
+	return result
+}
+
+// broadcastIdentity periodically broadcasts the payload returned by
+// identityPayload, so that changes of the identity are announced.
+func broadcastIdentity(ctx context.Context, identityPayload func() ([]byte, error), broadcastAddress string, log *logger) {
 	// Create a goroutine to send the payload every 200ms.
 	go func() {
-		for {
+		for ctx.Err() == nil {
 			// Create a UDP address for broadcasting (use broadcast IP)
-			addr, err := net.ResolveUDPAddr("udp", udpIdentifyAddress+":"+strconv.Itoa(udpIdentifyPort))
+			addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(broadcastAddress, strconv.Itoa(udpIdentifyPort)))
 			if err != nil {
 				// Sleep for a few seconds and try again.
 				time.Sleep(5 * time.Second)
@@ -263,19 +329,27 @@ func broadcastIdentity(identityPayload []byte) error {
 
 			ticker := time.NewTicker(200 * time.Millisecond)
 
-			for range ticker.C {
-				_, err := conn.Write(identityPayload)
+		broadcasting:
+			for {
+				select {
+				case <-ctx.Done():
+					break broadcasting
+				case <-ticker.C:
+				}
+				payload, err := identityPayload()
+				if err == nil {
+					_, err = conn.Write(payload)
+				}
 				if err != nil {
-					println("Error broadcasting payload:", err.Error())
-					ticker.Stop()
-					conn.Close()
+					log.Warnf("failed to broadcast the identity: %v", err)
 					// Try to reconnect.
 					break
 				}
 			}
+			ticker.Stop()
+			conn.Close()
 		}
 	}()
-	return nil
 }
 
 func extractDefines(r *http.Request) map[string]interface{} {
@@ -295,42 +369,11 @@ func extractDefines(r *http.Request) map[string]interface{} {
 		// Pass the interval string directly.
 		defines[defineJagInterval] = val
 	}
-	return defines
-}
-
-func serveBrowser(identity *uartIdentity, w http.ResponseWriter, r *http.Request) {
-	if r.URL.Path == "/" || r.URL.Path == "/index.html" {
-		w.Header().Add("Content-Type", "text/html")
-		w.Write([]byte(`
-<html>
-<head>
-	<link rel="stylesheet" href="` + styleURL + `">
-	<title>` + identity.Name + ` (Jaguar device)</title>
-</head>
-<body>
-	<div class="box">
-		<section class="text-center">
-			<img src="` + chipURL + `" alt="Picture of an embedded device" width=200>
-		</section>
-		<h1 class="mt-40">` + uartName(identity.Name) + `</h1>
-		<p class="text-center">Jaguar device</p>
-		<p class="mt-40">Device proxied through 'jag monitor'.</p>
-		<p class="hr mt-40"></p>
-		<section class="grid grid-cols-2 mt-20">
-			<p>SDK</p>
-			<p><b class="text-black">` + identity.SdkVersion + `</b></p>
-		</section>
-		<p class="hr mt-20"></p>
-		<p class="mt-40">Run code on this device using</p>
-		<b><a href="https://github.com/toitlang/jaguar">&gt; jag run -d ` + uartName(identity.Name) + ` hello.toit</a></b>
-	</div>
-</body>
-</html>
-`))
-	} else if r.URL.Path == "/favicon.ico" {
-		// Redirect to the default favicon.
-		http.Redirect(w, r, faviconURL, http.StatusFound)
-	} else {
-		w.WriteHeader(http.StatusNotFound)
+	if val := r.Header.Get(headerArguments); val != "" {
+		// The device gets the arguments as a define over the UART.
+		if arguments, err := decodeArguments(val); err == nil {
+			defines[defineJagArguments] = arguments
+		}
 	}
+	return defines
 }
@@ -0,0 +1,218 @@
+// Copyright (C) 2026 Toit contributors.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"bufio"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Uploads through the proxy are streamed from the HTTP request to the
+// device. Bodies of unknown length, and bodies whose CRC must be computed,
+// are stored in a temporary file first instead of in memory.
+//
+// Clients that send the X-Jaguar-Progress header get the progress of the
+// transfer to the device. The response then always has status 200, and
+// its body consists of lines:
+//
+//	progress <acknowledged bytes> <total bytes>
+//	ok
+//
+// or, if the upload failed:
+//
+//	error <message>
+//
+// As the response can only start once the request has been read, these
+// uploads are always stored in a temporary file first.
+
+// The minimum time between two progress lines.
+const progressInterval = 200 * time.Millisecond
+
+// uploadBody is the body of an upload request.
+type uploadBody struct {
+	reader io.Reader
+	size   int64
+	crc32  uint32
+	// file is the temporary file that holds the body, if any.
+	file *os.File
+}
+
+// openUploadBody prepares the body of the request for streaming.
+// If needsCrc is set, the CRC32 of the body is taken from the
+// X-Jaguar-CRC32 header, or computed. If spool is set, the body is always
+// read completely before returning.
+func openUploadBody(r *http.Request, needsCrc bool, spool bool) (*uploadBody, error) {
+	expectedCrc := uint32(0)
+	hasCrc := false
+	if header := r.Header.Get(headerCrc32); header != "" {
+		value, err := strconv.ParseUint(header, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s header '%s'", headerCrc32, header)
+		}
+		expectedCrc = uint32(value)
+		hasCrc = true
+	}
+	if r.ContentLength > math.MaxUint32 {
+		return nil, fmt.Errorf("body too large: %d bytes", r.ContentLength)
+	}
+
+	if !spool && r.ContentLength >= 0 && (hasCrc || !needsCrc) {
+		return &uploadBody{
+			reader: r.Body,
+			size:   r.ContentLength,
+			crc32:  expectedCrc,
+		}, nil
+	}
+
+	file, err := ioutil.TempFile("", "jag-upload-*")
+	if err != nil {
+		return nil, err
+	}
+	body := &uploadBody{file: file}
+	summer := crc32.NewIEEE()
+	size, err := io.Copy(io.MultiWriter(file, summer), r.Body)
+	if err == nil && r.ContentLength >= 0 && size != r.ContentLength {
+		err = fmt.Errorf("body has %d bytes, expected %d", size, r.ContentLength)
+	}
+	if err == nil && size > math.MaxUint32 {
+		err = fmt.Errorf("body too large: %d bytes", size)
+	}
+	if err == nil && hasCrc && summer.Sum32() != expectedCrc {
+		err = fmt.Errorf("CRC32 mismatch: the body was corrupted")
+	}
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	body.reader = file
+	body.size = size
+	body.crc32 = summer.Sum32()
+	return body, nil
+}
+
+func (b *uploadBody) Close() {
+	if b.file != nil {
+		b.file.Close()
+		os.Remove(b.file.Name())
+	}
+}
+
+// handleUpload streams the body of the request to the device with the
+// given send function.
+func handleUpload(w http.ResponseWriter, r *http.Request, needsCrc bool, log *logger, send func(upload *uartUpload) error) {
+	withProgress := r.Header.Get(headerProgress) != ""
+	body, err := openUploadBody(r, needsCrc, withProgress)
+	if err != nil {
+		log.Warnf("failed to receive upload for '%s': %v", r.URL.Path, err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+	defer body.Close()
+
+	upload := &uartUpload{
+		reader: body.reader,
+		size:   int(body.size),
+		crc32:  body.crc32,
+	}
+	if !withProgress {
+		if err := send(upload); err != nil {
+			log.Errorf("failed to send '%s' to the device: %v", r.URL.Path, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	reporter := startProgressReport(w, upload.size)
+	upload.progress = reporter.report
+	err = send(upload)
+	if err != nil {
+		log.Errorf("failed to send '%s' to the device: %v", r.URL.Path, err)
+	}
+	reporter.finish(err)
+}
+
+// progressReport writes the progress of an upload to the response.
+type progressReport struct {
+	w     http.ResponseWriter
+	total int
+	last  time.Time
+}
+
+func startProgressReport(w http.ResponseWriter, total int) *progressReport {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	result := &progressReport{w: w, total: total}
+	result.write(fmt.Sprintf("progress 0 %d", total))
+	return result
+}
+
+func (p *progressReport) report(acked int) {
+	if acked < p.total && time.Since(p.last) < progressInterval {
+		return
+	}
+	p.write(fmt.Sprintf("progress %d %d", acked, p.total))
+}
+
+func (p *progressReport) finish(err error) {
+	if err != nil {
+		p.write("error " + err.Error())
+	} else {
+		p.write("ok")
+	}
+}
+
+func (p *progressReport) write(line string) {
+	p.last = time.Now()
+	io.WriteString(p.w, line+"\n")
+	if flusher, ok := p.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// readProgressReport reads the progress lines of an upload response and
+// shows them with the given progress bar.
+func readProgressReport(body io.Reader, bar *ProgressReader) error {
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "ok":
+			return nil
+		case strings.HasPrefix(line, "error "):
+			return fmt.Errorf("the device reported an error: %s", strings.TrimPrefix(line, "error "))
+		case strings.HasPrefix(line, "progress "):
+			fields := strings.Fields(line)
+			if len(fields) != 3 {
+				continue
+			}
+			acked, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				continue
+			}
+			if bar != nil {
+				bar.SetProgress(acked)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("the connection closed before the upload finished")
+}
@@ -0,0 +1,119 @@
+// Copyright (C) 2026 Toit contributors.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// sentUpload records the upload that a handler forwarded to the device.
+type sentUpload struct {
+	data  []byte
+	size  int
+	crc32 uint32
+}
+
+func uploadHandler(sent *sentUpload, fail error) http.Handler {
+	log := newLogger("test", ioutil.Discard, logLevelFatal)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleUpload(w, r, true, log, func(upload *uartUpload) error {
+			data, err := io.ReadAll(upload.reader)
+			if err != nil {
+				return err
+			}
+			*sent = sentUpload{data: data, size: upload.size, crc32: upload.crc32}
+			if upload.progress != nil {
+				upload.progress(upload.size / 2)
+				upload.progress(upload.size)
+			}
+			return fail
+		})
+	})
+}
+
+func TestHandleUploadChunked(t *testing.T) {
+	data := bytes.Repeat([]byte("jaguar"), 1000)
+	sent := sentUpload{}
+	server := httptest.NewServer(uploadHandler(&sent, nil))
+	defer server.Close()
+
+	// Hide the length, so that the client uses chunked encoding.
+	req, err := http.NewRequest("PUT", server.URL, io.MultiReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %s", res.Status)
+	}
+	if !bytes.Equal(sent.data, data) || sent.size != len(data) || sent.crc32 != crc32.ChecksumIEEE(data) {
+		t.Errorf("got %d bytes (size %d, crc %d)", len(sent.data), sent.size, sent.crc32)
+	}
+
+	// A wrong CRC is rejected before anything is sent to the device.
+	sent = sentUpload{}
+	req, err = http.NewRequest("PUT", server.URL, io.MultiReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(JaguarCRC32Header, fmt.Sprint(crc32.ChecksumIEEE(data)+1))
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest || sent.data != nil {
+		t.Errorf("got status %s for a corrupted body", res.Status)
+	}
+}
+
+func TestHandleUploadProgress(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 100)
+	sent := sentUpload{}
+	server := httptest.NewServer(uploadHandler(&sent, nil))
+	defer server.Close()
+
+	req, err := http.NewRequest("PUT", server.URL, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(JaguarProgressHeader, "true")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The intermediate progress is throttled, but the final one isn't.
+	want := "progress 0 100\nprogress 100 100\nok\n"
+	if string(body) != want {
+		t.Errorf("got %q, want %q", body, want)
+	}
+	if err := readProgressReport(bytes.NewReader(body), nil); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := readProgressReport(strings.NewReader("progress 0 100\nerror device gone\n"), nil); err == nil || !strings.Contains(err.Error(), "device gone") {
+		t.Errorf("got %v, want the device error", err)
+	}
+	if err := readProgressReport(strings.NewReader("progress 0 100\n"), nil); err == nil {
+		t.Errorf("expected an error for a truncated report")
+	}
+}
@@ -0,0 +1,493 @@
+// Copyright (C) 2026 Toit contributors.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// Remote serial ports are given as URLs:
+//   - "rfc2217://host:port" for ports exposed by an RFC 2217 server, like
+//     'jag serial-server', ser2net, or pyserial's rfc2217 server. These
+//     support changing the baud rate and the DTR/RTS lines, so devices can
+//     be rebooted.
+//   - "tcp://host:port" for raw TCP bridges. These only forward the data.
+const (
+	rfc2217Scheme = "rfc2217://"
+	tcpScheme     = "tcp://"
+
+	remotePortDialTimeout = 5 * time.Second
+)
+
+// Telnet protocol bytes (RFC 854).
+const (
+	telnetIAC  = 255
+	telnetDONT = 254
+	telnetDO   = 253
+	telnetWONT = 252
+	telnetWILL = 251
+	telnetSB   = 250
+	telnetSE   = 240
+
+	telnetOptionBinary = 0
+	telnetOptionSGA    = 3
+	telnetOptionCOM    = 44
+)
+
+// RFC 2217 commands, sent by the client. The server answers with the
+// command plus rfc2217ServerOffset.
+const (
+	rfc2217SetBaudrate       = 1
+	rfc2217SetDatasize       = 2
+	rfc2217SetParity         = 3
+	rfc2217SetStopsize       = 4
+	rfc2217SetControl        = 5
+	rfc2217NotifyLinestate   = 6
+	rfc2217NotifyModemstate  = 7
+	rfc2217FlowSuspend       = 8
+	rfc2217FlowResume        = 9
+	rfc2217SetLinestateMask  = 10
+	rfc2217SetModemstateMask = 11
+	rfc2217PurgeData         = 12
+
+	rfc2217ServerOffset = 100
+)
+
+// Values for rfc2217SetControl.
+const (
+	rfc2217BreakOn  = 5
+	rfc2217BreakOff = 6
+	rfc2217DTROn    = 8
+	rfc2217DTROff   = 9
+	rfc2217RTSOn    = 11
+	rfc2217RTSOff   = 12
+)
+
+// Values for rfc2217PurgeData.
+const (
+	rfc2217PurgeReceive  = 1
+	rfc2217PurgeTransmit = 2
+	rfc2217PurgeBoth     = 3
+)
+
+// Bits of the modem state.
+const (
+	rfc2217ModemCTS = 0x10
+	rfc2217ModemDSR = 0x20
+	rfc2217ModemRI  = 0x40
+	rfc2217ModemDCD = 0x80
+)
+
+func isRemotePort(port string) bool {
+	return strings.HasPrefix(port, rfc2217Scheme) || strings.HasPrefix(port, tcpScheme)
+}
+
+// esptoolPort returns the port name that the esptool understands.
+// The esptool uses pyserial, which calls raw TCP ports "socket://".
+func esptoolPort(port string) string {
+	if strings.HasPrefix(port, tcpScheme) {
+		return "socket://" + strings.TrimPrefix(port, tcpScheme)
+	}
+	return port
+}
+
+func openRemotePort(port string, baud int) (serial.Port, error) {
+	var address string
+	if strings.HasPrefix(port, rfc2217Scheme) {
+		address = strings.TrimPrefix(port, rfc2217Scheme)
+	} else {
+		address = strings.TrimPrefix(port, tcpScheme)
+	}
+	address = strings.TrimSuffix(address, "/")
+	conn, err := net.DialTimeout("tcp", address, remotePortDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(port, tcpScheme) {
+		return &tcpPort{conn: conn, readTimeout: serial.NoTimeout}, nil
+	}
+	result := newRfc2217Port(conn)
+	if err := result.negotiate(&serial.Mode{BaudRate: baud}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return result, nil
+}
+
+// telnetDecoder separates the data in a telnet stream from the telnet
+// commands.
+type telnetDecoder struct {
+	state byte
+	verb  byte
+	sb    []byte
+
+	// onCommand is called for WILL, WONT, DO, and DONT commands.
+	onCommand func(verb byte, option byte)
+	// onSubnegotiation is called for subnegotiations.
+	onSubnegotiation func(option byte, data []byte)
+}
+
+const (
+	telnetStateData = iota
+	telnetStateIAC
+	telnetStateVerb
+	telnetStateSB
+	telnetStateSBIAC
+)
+
+// decode returns the data in the given bytes. The result is never longer
+// than the input.
+func (t *telnetDecoder) decode(in []byte) []byte {
+	data := make([]byte, 0, len(in))
+	for _, b := range in {
+		switch t.state {
+		case telnetStateData:
+			if b == telnetIAC {
+				t.state = telnetStateIAC
+			} else {
+				data = append(data, b)
+			}
+		case telnetStateIAC:
+			switch b {
+			case telnetIAC:
+				data = append(data, b)
+				t.state = telnetStateData
+			case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+				t.verb = b
+				t.state = telnetStateVerb
+			case telnetSB:
+				t.sb = t.sb[:0]
+				t.state = telnetStateSB
+			default:
+				// Other commands, like NOP, are ignored.
+				t.state = telnetStateData
+			}
+		case telnetStateVerb:
+			if t.onCommand != nil {
+				t.onCommand(t.verb, b)
+			}
+			t.state = telnetStateData
+		case telnetStateSB:
+			if b == telnetIAC {
+				t.state = telnetStateSBIAC
+			} else {
+				t.sb = append(t.sb, b)
+			}
+		case telnetStateSBIAC:
+			switch b {
+			case telnetSE:
+				if len(t.sb) > 0 && t.onSubnegotiation != nil {
+					t.onSubnegotiation(t.sb[0], t.sb[1:])
+				}
+				t.state = telnetStateData
+			case telnetIAC:
+				t.sb = append(t.sb, b)
+				t.state = telnetStateSB
+			default:
+				t.state = telnetStateSB
+			}
+		}
+	}
+	return data
+}
+
+// telnetEscape doubles the IAC bytes in the given data.
+func telnetEscape(data []byte) []byte {
+	result := make([]byte, 0, len(data))
+	for _, b := range data {
+		if b == telnetIAC {
+			result = append(result, telnetIAC)
+		}
+		result = append(result, b)
+	}
+	return result
+}
+
+// rfc2217Command builds an RFC 2217 subnegotiation.
+func rfc2217Command(command byte, value []byte) []byte {
+	result := []byte{telnetIAC, telnetSB, telnetOptionCOM, command}
+	result = append(result, telnetEscape(value)...)
+	return append(result, telnetIAC, telnetSE)
+}
+
+// rfc2217Parity maps between the parity of a serial.Mode and RFC 2217.
+var rfc2217Parity = map[serial.Parity]byte{
+	serial.NoParity:    1,
+	serial.OddParity:   2,
+	serial.EvenParity:  3,
+	serial.MarkParity:  4,
+	serial.SpaceParity: 5,
+}
+
+// rfc2217StopBits maps between the stop bits of a serial.Mode and RFC 2217.
+var rfc2217StopBits = map[serial.StopBits]byte{
+	serial.OneStopBit:           1,
+	serial.TwoStopBits:          2,
+	serial.OnePointFiveStopBits: 3,
+}
+
+// rfc2217Port is a serial.Port for a port on an RFC 2217 server.
+type rfc2217Port struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+	decoder telnetDecoder
+	buffer  []byte
+
+	mu          sync.Mutex
+	readTimeout time.Duration
+	modemState  byte
+}
+
+func newRfc2217Port(conn net.Conn) *rfc2217Port {
+	result := &rfc2217Port{
+		conn:        conn,
+		readTimeout: serial.NoTimeout,
+	}
+	result.decoder.onCommand = result.handleCommand
+	result.decoder.onSubnegotiation = result.handleSubnegotiation
+	return result
+}
+
+func (p *rfc2217Port) negotiate(mode *serial.Mode) error {
+	err := p.writeRaw([]byte{
+		telnetIAC, telnetWILL, telnetOptionCOM,
+		telnetIAC, telnetWILL, telnetOptionBinary,
+		telnetIAC, telnetDO, telnetOptionBinary,
+		telnetIAC, telnetDO, telnetOptionSGA,
+	})
+	if err != nil {
+		return err
+	}
+	return p.SetMode(mode)
+}
+
+func (p *rfc2217Port) handleCommand(verb byte, option byte) {
+	switch option {
+	case telnetOptionCOM, telnetOptionBinary, telnetOptionSGA:
+		// We asked for these ourselves.
+		return
+	}
+	switch verb {
+	case telnetWILL:
+		p.writeRaw([]byte{telnetIAC, telnetDONT, option})
+	case telnetDO:
+		p.writeRaw([]byte{telnetIAC, telnetWONT, option})
+	}
+}
+
+func (p *rfc2217Port) handleSubnegotiation(option byte, data []byte) {
+	if option != telnetOptionCOM || len(data) < 2 {
+		return
+	}
+	if data[0] == rfc2217NotifyModemstate+rfc2217ServerOffset {
+		p.mu.Lock()
+		p.modemState = data[1]
+		p.mu.Unlock()
+	}
+}
+
+func (p *rfc2217Port) writeRaw(data []byte) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	_, err := p.conn.Write(data)
+	return err
+}
+
+func (p *rfc2217Port) command(command byte, value ...byte) error {
+	return p.writeRaw(rfc2217Command(command, value))
+}
+
+func (p *rfc2217Port) SetMode(mode *serial.Mode) error {
+	if mode.BaudRate != 0 {
+		value := make([]byte, 4)
+		binary.BigEndian.PutUint32(value, uint32(mode.BaudRate))
+		if err := p.command(rfc2217SetBaudrate, value...); err != nil {
+			return err
+		}
+	}
+	dataBits := mode.DataBits
+	if dataBits == 0 {
+		dataBits = 8
+	}
+	if err := p.command(rfc2217SetDatasize, byte(dataBits)); err != nil {
+		return err
+	}
+	if err := p.command(rfc2217SetParity, rfc2217Parity[mode.Parity]); err != nil {
+		return err
+	}
+	if err := p.command(rfc2217SetStopsize, rfc2217StopBits[mode.StopBits]); err != nil {
+		return err
+	}
+	if mode.InitialStatusBits != nil {
+		if err := p.SetDTR(mode.InitialStatusBits.DTR); err != nil {
+			return err
+		}
+		return p.SetRTS(mode.InitialStatusBits.RTS)
+	}
+	return nil
+}
+
+func (p *rfc2217Port) Read(buf []byte) (int, error) {
+	p.mu.Lock()
+	timeout := p.readTimeout
+	p.mu.Unlock()
+	deadline := time.Time{}
+	if timeout != serial.NoTimeout {
+		deadline = time.Now().Add(timeout)
+	}
+	if err := p.conn.SetReadDeadline(deadline); err != nil {
+		return 0, err
+	}
+	if cap(p.buffer) < len(buf) {
+		p.buffer = make([]byte, len(buf))
+	}
+	for {
+		n, err := p.conn.Read(p.buffer[:len(buf)])
+		if n > 0 {
+			data := p.decoder.decode(p.buffer[:n])
+			if len(data) > 0 {
+				return copy(buf, data), nil
+			}
+		}
+		if err != nil {
+			if isTimeoutError(err) {
+				return 0, nil
+			}
+			return 0, err
+		}
+	}
+}
+
+func (p *rfc2217Port) Write(data []byte) (int, error) {
+	if err := p.writeRaw(telnetEscape(data)); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (p *rfc2217Port) Drain() error {
+	return nil
+}
+
+func (p *rfc2217Port) ResetInputBuffer() error {
+	return p.command(rfc2217PurgeData, rfc2217PurgeReceive)
+}
+
+func (p *rfc2217Port) ResetOutputBuffer() error {
+	return p.command(rfc2217PurgeData, rfc2217PurgeTransmit)
+}
+
+func (p *rfc2217Port) SetDTR(dtr bool) error {
+	if dtr {
+		return p.command(rfc2217SetControl, rfc2217DTROn)
+	}
+	return p.command(rfc2217SetControl, rfc2217DTROff)
+}
+
+func (p *rfc2217Port) SetRTS(rts bool) error {
+	if rts {
+		return p.command(rfc2217SetControl, rfc2217RTSOn)
+	}
+	return p.command(rfc2217SetControl, rfc2217RTSOff)
+}
+
+// GetModemStatusBits returns the modem state that the server last
+// reported.
+func (p *rfc2217Port) GetModemStatusBits() (*serial.ModemStatusBits, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return &serial.ModemStatusBits{
+		CTS: p.modemState&rfc2217ModemCTS != 0,
+		DSR: p.modemState&rfc2217ModemDSR != 0,
+		RI:  p.modemState&rfc2217ModemRI != 0,
+		DCD: p.modemState&rfc2217ModemDCD != 0,
+	}, nil
+}
+
+func (p *rfc2217Port) SetReadTimeout(t time.Duration) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.readTimeout = t
+	return nil
+}
+
+func (p *rfc2217Port) Close() error {
+	return p.conn.Close()
+}
+
+func (p *rfc2217Port) Break(d time.Duration) error {
+	if err := p.command(rfc2217SetControl, rfc2217BreakOn); err != nil {
+		return err
+	}
+	time.Sleep(d)
+	return p.command(rfc2217SetControl, rfc2217BreakOff)
+}
+
+// tcpPort is a serial.Port for a raw TCP bridge.
+// Raw bridges only forward data. The port settings and control lines are
+// ignored, so the device can't be rebooted through them.
+type tcpPort struct {
+	conn        net.Conn
+	mu          sync.Mutex
+	readTimeout time.Duration
+}
+
+func (p *tcpPort) SetMode(mode *serial.Mode) error {
+	return nil
+}
+
+func (p *tcpPort) Read(buf []byte) (int, error) {
+	p.mu.Lock()
+	timeout := p.readTimeout
+	p.mu.Unlock()
+	deadline := time.Time{}
+	if timeout != serial.NoTimeout {
+		deadline = time.Now().Add(timeout)
+	}
+	if err := p.conn.SetReadDeadline(deadline); err != nil {
+		return 0, err
+	}
+	n, err := p.conn.Read(buf)
+	if err != nil && isTimeoutError(err) {
+		return n, nil
+	}
+	return n, err
+}
+
+func (p *tcpPort) Write(data []byte) (int, error) {
+	return p.conn.Write(data)
+}
+
+func (p *tcpPort) Drain() error             { return nil }
+func (p *tcpPort) ResetInputBuffer() error  { return nil }
+func (p *tcpPort) ResetOutputBuffer() error { return nil }
+func (p *tcpPort) SetDTR(dtr bool) error    { return nil }
+func (p *tcpPort) SetRTS(rts bool) error    { return nil }
+
+func (p *tcpPort) GetModemStatusBits() (*serial.ModemStatusBits, error) {
+	return &serial.ModemStatusBits{}, nil
+}
+
+func (p *tcpPort) SetReadTimeout(t time.Duration) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.readTimeout = t
+	return nil
+}
+
+func (p *tcpPort) Close() error {
+	return p.conn.Close()
+}
+
+func (p *tcpPort) Break(d time.Duration) error {
+	return fmt.Errorf("raw TCP ports don't support breaks")
+}
@@ -0,0 +1,170 @@
+// Copyright (C) 2026 Toit contributors.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// fakeSerialPort records the settings and written data, and returns the
+// data that is sent to its incoming pipe.
+type fakeSerialPort struct {
+	mu       sync.Mutex
+	mode     serial.Mode
+	dtr, rts bool
+	written  []byte
+
+	incomingReader *io.PipeReader
+	incomingWriter *io.PipeWriter
+}
+
+func newFakeSerialPort() *fakeSerialPort {
+	reader, writer := io.Pipe()
+	return &fakeSerialPort{incomingReader: reader, incomingWriter: writer, dtr: true, rts: true}
+}
+
+func (f *fakeSerialPort) SetMode(mode *serial.Mode) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.mode = *mode
+	return nil
+}
+
+func (f *fakeSerialPort) Read(p []byte) (int, error) { return f.incomingReader.Read(p) }
+
+func (f *fakeSerialPort) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.written = append(f.written, p...)
+	return len(p), nil
+}
+
+func (f *fakeSerialPort) Drain() error             { return nil }
+func (f *fakeSerialPort) ResetInputBuffer() error  { return nil }
+func (f *fakeSerialPort) ResetOutputBuffer() error { return nil }
+
+func (f *fakeSerialPort) SetDTR(dtr bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.dtr = dtr
+	return nil
+}
+
+func (f *fakeSerialPort) SetRTS(rts bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rts = rts
+	return nil
+}
+
+func (f *fakeSerialPort) GetModemStatusBits() (*serial.ModemStatusBits, error) {
+	return &serial.ModemStatusBits{}, nil
+}
+func (f *fakeSerialPort) SetReadTimeout(t time.Duration) error { return nil }
+func (f *fakeSerialPort) Break(time.Duration) error            { return nil }
+
+func (f *fakeSerialPort) Close() error {
+	f.incomingReader.Close()
+	return nil
+}
+
+// waitFor polls the condition until it holds or a timeout expires.
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRfc2217(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	fake := newFakeSerialPort()
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		newRfc2217Server(conn, fake, &serial.Mode{BaudRate: 115200}).serve()
+	}()
+
+	port, err := serialOpen(rfc2217Scheme+listener.Addr().String(), 921600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "the baud rate", func() bool {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		return fake.mode.BaudRate == 921600 && fake.mode.DataBits == 8
+	})
+
+	port.Reboot()
+	waitFor(t, "the control lines", func() bool {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		return !fake.dtr && !fake.rts
+	})
+
+	// IAC bytes must survive in both directions.
+	sent := []byte{1, telnetIAC, 2, telnetIAC, telnetIAC}
+	if _, err := port.Write(sent); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the written data", func() bool {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		return bytes.Equal(fake.written, sent)
+	})
+
+	received := []byte{telnetIAC, 'a', telnetIAC, 'b'}
+	go fake.incomingWriter.Write(received)
+	var got []byte
+	buf := make([]byte, 16)
+	for len(got) < len(received) {
+		n, err := port.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if !bytes.Equal(got, received) {
+		t.Fatalf("read %v, want %v", got, received)
+	}
+
+	port.Close()
+	<-served
+}
+
+func TestEsptoolPort(t *testing.T) {
+	tests := map[string]string{
+		"tcp://pi:4000":     "socket://pi:4000",
+		"rfc2217://pi:2217": "rfc2217://pi:2217",
+		"/dev/ttyUSB0":      "/dev/ttyUSB0",
+	}
+	for port, want := range tests {
+		if got := esptoolPort(port); got != want {
+			t.Errorf("esptoolPort(%q) = %q, want %q", port, got, want)
+		}
+	}
+}
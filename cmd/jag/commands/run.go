@@ -7,7 +7,10 @@ package commands
 import (
 	"bytes"
 	"context"
+	_ "embed"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math"
@@ -86,7 +89,7 @@ func GetUuid(filename string) (uuid.UUID, error) {
 
 func RunCmd() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "run <file>",
+		Use:   "run <file> [-- <arguments>...]",
 		Short: "Run Toit code on a Jaguar device",
 		Long: "Run the specified .toit file on a Jaguar device as a new program. If the\n" +
 			"device is already executing another program, that program is stopped before\n" +
@@ -104,7 +107,24 @@ func RunCmd() *cobra.Command {
 			"     UART-only mode.\n" +
 			"\n" +
 			"For example 'jag run -D jag.wifi=false wifi-scan.toit' will run the wifi-scan\n" +
-			"program on the device without Jaguar using the network.",
+			"program on the device without Jaguar using the network.\n" +
+			"\n" +
+			"Programs that run on host get the same 'jag.defines' and assets as on devices.\n" +
+			"Arguments after the file are passed to 'main', on host and on devices:\n" +
+			"  jag run blink.toit -- 500\n" +
+			"\n" +
+			"With '-s', the given Toit code runs as the body of 'main'. Lines that start\n" +
+			"with 'import' are kept outside of it. On proxied devices, the output of the\n" +
+			"program, or the output on the serial port given with --port, is shown until\n" +
+			"it stops. For example:\n" +
+			"  jag run -s 'print (3 + 4)' -d mydevice\n" +
+			"\n" +
+			"With --wait, jag shows the output of the program on the device, waits for\n" +
+			"it to stop, and exits with its exit code. The output is read from the proxy\n" +
+			"of the device, or from the serial port given with --port. Devices that are\n" +
+			"reached directly over the network don't send their output, so they need\n" +
+			"--port. If the program doesn't stop within the --timeout, jag exits with\n" +
+			"code 124.",
 		Args:         cobra.MinimumNArgs(0),
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
@@ -124,20 +144,20 @@ func RunCmd() *cobra.Command {
 			}
 
 			if name, ok := deviceSelect.(deviceNameSelect); ok && string(name) == "host" {
-				if cmd.Flags().Changed("define") {
-					return fmt.Errorf("--define/-D is not yet supported when running on host")
-				}
 				return runOnHost(ctx, cmd, args, optimizationLevel)
 			}
 
-			if cmd.Flags().Changed("expression") {
-				return fmt.Errorf("--expression/-s is not yet supported when running on devices")
+			expression, err := cmd.Flags().GetString("expression")
+			if err != nil {
+				return err
 			}
 
-			if len(args) == 0 {
+			if expression != "" {
+				if len(args) > 0 {
+					return fmt.Errorf("passing arguments to expressions is only supported with 'jag run -d host'")
+				}
+			} else if len(args) == 0 {
 				return fmt.Errorf("no input file provided")
-			} else if len(args) > 1 {
-				return fmt.Errorf("passing arguments is only supported with 'jag run -d host'")
 			}
 
 			programAssetsPath, err := GetProgramAssetsPath(cmd.Flags(), "assets")
@@ -145,6 +165,15 @@ func RunCmd() *cobra.Command {
 				return err
 			}
 
+			wait, err := parseWaitOptions(cmd)
+			if err != nil {
+				return err
+			}
+
+			if expression != "" {
+				return runExpression(cmd, deviceSelect, expression, programAssetsPath, optimizationLevel, wait)
+			}
+
 			entrypoint := args[0]
 			if stat, err := os.Stat(entrypoint); err != nil {
 				if os.IsNotExist(err) {
@@ -169,19 +198,79 @@ func RunCmd() *cobra.Command {
 			if err != nil {
 				return err
 			}
+			defines = withArguments(defines, args[1:])
 
-			return RunFile(cmd, device, sdk, entrypoint, defines, programAssetsPath, optimizationLevel)
+			if !wait.wait {
+				return RunFile(cmd, device, sdk, entrypoint, defines, programAssetsPath, optimizationLevel)
+			}
+			// Follow the output before the program starts, so that none of it
+			// is lost.
+			output, err := wait.open(ctx, device)
+			if err != nil {
+				return err
+			}
+			defer output.Close()
+			if err := RunFile(cmd, device, sdk, entrypoint, defines, programAssetsPath, optimizationLevel); err != nil {
+				return err
+			}
+			return waitForProgram(ctx, output, os.Stdout, wait.timeout)
 		},
 	}
 
-	cmd.Flags().StringP("expression", "s", "", "evaluate immediate Toit expression")
+	cmd.Flags().StringP("expression", "s", "", "evaluate immediate Toit expression, on host or on a device")
 	cmd.Flags().StringP("device", "d", "", "use device with a given name, id, or address")
 	cmd.Flags().StringArrayP("define", "D", nil, "define settings to control run on device")
 	cmd.Flags().String("assets", "", "attach assets to the program")
 	cmd.Flags().IntP("optimization-level", "O", 1, "optimization level")
+	cmd.Flags().Bool("wait", false, "show the output of the program on the device and exit with its exit code")
+	cmd.Flags().Duration("timeout", 0, "with --wait, how long to wait for the program to stop; 0 waits forever")
+	cmd.Flags().String("port", "", "serial port to read the output of the program from; required for devices that aren't reached through a proxy")
+	cmd.Flags().Uint("baud", 115200, "the baud rate of the serial port")
 	return cmd
 }
 
+// waitOptions describe how 'jag run' follows programs on devices.
+type waitOptions struct {
+	wait    bool
+	timeout time.Duration
+	// port is the serial port of the device, or "" to read the output
+	// from the proxy of the device.
+	port string
+	baud int
+}
+
+func parseWaitOptions(cmd *cobra.Command) (*waitOptions, error) {
+	wait, err := cmd.Flags().GetBool("wait")
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := cmd.Flags().GetDuration("timeout")
+	if err != nil {
+		return nil, err
+	}
+	port, err := cmd.Flags().GetString("port")
+	if err != nil {
+		return nil, err
+	}
+	baud, err := cmd.Flags().GetUint("baud")
+	if err != nil {
+		return nil, err
+	}
+	if cmd.Flags().Changed("timeout") && !wait && !cmd.Flags().Changed("expression") {
+		return nil, fmt.Errorf("--timeout needs --wait")
+	}
+	return &waitOptions{wait: wait, timeout: timeout, port: port, baud: int(baud)}, nil
+}
+
+// open starts following the output of the device.
+func (o *waitOptions) open(ctx context.Context, device Device) (*programOutput, error) {
+	output, err := openProgramOutput(ctx, device, o.port, o.baud)
+	if err == errNoProgramOutput {
+		return nil, fmt.Errorf("'%s' isn't reached through a proxy and doesn't send the output of its programs over the network; use '--port' to read the output from its serial port", device.Name())
+	}
+	return output, err
+}
+
 func runOnHost(ctx context.Context, cmd *cobra.Command, args []string, optimizationLevel int) error {
 	sdk, err := GetSDK(ctx)
 	if err != nil {
@@ -193,29 +282,241 @@ func runOnHost(ctx context.Context, cmd *cobra.Command, args []string, optimizat
 		return err
 	}
 
-	return runOnHostWithSDK(ctx, sdk, args, optimizationLevel, expression)
-}
-
-func runOnHostWithSDK(ctx context.Context, sdk *SDK, args []string, optimizationLevel int, expression string) error {
-	if optimizationLevel >= 0 {
-		args = append([]string{"-O" + strconv.Itoa(optimizationLevel)}, args...)
+	programAssetsPath, err := GetProgramAssetsPath(cmd.Flags(), "assets")
+	if err != nil {
+		return err
 	}
 
-	var runCmd *exec.Cmd
+	defines, err := parseDefineFlags(cmd, "define")
+	if err != nil {
+		return err
+	}
 
-	if expression != "" {
-		expressionArgs := append([]string{"-s", expression}, args...)
-		runCmd = sdk.ToitRun(ctx, expressionArgs...)
-	} else {
-		runCmd = sdk.ToitRun(ctx, args...)
+	err = runOnHostWithSDK(ctx, sdk, &hostProgram{
+		args:              args,
+		optimizationLevel: optimizationLevel,
+		expression:        expression,
+		defines:           defines,
+		assetsPath:        programAssetsPath,
+	})
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() > 0 {
+		// Exit with the exit code of the program, like on devices.
+		return &ExitCodeError{Code: exitErr.ExitCode()}
 	}
+	return err
+}
+
+// The launcher runs program images on host, so that programs get their
+// assets like on devices.
+//
+//go:embed host/launcher.toit
+var hostLauncher []byte
+
+// hostWordSize is the word size of the host VM, which runs on the same
+// machine as jag.
+const hostWordSize = strconv.IntSize / 8
+
+// hostProgram is a program that runs on host.
+type hostProgram struct {
+	// args are the program followed by its arguments, or only the
+	// arguments if expression is set.
+	args              []string
+	optimizationLevel int
+	expression        string
+	defines           map[string]interface{}
+	assetsPath        string
+}
 
+func runOnHostWithSDK(ctx context.Context, sdk *SDK, program *hostProgram) error {
+	runCmd, cleanup, err := program.command(ctx, sdk, os.Stdout, os.Stderr)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
 	runCmd.Stderr = os.Stderr
 	runCmd.Stdout = os.Stdout
 	runCmd.Stdin = os.Stdin
 	return runCmd.Run()
 }
 
+// command returns the command that runs the program. The output of the
+// tools that prepare the program goes to stdout and stderr. The returned
+// function removes the temporary files of the command.
+// Programs with defines or assets are built into an image like for a
+// device, and the image is run by the launcher. Like on devices, the
+// defines are added to the assets as 'jag.defines'.
+func (p *hostProgram) command(ctx context.Context, sdk *SDK, stdout io.Writer, stderr io.Writer) (*exec.Cmd, func(), error) {
+	assetsMap := make(map[string]interface{})
+	for key, value := range p.defines {
+		if strings.HasPrefix(key, "jag.") {
+			fmt.Fprintf(stdout, "Warning: '-D %s' has no effect when running on host\n", key)
+			continue
+		}
+		assetsMap[key] = value
+	}
+
+	args := p.args
+	if len(assetsMap) == 0 && p.assetsPath == "" {
+		if p.optimizationLevel >= 0 {
+			args = append([]string{"-O" + strconv.Itoa(p.optimizationLevel)}, args...)
+		}
+		if p.expression != "" {
+			args = append([]string{"-s", p.expression}, args...)
+		}
+		return sdk.ToitRun(ctx, args...), func() {}, nil
+	}
+
+	tempdir, err := os.MkdirTemp("", "jag_host")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() { os.RemoveAll(tempdir) }
+	runCmd, err := p.launcherCommand(ctx, sdk, tempdir, assetsMap, stdout, stderr)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return runCmd, cleanup, nil
+}
+
+// launcherCommand builds the image of the program in the given directory,
+// and returns the command that runs it with the launcher.
+func (p *hostProgram) launcherCommand(ctx context.Context, sdk *SDK, tempdir string, assetsMap map[string]interface{}, stdout io.Writer, stderr io.Writer) (*exec.Cmd, error) {
+	args := p.args
+	var entrypoint string
+	if p.expression != "" {
+		entrypoint = filepath.Join(tempdir, "expression.toit")
+		if err := os.WriteFile(entrypoint, []byte(expressionProgram(p.expression)), 0644); err != nil {
+			return nil, err
+		}
+	} else {
+		if len(args) == 0 {
+			return nil, fmt.Errorf("no program to run")
+		}
+		entrypoint = args[0]
+		args = args[1:]
+	}
+
+	snapshot := entrypoint
+	if !IsSnapshot(entrypoint) {
+		snapshot = filepath.Join(tempdir, "program.snapshot")
+		if err := sdk.compile(ctx, snapshot, entrypoint, p.optimizationLevel, stdout, stderr); err != nil {
+			return nil, err
+		}
+	}
+
+	assetsPath := p.assetsPath
+	if len(assetsMap) > 0 {
+		assetsFile, err := os.Create(filepath.Join(tempdir, "program.assets"))
+		if err != nil {
+			return nil, err
+		}
+		err = buildAssets(ctx, sdk, assetsFile, assetsPath, assetsMap)
+		assetsFile.Close()
+		if err != nil {
+			return nil, err
+		}
+		assetsPath = assetsFile.Name()
+	}
+
+	image, err := sdk.buildImage(ctx, hostWordSize, snapshot, assetsPath, stdout, stderr)
+	if err != nil {
+		return nil, err
+	}
+	imagePath := filepath.Join(tempdir, "program.image")
+	if err := os.WriteFile(imagePath, image, 0644); err != nil {
+		return nil, err
+	}
+	launcherPath := filepath.Join(tempdir, "launcher.toit")
+	if err := os.WriteFile(launcherPath, hostLauncher, 0644); err != nil {
+		return nil, err
+	}
+	return sdk.ToitRun(ctx, append([]string{launcherPath, imagePath}, args...)...), nil
+}
+
+// withArguments adds the arguments for the program to the defines.
+func withArguments(defines map[string]interface{}, arguments []string) map[string]interface{} {
+	if len(arguments) == 0 {
+		return defines
+	}
+	if defines == nil {
+		defines = make(map[string]interface{})
+	}
+	defines["jag.arguments"] = arguments
+	return defines
+}
+
+// runExpression runs a program that evaluates the given expression on a
+// device, and shows its output if the device is proxied.
+func runExpression(cmd *cobra.Command, deviceSelect deviceSelect, expression string, assetsPath string, optimizationLevel int, wait *waitOptions) error {
+	ctx := cmd.Context()
+	sdk, err := GetSDK(ctx)
+	if err != nil {
+		return err
+	}
+
+	device, err := GetDevice(ctx, sdk, true, deviceSelect)
+	if err != nil {
+		return err
+	}
+
+	defines, err := parseDefineFlags(cmd, "define")
+	if err != nil {
+		return err
+	}
+
+	tempdir, err := os.MkdirTemp("", "jag_expression")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempdir)
+	entrypoint := filepath.Join(tempdir, "expression.toit")
+	if err := os.WriteFile(entrypoint, []byte(expressionProgram(expression)), 0644); err != nil {
+		return err
+	}
+
+	// Subscribe to the output before the program starts, so that none of it
+	// is lost.
+	output, err := openProgramOutput(ctx, device, wait.port, wait.baud)
+	if err == errNoProgramOutput && !wait.wait {
+		output = nil
+	} else if err != nil {
+		return err
+	} else {
+		defer output.Close()
+	}
+
+	fmt.Printf("Running expression on '%s' ...\n", device.Name())
+	if err := sendCodeFromFile(cmd, device, sdk, "/run", entrypoint, "", defines, assetsPath, optimizationLevel); err != nil {
+		return err
+	}
+	if output == nil {
+		fmt.Println("Use 'jag monitor' to see the output of the program.")
+		return nil
+	}
+	return waitForProgram(ctx, output, os.Stdout, wait.timeout)
+}
+
+// expressionProgram returns the source of a program that evaluates the
+// given expression. Import lines stay at the top level, and the rest is
+// the body of 'main'.
+func expressionProgram(expression string) string {
+	imports := []string{}
+	body := []string{}
+	for _, line := range strings.Split(expression, "\n") {
+		if strings.HasPrefix(line, "import ") {
+			imports = append(imports, line)
+		} else {
+			body = append(body, "  "+line)
+		}
+	}
+	program := strings.Join(imports, "\n")
+	if len(imports) > 0 {
+		program += "\n\n"
+	}
+	return program + "main:\n" + strings.Join(body, "\n") + "\n"
+}
+
 func RunFile(
 	cmd *cobra.Command,
 	device Device,
@@ -252,7 +553,47 @@ func sendCodeFromFile(
 	assetsPath string,
 	optimizationLevel int) error {
 
-	ctx := cmd.Context()
+	err := sendCode(cmd.Context(), device, sdk, request, path, name, defines, assetsPath, optimizationLevel, os.Stdout, os.Stderr)
+	var reported *reportedError
+	if errors.As(err, &reported) {
+		// Mark the command as silent to avoid printing the error twice.
+		cmd.SilenceErrors = true
+		cmd.SilenceUsage = true
+		return reported.err
+	}
+	return err
+}
+
+// reportedError is an error that has already been written to the output.
+type reportedError struct {
+	err error
+}
+
+func (e *reportedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *reportedError) Unwrap() error {
+	return e.err
+}
+
+// sendCode compiles the program at the given path, if it isn't a snapshot
+// yet, and sends it to the device. The output of the tools and the progress
+// are written to stdout and stderr. Errors that have been written there are
+// returned as *reportedError.
+func sendCode(
+	ctx context.Context,
+	device Device,
+	sdk *SDK,
+	request string,
+	path string,
+	name string,
+	defines map[string]interface{},
+	assetsPath string,
+	optimizationLevel int,
+	stdout io.Writer,
+	stderr io.Writer) error {
+
 	snapshotsStateDir, err := directory.GetSnapshotsStatePath()
 	if err != nil {
 		return err
@@ -276,13 +617,10 @@ func sendCodeFromFile(
 			return err
 		}
 		snapshot = snapshotFile.Name()
-		err = sdk.Compile(ctx, snapshot, path, optimizationLevel)
+		err = sdk.compile(ctx, snapshot, path, optimizationLevel, stdout, stderr)
 		if err != nil {
-			// We assume the error has been printed.
-			// Mark the command as silent to avoid printing the error twice.
-			cmd.SilenceErrors = true
-			cmd.SilenceUsage = true
-			return err
+			// We assume the compiler printed the error.
+			return &reportedError{err}
 		}
 	}
 
@@ -302,7 +640,7 @@ func sendCodeFromFile(
 	if cacheDestination != snapshot {
 		tempFileInCacheDirectory, err := os.CreateTemp(snapshotsStateDir, "jag_run_*.snapshot")
 		if err != nil {
-			fmt.Printf("Failed to write temporary file in '%s'\n", snapshotsStateDir)
+			fmt.Fprintf(stdout, "Failed to write temporary file in '%s'\n", snapshotsStateDir)
 			return err
 		}
 		defer tempFileInCacheDirectory.Close()
@@ -310,7 +648,7 @@ func sendCodeFromFile(
 
 		source, err := os.Open(snapshot)
 		if err != nil {
-			fmt.Printf("Failed to read '%s'n", snapshot)
+			fmt.Fprintf(stdout, "Failed to read '%s'n", snapshot)
 			return err
 		}
 		defer source.Close()
@@ -318,7 +656,7 @@ func sendCodeFromFile(
 
 		_, err = io.Copy(tempFileInCacheDirectory, source)
 		if err != nil {
-			fmt.Printf("Failed to write '%s'n", tempFileInCacheDirectory.Name())
+			fmt.Fprintf(stdout, "Failed to write '%s'n", tempFileInCacheDirectory.Name())
 			return err
 		}
 		tempFileInCacheDirectory.Close()
@@ -339,7 +677,7 @@ func sendCodeFromFile(
 		if strings.HasPrefix(key, "jag.") {
 			if key == "jag.disabled" || key == "jag.wifi" {
 				if key == "jag.disabled" {
-					fmt.Println("Warning: jag.disabled is deprecated, use jag.wifi=false instead")
+					fmt.Fprintln(stdout, "Warning: jag.disabled is deprecated, use jag.wifi=false instead")
 				}
 				switch converted := value.(type) {
 				case bool:
@@ -373,6 +711,15 @@ func sendCodeFromFile(
 				default:
 					return fmt.Errorf("cannot parse jag.interval ('%s') as a duration", converted)
 				}
+			} else if key == "jag.arguments" {
+				encoded, err := encodeArguments(value)
+				if err != nil {
+					return err
+				}
+				if err := requireFeature(ctx, device, featureArguments); err != nil {
+					return err
+				}
+				headersMap[JaguarArgumentsHeader] = encoded
 			} else {
 				return fmt.Errorf("unsupported Jaguar define: %s", key)
 			}
@@ -392,28 +739,60 @@ func sendCodeFromFile(
 		assetsPath = temporaryAssetsFile.Name()
 	}
 
-	b, err := sdk.Build(ctx, device, cacheDestination, assetsPath)
+	b, err := sdk.buildImage(ctx, device.WordSize(), cacheDestination, assetsPath, stdout, stderr)
 	if err != nil {
-		// We assume the error has been printed.
-		// Mark the command as silent to avoid printing the error twice.
-		cmd.SilenceErrors = true
-		cmd.SilenceUsage = true
-		return err
+		// We assume the tool printed the error.
+		return &reportedError{err}
 	}
 	startSend := time.Now()
 	if err := device.SendCode(ctx, sdk, request, b, headersMap); err != nil {
-		fmt.Println("Error:", err)
-		// We just printed the error.
-		// Mark the command as silent to avoid printing the error twice.
-		cmd.SilenceErrors = true
-		cmd.SilenceUsage = true
-		return err
+		fmt.Fprintln(stdout, "Error:", err)
+		return &reportedError{err}
 	}
 	elapsed := time.Since(startSend)
-	fmt.Printf("Success: Sent %dKB code to '%s' in %.2fs\n", len(b)/1024, device.Name(), elapsed.Seconds())
+	fmt.Fprintf(stdout, "Success: Sent %dKB code to '%s' in %.2fs\n", len(b)/1024, device.Name(), elapsed.Seconds())
 	return nil
 }
 
+// encodeArguments encodes the arguments of a program for the
+// X-Jaguar-Arguments header. Headers can't hold arbitrary text, so the
+// arguments are a base64-encoded JSON list.
+func encodeArguments(value interface{}) (string, error) {
+	var arguments []string
+	switch converted := value.(type) {
+	case []string:
+		arguments = converted
+	case []interface{}:
+		for _, element := range converted {
+			str, ok := element.(string)
+			if !ok {
+				return "", fmt.Errorf("jag.arguments must be a list of strings")
+			}
+			arguments = append(arguments, str)
+		}
+	default:
+		return "", fmt.Errorf("jag.arguments must be a list of strings")
+	}
+	encoded, err := json.Marshal(arguments)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(encoded), nil
+}
+
+// decodeArguments decodes the X-Jaguar-Arguments header.
+func decodeArguments(header string) ([]string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(header)
+	if err != nil {
+		return nil, err
+	}
+	var arguments []string
+	if err := json.Unmarshal(decoded, &arguments); err != nil {
+		return nil, err
+	}
+	return arguments, nil
+}
+
 func buildAssets(ctx context.Context, sdk *SDK, output *os.File, inputPath string, assetsMap map[string]interface{}) error {
 	// Write the defines into a temporary file as JSON.
 	definesJsonFile, err := os.CreateTemp("", "jag_run_*.defines")
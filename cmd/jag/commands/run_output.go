@@ -0,0 +1,225 @@
+// Copyright (C) 2026 Toit contributors.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errNoProgramOutput is returned when the output of a device can't be
+// followed. Only proxies pass on the output of their devices.
+var errNoProgramOutput = fmt.Errorf("the output of the device is not available")
+
+// programStatusPattern matches the lines that Jaguar logs when it starts
+// and stops programs.
+var programStatusPattern = regexp.MustCompile(`program ([0-9a-f-]{36}) (started|stopped)(?: - exit code (-?[0-9]+))?`)
+
+// programOutput is the output of the next program that starts on a
+// device. Reading it returns the raw output lines of the device, and
+// io.EOF once the program stopped.
+type programOutput struct {
+	reader *io.PipeReader
+	cancel context.CancelFunc
+	// done is closed when the program stopped.
+	done chan struct{}
+	// exitCode is the exit code of the program, once done is closed.
+	exitCode int
+	// ended is closed when the output ended, and err is the reason.
+	ended chan struct{}
+	err   error
+}
+
+// followProgramOutput subscribes to the output of the device. It must be
+// called before the program is sent to the device.
+func followProgramOutput(ctx context.Context, device Device) (*programOutput, error) {
+	d, ok := device.(*DeviceNetwork)
+	if !ok || !d.proxied {
+		return nil, errNoProgramOutput
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	req, err := d.newRequest(ctx, "GET", "/api/logs?history=false", nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		// Older proxies don't serve the output of their devices.
+		res.Body.Close()
+		cancel()
+		return nil, errNoProgramOutput
+	}
+
+	return newProgramOutput(res.Body, true, cancel), nil
+}
+
+// followSerialOutput follows the output of a device on a serial port.
+func followSerialOutput(ctx context.Context, port string, baud int) (*programOutput, error) {
+	dev, err := serialOpen(port, baud)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		<-ctx.Done()
+		// Closing the port ends the reads.
+		dev.Close()
+	}()
+	return newProgramOutput(dev, false, cancel), nil
+}
+
+// newProgramOutput follows the output lines in source. If events is true,
+// the source is a stream of server-sent events with one line each.
+func newProgramOutput(source io.ReadCloser, events bool, cancel context.CancelFunc) *programOutput {
+	reader, writer := io.Pipe()
+	output := &programOutput{
+		reader: reader,
+		cancel: cancel,
+		done:   make(chan struct{}),
+		ended:  make(chan struct{}),
+	}
+	go func() {
+		defer close(output.ended)
+		defer source.Close()
+		output.err = output.follow(source, events, writer)
+		writer.CloseWithError(output.err)
+	}()
+	return output
+}
+
+// follow copies the output lines in source to out, until the program that
+// starts next stopped.
+func (o *programOutput) follow(source io.Reader, events bool, out io.Writer) error {
+	program := ""
+	scanner := bufio.NewScanner(source)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if events {
+			if !strings.HasPrefix(line, "data: ") {
+				continue
+			}
+			line = strings.TrimPrefix(line, "data: ")
+		}
+		if _, err := fmt.Fprintln(out, line); err != nil {
+			return err
+		}
+		match := programStatusPattern.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		if match[2] == "started" && program == "" {
+			program = match[1]
+		} else if match[2] == "stopped" && match[1] == program {
+			if match[3] != "" {
+				o.exitCode, _ = strconv.Atoi(match[3])
+			}
+			close(o.done)
+			return io.EOF
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("the output ended before the program stopped")
+}
+
+func (o *programOutput) Read(p []byte) (int, error) {
+	return o.reader.Read(p)
+}
+
+// Close stops following the output.
+func (o *programOutput) Close() error {
+	o.cancel()
+	return o.reader.Close()
+}
+
+// openProgramOutput starts following the output of the device, over the
+// serial port if one is given, or through the proxy of the device.
+func openProgramOutput(ctx context.Context, device Device, port string, baud int) (*programOutput, error) {
+	if port != "" {
+		return followSerialOutput(ctx, port, baud)
+	}
+	return followProgramOutput(ctx, device)
+}
+
+// ExitCodeError is returned when a program on a device failed. The jag
+// command exits with the same code.
+type ExitCodeError struct {
+	Code int
+	// Reason is the reason of the failure, if the program didn't exit by
+	// itself.
+	Reason string
+}
+
+func (e *ExitCodeError) Error() string {
+	if e.Reason != "" {
+		return e.Reason
+	}
+	return fmt.Sprintf("the program exited with code %d", e.Code)
+}
+
+// timeoutExitCode is the exit code when a program doesn't stop in time,
+// like for the 'timeout' command.
+const timeoutExitCode = 124
+
+// waitForProgram writes the decoded output of the program to out until it
+// stops, and returns an ExitCodeError if it failed. A timeout of 0 waits
+// forever.
+func waitForProgram(ctx context.Context, output *programOutput, out io.Writer, timeout time.Duration) error {
+	waitCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	decoded := make(chan struct{})
+	go func() {
+		decoder := NewDecoder(bufio.NewScanner(output), ctx, "")
+		decoder.SetOutput(out)
+		decoder.decode(false, false)
+		close(decoded)
+	}()
+
+	select {
+	case <-decoded:
+	case <-waitCtx.Done():
+		// Stop the decoder.
+		output.Close()
+		<-decoded
+	}
+
+	select {
+	case <-output.done:
+	default:
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if waitCtx.Err() != nil {
+			return &ExitCodeError{Code: timeoutExitCode, Reason: fmt.Sprintf("the program didn't stop within %v", timeout)}
+		}
+		output.Close()
+		<-output.ended
+		if output.err == nil || output.err == io.EOF {
+			return fmt.Errorf("the output ended before the program stopped")
+		}
+		return output.err
+	}
+	if output.exitCode != 0 {
+		return &ExitCodeError{Code: output.exitCode}
+	}
+	return nil
+}
@@ -0,0 +1,264 @@
+// Copyright (C) 2026 Toit contributors.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpressionProgram(t *testing.T) {
+	tests := []struct {
+		expression string
+		want       string
+	}{
+		{"print (3 + 4)", "main:\n  print (3 + 4)\n"},
+		{
+			"import gpio\nimport i2c\npin := gpio.Pin 2\nprint pin.get",
+			"import gpio\nimport i2c\n\nmain:\n  pin := gpio.Pin 2\n  print pin.get\n",
+		},
+	}
+	for _, test := range tests {
+		if got := expressionProgram(test.expression); got != test.want {
+			t.Errorf("expressionProgram(%q) = %q, want %q", test.expression, got, test.want)
+		}
+	}
+}
+
+func TestFollowProgramOutput(t *testing.T) {
+	const program = "a3a1b5c2-9b43-4e5c-8d2f-0a5b6f0e7d11"
+	lines := []string{
+		"[jaguar] INFO: container 'other' started",
+		"[jaguar] INFO: program " + program + " started",
+		"7",
+		"[jaguar] ERROR: program " + program + " stopped - exit code 1",
+		"after",
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/logs" || r.URL.Query().Get("history") != "false" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, line := range lines {
+			fmt.Fprintf(w, "data: %s\n\n", line)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	device := &DeviceNetwork{DeviceBase: DeviceBase{address: server.URL}, proxied: true}
+	output, err := followProgramOutput(ctx, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer output.Close()
+	got, err := io.ReadAll(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ""
+	for _, line := range lines[:4] {
+		want += line + "\n"
+	}
+	if string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	<-output.done
+	if output.exitCode != 1 {
+		t.Errorf("got exit code %d", output.exitCode)
+	}
+
+	// Devices that aren't proxied don't pass on their output.
+	device.proxied = false
+	if _, err := followProgramOutput(ctx, device); err != errNoProgramOutput {
+		t.Errorf("got %v for a device that isn't proxied", err)
+	}
+	wait := &waitOptions{wait: true}
+	if _, err := wait.open(ctx, device); err == nil || !strings.Contains(err.Error(), "'--port'") {
+		t.Errorf("got %v when waiting for a device that isn't proxied", err)
+	}
+}
+
+func TestArgumentsHeader(t *testing.T) {
+	arguments := []string{"500", "with space", "ünïcödé", ""}
+	encoded, err := encodeArguments(arguments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Arguments from '-D jag.arguments=[...]' are decoded JSON.
+	fromDefine, err := encodeArguments([]interface{}{"500", "with space", "ünïcödé", ""})
+	if err != nil || fromDefine != encoded {
+		t.Errorf("got %q, %v for decoded JSON", fromDefine, err)
+	}
+	if _, err := encodeArguments([]interface{}{1}); err == nil {
+		t.Error("encoded a list with a number")
+	}
+
+	// Proxies pass the arguments on as a define.
+	r := httptest.NewRequest("PUT", "/run", nil)
+	r.Header.Set(JaguarArgumentsHeader, encoded)
+	defines := extractDefines(r)
+	if got := defines[defineJagArguments]; !reflect.DeepEqual(got, arguments) {
+		t.Errorf("got %q, want %q", got, arguments)
+	}
+}
+
+func TestWaitForProgram(t *testing.T) {
+	const program = "a3a1b5c2-9b43-4e5c-8d2f-0a5b6f0e7d11"
+	follow := func(lines ...string) (*programOutput, *io.PipeWriter) {
+		reader, writer := io.Pipe()
+		go func() {
+			for _, line := range lines {
+				fmt.Fprintf(writer, "%s\r\n", line)
+			}
+		}()
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-ctx.Done()
+			writer.Close()
+		}()
+		return newProgramOutput(reader, false, cancel), writer
+	}
+	ctx := context.Background()
+
+	output, _ := follow("[jaguar] INFO: program "+program+" started", "[jaguar] INFO: program "+program+" stopped")
+	if err := waitForProgram(ctx, output, io.Discard, 0); err != nil {
+		t.Errorf("got %v for a program that succeeded", err)
+	}
+
+	output, _ = follow("[jaguar] INFO: program "+program+" started", "[jaguar] ERROR: program "+program+" stopped - exit code 3")
+	err := waitForProgram(ctx, output, io.Discard, 0)
+	if exitErr, ok := err.(*ExitCodeError); !ok || exitErr.Code != 3 {
+		t.Errorf("got %v for a program that failed", err)
+	}
+
+	output, _ = follow("[jaguar] INFO: program " + program + " started")
+	err = waitForProgram(ctx, output, io.Discard, 50*time.Millisecond)
+	if exitErr, ok := err.(*ExitCodeError); !ok || exitErr.Code != timeoutExitCode {
+		t.Errorf("got %v for a program that didn't stop", err)
+	}
+
+	output, writer := follow()
+	writer.Close()
+	if err := waitForProgram(ctx, output, io.Discard, 0); err == nil {
+		t.Error("waiting succeeded without output")
+	}
+}
+
+// fakeImageSDK returns an SDK with a 'toit' executable that builds images
+// by concatenating the snapshot and the assets, and that prints the images
+// it runs with the launcher.
+func fakeImageSDK(t *testing.T) *SDK {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake SDK is a shell script")
+	}
+	sdk := &SDK{Path: t.TempDir(), Version: "v2.0.0"}
+	script := `#!/bin/sh
+case "$1 $2" in
+  "compile --snapshot")
+    echo "snapshot" > "$4"
+    ;;
+  "tool assets")
+    # tool assets -e <input> create | tool assets -e <input> add -o <output> --format=tison <name> <file>
+    if [ "$5" = "create" ]; then
+      : > "$4"
+    else
+      { cat "$4"; echo "$9: $(cat "${10}")"; } > "$7.tmp" && mv "$7.tmp" "$7"
+    fi
+    ;;
+  "tool snapshot-to-image")
+    # tool snapshot-to-image --format=binary -m<bits> --output <image> <snapshot> [--assets <assets>]
+    { cat "$7"; if [ -n "$9" ]; then cat "$9"; fi; } > "$6"
+    ;;
+  "run --")
+    if [ -z "$4" ]; then
+      echo "plain $3"
+      exit 0
+    fi
+    grep -q "containers.start" "$3" || exit 9
+    cat "$4"
+    shift 4
+    echo "arguments: $*"
+    ;;
+  *)
+    exit 2
+    ;;
+esac
+`
+	if err := os.MkdirAll(filepath.Dir(sdk.ToitPath()), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(sdk.ToitPath(), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return sdk
+}
+
+func TestHostRunGetsDefinesAndAssets(t *testing.T) {
+	sdk := fakeImageSDK(t)
+	dir := t.TempDir()
+	entrypoint := filepath.Join(dir, "defines.toit")
+	assets := filepath.Join(dir, "program.assets")
+	if err := os.WriteFile(entrypoint, []byte("main:\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(assets, []byte("user-assets\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	run := func(program *hostProgram) string {
+		t.Helper()
+		var out bytes.Buffer
+		runCmd, cleanup, err := program.command(ctx, sdk, &out, &out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cleanup()
+		runCmd.Stdout = &out
+		runCmd.Stderr = &out
+		if err := runCmd.Run(); err != nil {
+			t.Fatalf("%v: %s", err, out.String())
+		}
+		return out.String()
+	}
+
+	// The defines are added to the given assets, and the program runs in
+	// an image with them.
+	got := run(&hostProgram{
+		args:              []string{entrypoint, "a", "b"},
+		optimizationLevel: -1,
+		defines:           map[string]interface{}{"my-define": 499, "jag.timeout": "10s"},
+		assetsPath:        assets,
+	})
+	want := "Warning: '-D jag.timeout' has no effect when running on host\n" +
+		"snapshot\nuser-assets\njag.defines: {\"my-define\":499}\narguments: a b\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Assets without defines are passed on as they are.
+	got = run(&hostProgram{args: []string{entrypoint}, optimizationLevel: -1, assetsPath: assets})
+	if got != "snapshot\nuser-assets\narguments: \n" {
+		t.Errorf("got %q for assets without defines", got)
+	}
+
+	// Programs without defines and assets run directly.
+	got = run(&hostProgram{args: []string{entrypoint}, optimizationLevel: -1})
+	if got != "plain "+entrypoint+"\n" {
+		t.Errorf("got %q for a program without assets", got)
+	}
+}
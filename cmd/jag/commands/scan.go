@@ -69,11 +69,15 @@ func ScanCmd() *cobra.Command {
 			if outputter != nil {
 				var devices []Device
 				var err error
-				scanCtx, cancel := context.WithTimeout(ctx, timeout)
-				devices, err = ScanNetwork(scanCtx, autoSelect, port)
-				cancel()
-				if err != nil {
-					return err
+				if injected, ok := getDevices(ctx); ok {
+					devices = injected
+				} else {
+					scanCtx, cancel := context.WithTimeout(ctx, timeout)
+					devices, err = ScanNetwork(scanCtx, autoSelect, port)
+					cancel()
+					if err != nil {
+						return err
+					}
 				}
 				if devices == nil {
 					devices = []Device{}
@@ -0,0 +1,343 @@
+// Copyright (C) 2026 Toit contributors.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"go.bug.st/serial"
+)
+
+func SerialServerCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "serial-server",
+		Short: "Expose local serial ports on the network",
+		Long: "Expose local serial ports on the network using the RFC 2217 protocol.\n" +
+			"Each port is served on its own TCP port, starting at --listen-port. Other\n" +
+			"machines can then use the ports with, for example,\n" +
+			"'jag monitor -p rfc2217://host:2217' or 'jag flash -p rfc2217://host:2217'.\n" +
+			"Only one client can use a port at a time. The serial port is only opened\n" +
+			"while a client is connected.\n" +
+			"\n" +
+			"The server has no authentication and gives full access to the devices,\n" +
+			"including resetting and flashing them. By default, it only listens on the\n" +
+			"loopback interface. Use --bind to make the ports reachable from other machines.",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := context.WithCancel(cmd.Context())
+			defer cancel()
+
+			ports, err := cmd.Flags().GetStringArray("port")
+			if err != nil {
+				return err
+			}
+			all, err := cmd.Flags().GetBool("all")
+			if err != nil {
+				return err
+			}
+			if all {
+				if cmd.Flags().Changed("port") {
+					return fmt.Errorf("--all and --port can't be used together")
+				}
+				available, err := getPorts(false)
+				if err != nil {
+					return err
+				}
+				ports = nil
+				for _, p := range available.Ports {
+					ports = append(ports, string(p))
+				}
+			} else if !cmd.Flags().Changed("port") {
+				port, err := checkPort(ConfiguredPort(), false)
+				if err != nil {
+					return err
+				}
+				ports = []string{port}
+			}
+			if len(ports) == 0 {
+				return fmt.Errorf("no serial ports detected")
+			}
+
+			bind, err := cmd.Flags().GetString("bind")
+			if err != nil {
+				return err
+			}
+			listenPort, err := cmd.Flags().GetUint("listen-port")
+			if err != nil {
+				return err
+			}
+			baud, err := cmd.Flags().GetUint("baud")
+			if err != nil {
+				return err
+			}
+
+			errc := make(chan error, len(ports))
+			for i, port := range ports {
+				if isRemotePort(port) {
+					return fmt.Errorf("can't serve the remote port '%s'", port)
+				}
+				address := net.JoinHostPort(bind, strconv.Itoa(int(listenPort)+i))
+				listener, err := net.Listen("tcp", address)
+				if err != nil {
+					return err
+				}
+				defer listener.Close()
+				fmt.Printf("Serving '%s' on rfc2217://%s\n", port, listener.Addr())
+				go func(port string) {
+					errc <- serveSerialPort(ctx, listener, port, int(baud))
+				}(port)
+			}
+			return <-errc
+		},
+	}
+
+	cmd.Flags().StringArrayP("port", "p", []string{ConfiguredPort()}, "serial port to serve; can be repeated")
+	cmd.Flags().Bool("all", false, "serve all available serial ports")
+	cmd.Flags().String("bind", "127.0.0.1", "the address to listen on; use '0.0.0.0' to listen on all interfaces")
+	cmd.Flags().Uint("listen-port", 2217, "the TCP port for the first serial port; further serial ports use the following TCP ports")
+	cmd.Flags().Uint("baud", 115200, "the baud rate used until the client sets its own")
+	return cmd
+}
+
+// serveSerialPort accepts clients for the given serial port, one at a time.
+func serveSerialPort(ctx context.Context, listener net.Listener, port string, baud int) error {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	var mu sync.Mutex
+	busy := false
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		mu.Lock()
+		if busy {
+			mu.Unlock()
+			fmt.Printf("Rejected client %s for '%s': port is in use\n", conn.RemoteAddr(), port)
+			conn.Close()
+			continue
+		}
+		busy = true
+		mu.Unlock()
+
+		go func() {
+			defer func() {
+				mu.Lock()
+				busy = false
+				mu.Unlock()
+			}()
+			defer conn.Close()
+			fmt.Printf("Client %s connected to '%s'\n", conn.RemoteAddr(), port)
+			dev, err := serialOpen(port, baud)
+			if err != nil {
+				fmt.Printf("Failed to open '%s' for %s: %v\n", port, conn.RemoteAddr(), err)
+				return
+			}
+			defer dev.Close()
+			newRfc2217Server(conn, dev.Port, &serial.Mode{BaudRate: baud}).serve()
+			fmt.Printf("Client %s disconnected from '%s'\n", conn.RemoteAddr(), port)
+		}()
+	}
+}
+
+// rfc2217Server serves a serial port to a single RFC 2217 client.
+type rfc2217Server struct {
+	conn    net.Conn
+	port    serial.Port
+	mode    serial.Mode
+	writeMu sync.Mutex
+	decoder telnetDecoder
+}
+
+func newRfc2217Server(conn net.Conn, port serial.Port, mode *serial.Mode) *rfc2217Server {
+	result := &rfc2217Server{
+		conn: conn,
+		port: port,
+		mode: *mode,
+	}
+	if result.mode.DataBits == 0 {
+		result.mode.DataBits = 8
+	}
+	result.decoder.onCommand = result.handleCommand
+	result.decoder.onSubnegotiation = result.handleSubnegotiation
+	return result
+}
+
+func (s *rfc2217Server) writeRaw(data []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_, err := s.conn.Write(data)
+	return err
+}
+
+// serve forwards data in both directions until the client disconnects or
+// the serial port fails.
+func (s *rfc2217Server) serve() {
+	err := s.writeRaw([]byte{
+		telnetIAC, telnetDO, telnetOptionCOM,
+		telnetIAC, telnetWILL, telnetOptionBinary,
+		telnetIAC, telnetDO, telnetOptionBinary,
+		telnetIAC, telnetWILL, telnetOptionSGA,
+	})
+	if err != nil {
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 1024)
+		for {
+			n, err := s.port.Read(buf)
+			if n > 0 {
+				if err := s.writeRaw(telnetEscape(buf[:n])); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				// Make the other direction stop as well.
+				s.conn.Close()
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, 1024)
+	for {
+		n, err := s.conn.Read(buf)
+		if n > 0 {
+			data := s.decoder.decode(buf[:n])
+			if len(data) > 0 {
+				if _, err := s.port.Write(data); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	// Unblock the reading goroutine.
+	s.port.Close()
+	<-done
+}
+
+func (s *rfc2217Server) handleCommand(verb byte, option byte) {
+	switch option {
+	case telnetOptionCOM, telnetOptionBinary, telnetOptionSGA:
+		return
+	}
+	switch verb {
+	case telnetWILL:
+		s.writeRaw([]byte{telnetIAC, telnetDONT, option})
+	case telnetDO:
+		s.writeRaw([]byte{telnetIAC, telnetWONT, option})
+	}
+}
+
+func (s *rfc2217Server) reply(command byte, value []byte) {
+	s.writeRaw(rfc2217Command(command+rfc2217ServerOffset, value))
+}
+
+func (s *rfc2217Server) handleSubnegotiation(option byte, data []byte) {
+	if option != telnetOptionCOM || len(data) < 1 {
+		return
+	}
+	command := data[0]
+	value := data[1:]
+	switch command {
+	case rfc2217SetBaudrate:
+		if len(value) != 4 {
+			return
+		}
+		if baud := binary.BigEndian.Uint32(value); baud != 0 {
+			s.mode.BaudRate = int(baud)
+			s.setMode()
+		}
+		reply := make([]byte, 4)
+		binary.BigEndian.PutUint32(reply, uint32(s.mode.BaudRate))
+		s.reply(command, reply)
+	case rfc2217SetDatasize:
+		if len(value) != 1 {
+			return
+		}
+		if value[0] != 0 {
+			s.mode.DataBits = int(value[0])
+			s.setMode()
+		}
+		s.reply(command, []byte{byte(s.mode.DataBits)})
+	case rfc2217SetParity:
+		if len(value) != 1 {
+			return
+		}
+		for parity, v := range rfc2217Parity {
+			if v == value[0] {
+				s.mode.Parity = parity
+				s.setMode()
+			}
+		}
+		s.reply(command, []byte{rfc2217Parity[s.mode.Parity]})
+	case rfc2217SetStopsize:
+		if len(value) != 1 {
+			return
+		}
+		for stopBits, v := range rfc2217StopBits {
+			if v == value[0] {
+				s.mode.StopBits = stopBits
+				s.setMode()
+			}
+		}
+		s.reply(command, []byte{rfc2217StopBits[s.mode.StopBits]})
+	case rfc2217SetControl:
+		if len(value) != 1 {
+			return
+		}
+		switch value[0] {
+		case rfc2217DTROn, rfc2217DTROff:
+			s.port.SetDTR(value[0] == rfc2217DTROn)
+		case rfc2217RTSOn, rfc2217RTSOff:
+			s.port.SetRTS(value[0] == rfc2217RTSOn)
+		case rfc2217BreakOn:
+			go s.port.Break(250 * time.Millisecond)
+		}
+		s.reply(command, value)
+	case rfc2217PurgeData:
+		if len(value) != 1 {
+			return
+		}
+		if value[0] == rfc2217PurgeReceive || value[0] == rfc2217PurgeBoth {
+			s.port.ResetInputBuffer()
+		}
+		if value[0] == rfc2217PurgeTransmit || value[0] == rfc2217PurgeBoth {
+			s.port.ResetOutputBuffer()
+		}
+		s.reply(command, value)
+	case rfc2217SetLinestateMask, rfc2217SetModemstateMask:
+		s.reply(command, value)
+	case rfc2217NotifyLinestate, rfc2217NotifyModemstate, rfc2217FlowSuspend, rfc2217FlowResume:
+		// Notifications are sent by the server, and flow control isn't
+		// supported.
+	}
+}
+
+func (s *rfc2217Server) setMode() {
+	if err := s.port.SetMode(&s.mode); err != nil {
+		fmt.Printf("Failed to change the serial settings: %v\n", err)
+	}
+}
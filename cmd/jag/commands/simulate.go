@@ -6,9 +6,15 @@ package commands
 
 import (
 	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
 	"io"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
+	"syscall"
 
 	"github.com/google/uuid"
 	"github.com/spf13/cobra"
@@ -20,10 +26,21 @@ func SimulateCmd() *cobra.Command {
 		Use:   "simulate",
 		Short: "Start a simulated Jaguar device on your machine",
 		Long: "Start a simulated Jaguar device on your host machine. Useful for testing\n" +
-			"and for experimenting with the Jaguar-based workflows.",
+			"and for experimenting with the Jaguar-based workflows.\n\n" +
+			"With --count, several simulated devices are started, each with its own id,\n" +
+			"name and port. Their output is prefixed with their names.\n\n" +
+			"With --state-dir, the simulator keeps its id, name and installed containers\n" +
+			"in the given directory, so that restarting it is like rebooting a device.\n\n" +
+			"With --uart (Linux only), the simulator also serves its UART endpoint on a\n" +
+			"pseudo-terminal, which can be proxied like a serial port:\n\n" +
+			"  jag monitor --proxy --attach -p /dev/pts/N\n\n" +
+			"With --latency, --bandwidth, --drop-rate or --fail-every, the HTTP port of the\n" +
+			"simulator is served by a proxy that degrades the connection, so that slow or\n" +
+			"unreliable devices can be reproduced.",
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			ctx := cmd.Context()
+			ctx, cancel := context.WithCancel(cmd.Context())
+			defer cancel()
 
 			info := GetInfo(ctx)
 			jagVersion := info.Version
@@ -33,15 +50,20 @@ func SimulateCmd() *cobra.Command {
 				return err
 			}
 
-			id := uuid.New()
-			var name string
+			count, err := cmd.Flags().GetUint("count")
+			if err != nil {
+				return err
+			}
+			if count == 0 {
+				return fmt.Errorf("the count must be at least 1")
+			}
+
+			name := ""
 			if cmd.Flags().Changed("name") {
 				name, err = cmd.Flags().GetString("name")
 				if err != nil {
 					return err
 				}
-			} else {
-				name = GetRandomName(id[:])
 			}
 
 			sdk, err := GetSDK(ctx)
@@ -64,29 +86,358 @@ func SimulateCmd() *cobra.Command {
 				return err
 			}
 
-			outReader, outWriter := io.Pipe()
+			colorMode, err := cmd.Flags().GetString("color")
+			if err != nil {
+				return err
+			}
+			color, err := useColor(colorMode)
+			if err != nil {
+				return err
+			}
+
+			stateDir, err := cmd.Flags().GetString("state-dir")
+			if err != nil {
+				return err
+			}
 
-			// Goroutine that gets data from the pipe and converts it into
-			// lines.
-			go func() {
-				scanner := bufio.NewScanner(outReader)
+			simulators, err := newSimulators(int(count), int(port), name, stateDir)
+			if err != nil {
+				return err
+			}
+
+			withUart, err := cmd.Flags().GetBool("uart")
+			if err != nil {
+				return err
+			}
+			faults, err := parseNetworkFaults(cmd)
+			if err != nil {
+				return err
+			}
+			for _, sim := range simulators {
+				sim.uart = withUart
+				sim.faults = faults
+			}
 
-				decoder := NewDecoder(scanner, cmd.Context(), "")
+			if len(simulators) == 1 {
+				return simulators[0].run(ctx, sdk, snapshot, os.Stdout, os.Stderr, pretty, plain)
+			}
 
-				decoder.decode(pretty, plain)
+			signalChan := make(chan os.Signal, 1)
+			signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
+			defer signal.Stop(signalChan)
+			interrupted := make(chan struct{})
+			go func() {
+				select {
+				case <-signalChan:
+					fmt.Fprintf(os.Stderr, "\nInterrupt received, stopping the simulators...\n")
+					close(interrupted)
+					cancel()
+				case <-ctx.Done():
+				}
 			}()
 
-			simCmd := sdk.ToitRunSnapshot(ctx, snapshot, strconv.Itoa(int(port)), id.String(), name)
-			simCmd.Stderr = os.Stderr
-			simCmd.Stdout = outWriter
-			return simCmd.Run()
+			// Lines of the different simulators must not be mixed.
+			sharedOut := &lockedWriter{w: os.Stdout}
+			sharedErr := &lockedWriter{w: os.Stderr}
+			errc := make(chan error, len(simulators))
+			for i, sim := range simulators {
+				prefix := labelPrefix(sim.name, i, color)
+				out := newPrefixWriter(sharedOut, prefix)
+				errOut := newPrefixWriter(sharedErr, prefix)
+				go func(sim *simulator) {
+					errc <- sim.run(ctx, sdk, snapshot, out, errOut, pretty, plain)
+				}(sim)
+			}
+			// All simulators are stopped as soon as one of them is done.
+			err = <-errc
+			cancel()
+			for i := 1; i < len(simulators); i++ {
+				<-errc
+			}
+			select {
+			case <-interrupted:
+				// The simulators were killed on request.
+				return nil
+			default:
+				return err
+			}
 		},
 	}
 
-	cmd.Flags().UintP("port", "p", 0, "port to run the simulator on")
-	cmd.Flags().String("name", "", "name for the simulator, if not set a name will be auto generated")
+	cmd.Flags().UintP("port", "p", 0, "port to run the simulator on; with --count, the simulators use consecutive ports")
+	cmd.Flags().String("name", "", "name for the simulator, if not set a name will be auto generated; with --count, the names are numbered")
+	cmd.Flags().Uint("count", 1, "the number of simulated devices to start")
+	cmd.Flags().Bool("uart", false, "serve the UART endpoint of the simulator on a pseudo-terminal (Linux only)")
+	cmd.Flags().String("state-dir", "", "directory that keeps the state of the simulator across restarts; with --count, every simulator uses a numbered subdirectory")
+	cmd.Flags().Duration("latency", 0, "delay every request to the simulator by the given duration")
+	cmd.Flags().Uint("bandwidth", 0, "limit the transfers to and from the simulator to the given bytes per second")
+	cmd.Flags().Float64("drop-rate", 0, "probability between 0 and 1 that a request to the simulator loses its connection")
+	cmd.Flags().Uint("fail-every", 0, "fail every n-th request to the simulator with a server error")
+	cmd.Flags().Int64("fault-seed", 1, "seed for the requests that are dropped, to reproduce a run")
 	cmd.Flags().BoolP("force-pretty", "r", false, "force output to use terminal graphics")
 	cmd.Flags().BoolP("force-plain", "l", false, "force output to use plain ASCII text")
+	cmd.Flags().String("color", "auto", "highlight the names of the simulators (auto, always, or never)")
 
 	return cmd
 }
+
+// simulator is a simulated device.
+type simulator struct {
+	id   uuid.UUID
+	name string
+	// port is the port of the device's HTTP server, or 0 for any free port.
+	port int
+	// stateDir is the directory that keeps the state of the simulator, or
+	// "" if the state is lost when the simulator stops.
+	stateDir string
+	// uart is whether the simulator serves its UART endpoint on a
+	// pseudo-terminal.
+	uart bool
+	// faults degrade the connection to the HTTP port of the simulator, or
+	// are nil for a direct connection.
+	faults *networkFaults
+}
+
+// parseNetworkFaults returns the faults that are configured by the flags
+// of the command, or nil if there are none.
+func parseNetworkFaults(cmd *cobra.Command) (*networkFaults, error) {
+	latency, err := cmd.Flags().GetDuration("latency")
+	if err != nil {
+		return nil, err
+	}
+	bandwidth, err := cmd.Flags().GetUint("bandwidth")
+	if err != nil {
+		return nil, err
+	}
+	dropRate, err := cmd.Flags().GetFloat64("drop-rate")
+	if err != nil {
+		return nil, err
+	}
+	if dropRate < 0 || dropRate > 1 {
+		return nil, fmt.Errorf("the drop rate must be between 0 and 1")
+	}
+	failEvery, err := cmd.Flags().GetUint("fail-every")
+	if err != nil {
+		return nil, err
+	}
+	seed, err := cmd.Flags().GetInt64("fault-seed")
+	if err != nil {
+		return nil, err
+	}
+	if latency == 0 && bandwidth == 0 && dropRate == 0 && failEvery == 0 {
+		return nil, nil
+	}
+	return &networkFaults{
+		latency:   latency,
+		bandwidth: int(bandwidth),
+		dropRate:  dropRate,
+		failEvery: int(failEvery),
+		seed:      seed,
+	}, nil
+}
+
+// newSimulators returns count simulators with distinct ids, names and
+// ports. If name is empty, the names are generated from the ids. If port
+// is 0, every simulator picks a free port.
+// If stateDir is given, simulators that ran before keep their id, and
+// their name unless a name is given.
+func newSimulators(count int, port int, name string, stateDir string) ([]*simulator, error) {
+	result := []*simulator{}
+	used := map[string]bool{}
+	for i := 0; i < count; i++ {
+		sim := &simulator{id: uuid.New()}
+		if stateDir != "" {
+			sim.stateDir = stateDir
+			if count > 1 {
+				sim.stateDir = filepath.Join(stateDir, strconv.Itoa(i+1))
+			}
+		}
+		state, err := sim.loadState()
+		if err != nil {
+			return nil, err
+		}
+		if state != nil {
+			sim.id = state.Id
+		}
+		switch {
+		case name == "" && state != nil:
+			sim.name = state.Name
+		case name == "":
+			sim.name = GetRandomName(sim.id[:])
+			if used[sim.name] {
+				// Generated names aren't unique.
+				sim.name += "-" + strconv.Itoa(i+1)
+			}
+		case count == 1:
+			sim.name = name
+		default:
+			sim.name = name + "-" + strconv.Itoa(i+1)
+		}
+		used[sim.name] = true
+		if port != 0 {
+			sim.port = port + i
+		}
+		if err := sim.saveState(); err != nil {
+			return nil, err
+		}
+		result = append(result, sim)
+	}
+	return result, nil
+}
+
+// simulatorState is the identity of a simulator that is kept in its state
+// directory. The simulator itself keeps its containers there.
+type simulatorState struct {
+	Id   uuid.UUID `json:"id"`
+	Name string    `json:"name"`
+}
+
+func (s *simulator) statePath() string {
+	return filepath.Join(s.stateDir, "simulator.json")
+}
+
+// loadState returns the saved state of the simulator, or nil if there is
+// none.
+func (s *simulator) loadState() (*simulatorState, error) {
+	if s.stateDir == "" {
+		return nil, nil
+	}
+	content, err := os.ReadFile(s.statePath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state simulatorState
+	if err := json.Unmarshal(content, &state); err != nil {
+		return nil, fmt.Errorf("invalid simulator state in '%s': %w", s.statePath(), err)
+	}
+	return &state, nil
+}
+
+func (s *simulator) saveState() error {
+	if s.stateDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(s.stateDir, 0755); err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(simulatorState{Id: s.id, Name: s.name}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.statePath(), append(content, '\n'), 0644)
+}
+
+// run runs the simulator until it exits or the context is done.
+// The decoded output of the simulator is written to out.
+func (s *simulator) run(ctx context.Context, sdk *SDK, snapshot string, out io.Writer, errOut io.Writer, pretty bool, plain bool) error {
+	outReader, outWriter := io.Pipe()
+	defer outWriter.Close()
+
+	var logReader io.Reader = outReader
+	var simStdin io.Reader
+	var simStdout io.Writer = outWriter
+	if s.uart {
+		master, slave, path, err := openPty()
+		if err != nil {
+			return err
+		}
+		defer master.Close()
+		// Keep the slave side open, so that the pseudo-terminal stays
+		// usable while no proxy is connected.
+		defer slave.Close()
+		fmt.Fprintf(out, "Serving the UART endpoint of '%s' on '%s'\n", s.name, path)
+
+		// The simulator reads the requests of the proxy from its stdin, and
+		// prints its packets between its other output.
+		simStdin = master
+		simStdout = io.MultiWriter(outWriter, newDroppingWriter(ctx, master))
+		// Only show the output of the simulator here, not its packets.
+		logs, packets := multiplexReader(outReader)
+		go io.Copy(io.Discard, packets)
+		logReader = logs
+	}
+
+	// Goroutine that gets data from the pipe and converts it into
+	// lines.
+	go func() {
+		scanner := bufio.NewScanner(logReader)
+
+		decoder := NewDecoder(scanner, ctx, "")
+		decoder.SetOutput(out)
+
+		decoder.decode(pretty, plain)
+	}()
+
+	port := s.port
+	advertisedPort := 0
+	if s.faults != nil {
+		// The simulator listens on a private port, and announces the port
+		// of the proxy in front of it.
+		var err error
+		port, err = freePort()
+		if err != nil {
+			return err
+		}
+		advertisedPort, err = serveFaultProxy(ctx, s.port, port, s.faults)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Degrading the connection to '%s' on port %d (%s)\n", s.name, advertisedPort, s.faults)
+	}
+
+	arguments := []string{snapshot, strconv.Itoa(port), s.id.String(), s.name}
+	if s.stateDir != "" {
+		// The simulator keeps its containers in the state directory.
+		stateDir, err := filepath.Abs(s.stateDir)
+		if err != nil {
+			return err
+		}
+		arguments = append(arguments, "--state-dir="+stateDir)
+	}
+	if s.uart {
+		arguments = append(arguments, "--uart")
+	}
+	if advertisedPort != 0 {
+		arguments = append(arguments, "--advertised-port="+strconv.Itoa(advertisedPort))
+	}
+	simCmd := sdk.ToitRunSnapshot(ctx, arguments...)
+	simCmd.Stderr = errOut
+	simCmd.Stdin = simStdin
+	simCmd.Stdout = simStdout
+	return simCmd.Run()
+}
+
+// droppingWriter writes to the underlying writer in the background.
+// Data is dropped instead of blocking the caller while the underlying
+// writer doesn't keep up, like a serial port that nobody listens to.
+type droppingWriter struct {
+	ch chan []byte
+}
+
+func newDroppingWriter(ctx context.Context, w io.Writer) *droppingWriter {
+	result := &droppingWriter{ch: make(chan []byte, 256)}
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case data := <-result.ch:
+				if _, err := w.Write(data); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	return result
+}
+
+func (d *droppingWriter) Write(p []byte) (int, error) {
+	select {
+	case d.ch <- append([]byte{}, p...):
+	default:
+	}
+	return len(p), nil
+}
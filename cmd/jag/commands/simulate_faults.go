@@ -0,0 +1,198 @@
+// Copyright (C) 2026 Toit contributors.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// networkFaults describes how the connection to a simulated device is
+// degraded, so that the behavior of jag with slow or unreliable devices
+// can be tested.
+type networkFaults struct {
+	// latency is added to every request before it reaches the device.
+	latency time.Duration
+	// bandwidth limits the bytes per second of the request and response
+	// bodies, or is 0 for no limit.
+	bandwidth int
+	// dropRate is the probability that the connection of a request is
+	// closed without a response.
+	dropRate float64
+	// failEvery makes every n-th request fail with a server error, or is
+	// 0 for no failures.
+	failEvery int
+	// seed makes the dropped requests reproducible.
+	seed int64
+}
+
+func (f *networkFaults) String() string {
+	return fmt.Sprintf("latency %v, bandwidth %d B/s, drop rate %g, fail every %d", f.latency, f.bandwidth, f.dropRate, f.failEvery)
+}
+
+// faultProxy forwards HTTP requests to a device and injects the
+// configured faults.
+type faultProxy struct {
+	faults *networkFaults
+	proxy  *httputil.ReverseProxy
+
+	mu       sync.Mutex
+	random   *rand.Rand
+	requests int
+}
+
+func newFaultProxy(target *url.URL, faults *networkFaults) *faultProxy {
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	// Pass the progress of long responses on right away.
+	proxy.FlushInterval = -1
+	return &faultProxy{
+		faults: faults,
+		proxy:  proxy,
+		random: rand.New(rand.NewSource(faults.seed)),
+	}
+}
+
+// next decides the fate of the next request.
+func (p *faultProxy) next() (fail bool, drop bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.requests++
+	fail = p.faults.failEvery > 0 && p.requests%p.faults.failEvery == 0
+	drop = p.faults.dropRate > 0 && p.random.Float64() < p.faults.dropRate
+	return fail, drop
+}
+
+func (p *faultProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fail, drop := p.next()
+	if p.faults.latency > 0 {
+		select {
+		case <-time.After(p.faults.latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if fail {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("injected failure\n"))
+		return
+	}
+	if drop {
+		// Lose the connection, as if the device went out of range.
+		if hijacker, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hijacker.Hijack(); err == nil {
+				conn.Close()
+				return
+			}
+		}
+		panic(http.ErrAbortHandler)
+	}
+	if p.faults.bandwidth > 0 {
+		r.Body = &throttledReadCloser{r: r.Body, c: r.Body, bandwidth: p.faults.bandwidth}
+		w = &throttledResponseWriter{ResponseWriter: w, bandwidth: p.faults.bandwidth}
+	}
+	p.proxy.ServeHTTP(w, r)
+}
+
+// throttleChunk is the largest number of bytes that are passed on at
+// once, so that throttled transfers are smooth.
+func throttleChunk(bandwidth int) int {
+	chunk := bandwidth / 10
+	if chunk < 1 {
+		return 1
+	}
+	return chunk
+}
+
+// throttleWait waits as long as the transfer of n bytes takes.
+func throttleWait(n int, bandwidth int) {
+	time.Sleep(time.Duration(n) * time.Second / time.Duration(bandwidth))
+}
+
+type throttledReadCloser struct {
+	r         io.Reader
+	c         io.Closer
+	bandwidth int
+}
+
+func (t *throttledReadCloser) Read(p []byte) (int, error) {
+	if chunk := throttleChunk(t.bandwidth); len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := t.r.Read(p)
+	throttleWait(n, t.bandwidth)
+	return n, err
+}
+
+func (t *throttledReadCloser) Close() error {
+	return t.c.Close()
+}
+
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	bandwidth int
+}
+
+func (t *throttledResponseWriter) Write(p []byte) (int, error) {
+	written := 0
+	chunk := throttleChunk(t.bandwidth)
+	for written < len(p) {
+		end := written + chunk
+		if end > len(p) {
+			end = len(p)
+		}
+		// The bytes arrive once they have been transferred.
+		throttleWait(end-written, t.bandwidth)
+		n, err := t.ResponseWriter.Write(p[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		t.Flush()
+	}
+	return written, nil
+}
+
+func (t *throttledResponseWriter) Flush() {
+	if flusher, ok := t.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// serveFaultProxy listens on the given port, or a free port if it is 0,
+// and forwards the requests to the device on the target port until the
+// context is done. It returns the port it listens on.
+func serveFaultProxy(ctx context.Context, port int, targetPort int, faults *networkFaults) (int, error) {
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		return 0, err
+	}
+	target := &url.URL{Scheme: "http", Host: net.JoinHostPort("127.0.0.1", strconv.Itoa(targetPort))}
+	server := &http.Server{Handler: newFaultProxy(target, faults)}
+	go server.Serve(listener)
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// freePort returns a TCP port that is currently not in use.
+func freePort() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
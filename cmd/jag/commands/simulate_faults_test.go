@@ -0,0 +1,102 @@
+// Copyright (C) 2026 Toit contributors.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFaultProxy(t *testing.T) {
+	device := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(append([]byte("echo "), body...))
+	}))
+	defer device.Close()
+	target, err := url.Parse(device.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(faults *networkFaults) *httptest.Server {
+		return httptest.NewServer(newFaultProxy(target, faults))
+	}
+	post := func(server *httptest.Server) (int, string, error) {
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		res, err := client.Post(server.URL, "text/plain", strings.NewReader("hello"))
+		if err != nil {
+			return 0, "", err
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		return res.StatusCode, string(body), err
+	}
+
+	t.Run("fail-every", func(t *testing.T) {
+		server := serve(&networkFaults{failEvery: 3})
+		defer server.Close()
+		for i := 1; i <= 6; i++ {
+			status, body, err := post(server)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i%3 == 0 && status != http.StatusServiceUnavailable {
+				t.Errorf("request %d: got %d, want a failure", i, status)
+			}
+			if i%3 != 0 && (status != http.StatusOK || body != "echo hello") {
+				t.Errorf("request %d: got %d: %q", i, status, body)
+			}
+		}
+	})
+
+	t.Run("drop-rate", func(t *testing.T) {
+		dropped := func(seed int64) []bool {
+			server := serve(&networkFaults{dropRate: 0.5, seed: seed})
+			defer server.Close()
+			result := []bool{}
+			for i := 0; i < 20; i++ {
+				_, _, err := post(server)
+				result = append(result, err != nil)
+			}
+			return result
+		}
+		first := dropped(7)
+		second := dropped(7)
+		count := 0
+		for i := range first {
+			if first[i] != second[i] {
+				t.Fatalf("the same seed dropped different requests: %v and %v", first, second)
+			}
+			if first[i] {
+				count++
+			}
+		}
+		if count == 0 || count == len(first) {
+			t.Errorf("dropped %d of %d requests", count, len(first))
+		}
+	})
+
+	t.Run("latency and bandwidth", func(t *testing.T) {
+		server := serve(&networkFaults{latency: 100 * time.Millisecond, bandwidth: 50})
+		defer server.Close()
+		start := time.Now()
+		status, body, err := post(server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != http.StatusOK || body != "echo hello" {
+			t.Errorf("got %d: %q", status, body)
+		}
+		// The latency, 5 bytes up and 10 bytes down at 50 bytes per second.
+		if elapsed := time.Since(start); elapsed < 350*time.Millisecond {
+			t.Errorf("the request took only %v", elapsed)
+		}
+	})
+}
@@ -0,0 +1,66 @@
+// Copyright (C) 2026 Toit contributors.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import "testing"
+
+func TestNewSimulators(t *testing.T) {
+	simulators, err := newSimulators(3, 9000, "sim", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := map[string]bool{}
+	for i, sim := range simulators {
+		ids[sim.id.String()] = true
+		if want := "sim-" + string(rune('1'+i)); sim.name != want {
+			t.Errorf("got name %s, want %s", sim.name, want)
+		}
+		if sim.port != 9000+i {
+			t.Errorf("got port %d, want %d", sim.port, 9000+i)
+		}
+	}
+	if len(ids) != 3 {
+		t.Errorf("the simulators share ids")
+	}
+
+	single, _ := newSimulators(1, 0, "sim", "")
+	if single[0].name != "sim" || single[0].port != 0 {
+		t.Errorf("got %+v", single[0])
+	}
+	generated, _ := newSimulators(2, 0, "", "")
+	if generated[0].name == "" || generated[0].name == generated[1].name {
+		t.Errorf("got names %s and %s", generated[0].name, generated[1].name)
+	}
+}
+
+func TestSimulatorState(t *testing.T) {
+	dir := t.TempDir()
+	first, err := newSimulators(2, 0, "", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Restarting keeps the ids and names.
+	second, err := newSimulators(2, 0, "", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range first {
+		if first[i].id != second[i].id || first[i].name != second[i].name {
+			t.Errorf("got %+v after %+v", second[i], first[i])
+		}
+	}
+	// An explicit name replaces the saved one, but the id stays.
+	renamed, err := newSimulators(2, 0, "sim", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renamed[0].id != first[0].id || renamed[0].name != "sim-1" {
+		t.Errorf("got %+v", renamed[0])
+	}
+	again, _ := newSimulators(2, 0, "", dir)
+	if again[1].name != "sim-2" {
+		t.Errorf("got %+v", again[1])
+	}
+}
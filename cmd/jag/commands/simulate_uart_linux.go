@@ -0,0 +1,70 @@
+// Copyright (C) 2026 Toit contributors.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+//go:build linux
+
+package commands
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// openPty opens a new pseudo-terminal in raw mode.
+// It returns the master side, the slave side, and the path of the slave
+// side, which other programs open like a serial port.
+func openPty() (master *os.File, slave *os.File, path string, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	unlock := int32(0)
+	if err := ioctl(master, syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); err != nil {
+		master.Close()
+		return nil, nil, "", err
+	}
+	number := uint32(0)
+	if err := ioctl(master, syscall.TIOCGPTN, uintptr(unsafe.Pointer(&number))); err != nil {
+		master.Close()
+		return nil, nil, "", err
+	}
+	path = "/dev/pts/" + strconv.Itoa(int(number))
+	slave, err = os.OpenFile(path, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, "", err
+	}
+
+	// The packets are binary, so the terminal must neither echo nor
+	// translate them.
+	var termios syscall.Termios
+	if err := ioctl(slave, syscall.TCGETS, uintptr(unsafe.Pointer(&termios))); err != nil {
+		master.Close()
+		slave.Close()
+		return nil, nil, "", err
+	}
+	termios.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	termios.Oflag &^= syscall.OPOST
+	termios.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	termios.Cflag &^= syscall.CSIZE | syscall.PARENB
+	termios.Cflag |= syscall.CS8
+	termios.Cc[syscall.VMIN] = 1
+	termios.Cc[syscall.VTIME] = 0
+	if err := ioctl(slave, syscall.TCSETS, uintptr(unsafe.Pointer(&termios))); err != nil {
+		master.Close()
+		slave.Close()
+		return nil, nil, "", err
+	}
+	return master, slave, path, nil
+}
+
+func ioctl(file *os.File, request uintptr, arg uintptr) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), request, arg)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+// Copyright (C) 2026 Toit contributors.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+//go:build linux
+
+package commands
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestOpenPty(t *testing.T) {
+	master, slave, path, err := openPty()
+	if err != nil {
+		t.Skipf("no pseudo-terminals: %v", err)
+	}
+	defer master.Close()
+	defer slave.Close()
+
+	port, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer port.Close()
+
+	// Binary data, including newlines and control characters, passes
+	// unchanged in both directions.
+	packet := []byte{3, 0, 0x82, '\n', 0x03, 0x11, 0x7f, '\r', '\n'}
+	if _, err := master.Write(packet); err != nil {
+		t.Fatal(err)
+	}
+	received := make([]byte, len(packet))
+	if _, err := io.ReadFull(port, received); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, packet) {
+		t.Errorf("got %v, want %v", received, packet)
+	}
+
+	if _, err := port.Write(packet); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(master, received); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, packet) {
+		t.Errorf("got %v, want %v", received, packet)
+	}
+}
@@ -0,0 +1,17 @@
+// Copyright (C) 2026 Toit contributors.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+//go:build !linux
+
+package commands
+
+import (
+	"fmt"
+	"os"
+)
+
+// openPty is only supported on Linux.
+func openPty() (master *os.File, slave *os.File, path string, err error) {
+	return nil, nil, "", fmt.Errorf("simulated UART endpoints are only supported on Linux")
+}
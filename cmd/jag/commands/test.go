@@ -0,0 +1,472 @@
+// Copyright (C) 2026 Toit contributors.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const testFileSuffix = "_test.toit"
+
+func TestCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "test [paths...]",
+		Short: "Run Toit tests on a Jaguar device or on host",
+		Long: "Run the Toit tests in the given files and directories on a Jaguar device,\n" +
+			"or on the current computer with '-d host'.\n" +
+			"Directories are searched for files that end with '" + testFileSuffix + "'. Without\n" +
+			"paths, the current directory is searched.\n" +
+			"\n" +
+			"A test passes if its program exits with code 0 within the timeout. The output\n" +
+			"of failing tests is shown, and with --verbose the output of all tests.\n" +
+			"Tests that don't stop in time are stopped. On devices, this is done by running\n" +
+			"an empty program in their place.\n" +
+			"On devices, the output is read from the proxy of the device, or from the\n" +
+			"serial port given with --port. Devices that are reached directly over the\n" +
+			"network don't send their output, so they need --port.\n" +
+			"\n" +
+			"With --junit and --tap, the results are also written as JUnit XML or in the\n" +
+			"Test Anything Protocol, for CI dashboards. Use '-' for stdout.",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			deviceSelect, err := parseDeviceFlag(cmd)
+			if err != nil {
+				return err
+			}
+
+			paths := args
+			if len(paths) == 0 {
+				paths = []string{"."}
+			}
+			tests, err := discoverTests(paths)
+			if err != nil {
+				return err
+			}
+			if len(tests) == 0 {
+				return fmt.Errorf("no tests found; test files end with '%s'", testFileSuffix)
+			}
+
+			timeout, err := cmd.Flags().GetDuration("timeout")
+			if err != nil {
+				return err
+			}
+
+			port, err := cmd.Flags().GetString("port")
+			if err != nil {
+				return err
+			}
+
+			baud, err := cmd.Flags().GetUint("baud")
+			if err != nil {
+				return err
+			}
+
+			// Tests always wait for their programs.
+			wait := &waitOptions{wait: true, timeout: timeout, port: port, baud: int(baud)}
+
+			verbose, err := cmd.Flags().GetBool("verbose")
+			if err != nil {
+				return err
+			}
+
+			junitPath, err := cmd.Flags().GetString("junit")
+			if err != nil {
+				return err
+			}
+
+			tapPath, err := cmd.Flags().GetString("tap")
+			if err != nil {
+				return err
+			}
+
+			// Reports on stdout must stay parseable, so everything else goes
+			// to stderr then.
+			stdout := cmd.OutOrStdout()
+			console := stdout
+			if junitPath == "-" || tapPath == "-" {
+				if junitPath == tapPath {
+					return fmt.Errorf("--junit and --tap can't both write to stdout")
+				}
+				console = cmd.ErrOrStderr()
+			}
+
+			optimizationLevel := -1
+			if cmd.Flags().Changed("optimization-level") {
+				optimizationLevel, err = cmd.Flags().GetInt("optimization-level")
+				if err != nil {
+					return err
+				}
+			}
+
+			defines, err := parseDefineFlags(cmd, "define")
+			if err != nil {
+				return err
+			}
+
+			sdk, err := GetSDK(ctx)
+			if err != nil {
+				return err
+			}
+
+			var run func(ctx context.Context, test string, out io.Writer) error
+			if name, ok := deviceSelect.(deviceNameSelect); ok && string(name) == "host" {
+				run = func(ctx context.Context, test string, out io.Writer) error {
+					program := &hostProgram{
+						args:              []string{test},
+						optimizationLevel: optimizationLevel,
+						defines:           defines,
+					}
+					return runTestOnHost(ctx, sdk, program, out, wait.timeout)
+				}
+			} else {
+				device, err := GetDevice(ctx, sdk, true, deviceSelect)
+				if err != nil {
+					return err
+				}
+				run = func(ctx context.Context, test string, out io.Writer) error {
+					return runTestOnDevice(ctx, device, sdk, test, defines, optimizationLevel, wait, out)
+				}
+			}
+
+			results := []*testResult{}
+			for _, test := range tests {
+				result := runTest(ctx, test, run)
+				results = append(results, result)
+				fmt.Fprintln(console, result)
+				if verbose || !result.passed() {
+					console.Write(result.output)
+				}
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+			}
+
+			if junitPath != "" {
+				if err := writeTestReport(stdout, junitPath, results, writeJUnit); err != nil {
+					return err
+				}
+			}
+			if tapPath != "" {
+				if err := writeTestReport(stdout, tapPath, results, writeTap); err != nil {
+					return err
+				}
+			}
+
+			failed := 0
+			for _, result := range results {
+				if !result.passed() {
+					failed++
+				}
+			}
+			fmt.Fprintf(console, "%d passed, %d failed\n", len(results)-failed, failed)
+			if failed > 0 {
+				return &ExitCodeError{Code: 1, Reason: fmt.Sprintf("%d of %d tests failed", failed, len(results))}
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringP("device", "d", "", "use device with a given name, id, or address")
+	cmd.Flags().StringArrayP("define", "D", nil, "define settings to control the tests")
+	cmd.Flags().IntP("optimization-level", "O", 1, "optimization level")
+	cmd.Flags().Duration("timeout", time.Minute, "how long every test may run")
+	cmd.Flags().String("port", "", "serial port to read the output of the tests from; required for devices that aren't reached through a proxy")
+	cmd.Flags().Uint("baud", 115200, "the baud rate of the serial port")
+	cmd.Flags().BoolP("verbose", "v", false, "show the output of all tests, not only of failing ones")
+	cmd.Flags().String("junit", "", "write the results as JUnit XML to the given file")
+	cmd.Flags().String("tap", "", "write the results in the Test Anything Protocol to the given file")
+	return cmd
+}
+
+// discoverTests returns the test files in the given paths. Files are
+// taken as they are, and directories are searched for files that end with
+// testFileSuffix. Hidden directories and package directories are skipped.
+func discoverTests(paths []string) ([]string, error) {
+	result := []string{}
+	seen := map[string]bool{}
+	add := func(path string) {
+		if !seen[path] {
+			seen[path] = true
+			result = append(result, path)
+		}
+	}
+	for _, root := range paths {
+		stat, err := os.Stat(root)
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no such file or directory: '%s'", root)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !stat.IsDir() {
+			add(root)
+			continue
+		}
+		found := []string{}
+		err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				name := info.Name()
+				if path != root && (strings.HasPrefix(name, ".") || name == "packages") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if strings.HasSuffix(path, testFileSuffix) {
+				found = append(found, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(found)
+		for _, path := range found {
+			add(path)
+		}
+	}
+	return result, nil
+}
+
+// testResult is the outcome of running a test.
+type testResult struct {
+	name     string
+	duration time.Duration
+	output   []byte
+	// err is nil if the test passed.
+	err error
+}
+
+func (r *testResult) passed() bool {
+	return r.err == nil
+}
+
+func (r *testResult) String() string {
+	if r.passed() {
+		return fmt.Sprintf("PASS %s (%.2fs)", r.name, r.duration.Seconds())
+	}
+	return fmt.Sprintf("FAIL %s (%.2fs): %v", r.name, r.duration.Seconds(), r.err)
+}
+
+// runTest runs a test, and captures its output.
+func runTest(ctx context.Context, test string, run func(ctx context.Context, test string, out io.Writer) error) *testResult {
+	var output bytes.Buffer
+	start := time.Now()
+	err := run(ctx, test, &output)
+	return &testResult{
+		name:     test,
+		duration: time.Since(start),
+		output:   output.Bytes(),
+		err:      err,
+	}
+}
+
+// stopProgramTimeout is how long the empty program that stops a test may
+// take.
+const stopProgramTimeout = 30 * time.Second
+
+// runTestOnDevice runs a test on the device. Tests that don't stop within
+// the timeout are stopped.
+func runTestOnDevice(ctx context.Context, device Device, sdk *SDK, test string, defines map[string]interface{}, optimizationLevel int, wait *waitOptions, out io.Writer) error {
+	output, err := wait.open(ctx, device)
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+	// The output of the compiler and the progress belong to the output of
+	// the test.
+	if err := sendCode(ctx, device, sdk, "/run", test, "", defines, "", optimizationLevel, out, out); err != nil {
+		return err
+	}
+	err = waitForProgram(ctx, output, out, wait.timeout)
+	if exitErr, ok := err.(*ExitCodeError); ok && exitErr.Code == timeoutExitCode && ctx.Err() == nil {
+		if stopErr := stopProgram(ctx, device, sdk, wait); stopErr != nil {
+			fmt.Fprintf(out, "Failed to stop the program: %v\n", stopErr)
+		}
+	}
+	return err
+}
+
+// stopProgram stops the program that runs on the device. Jaguar stops the
+// running program when it gets the next one, so an empty program is run in
+// its place. Waiting for the empty program to stop keeps its output out of
+// the output of the next test.
+func stopProgram(ctx context.Context, device Device, sdk *SDK, wait *waitOptions) error {
+	tempdir, err := os.MkdirTemp("", "jag_test")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempdir)
+	path := filepath.Join(tempdir, "stop.toit")
+	if err := os.WriteFile(path, []byte("main:\n"), 0644); err != nil {
+		return err
+	}
+
+	output, err := wait.open(ctx, device)
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+	if err := sendCode(ctx, device, sdk, "/run", path, "", nil, "", -1, io.Discard, io.Discard); err != nil {
+		return err
+	}
+	return waitForProgram(ctx, output, io.Discard, stopProgramTimeout)
+}
+
+// runTestOnHost runs a test on the host. The timeout includes building the
+// test. A timeout of 0 waits forever.
+func runTestOnHost(ctx context.Context, sdk *SDK, program *hostProgram, out io.Writer, timeout time.Duration) error {
+	runCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	runCmd, cleanup, err := program.command(runCtx, sdk, out, out)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	runCmd.Stdout = out
+	runCmd.Stderr = out
+	err = runCmd.Run()
+	if runCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		return &ExitCodeError{Code: timeoutExitCode, Reason: fmt.Sprintf("the program didn't stop within %v", timeout)}
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() > 0 {
+		return &ExitCodeError{Code: exitErr.ExitCode()}
+	}
+	return err
+}
+
+// writeTestReport writes a report of the results to the given path, or
+// to stdout if the path is "-".
+func writeTestReport(stdout io.Writer, path string, results []*testResult, write func(io.Writer, []*testResult) error) error {
+	if path == "-" {
+		return write(stdout, results)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := write(file, results); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Time     string           `xml:"time,attr"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Output  string `xml:",chardata"`
+}
+
+func junitSeconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// writeJUnit writes the results as JUnit XML. All tests are in a single
+// suite.
+func writeJUnit(w io.Writer, results []*testResult) error {
+	suite := junitTestSuite{Name: "jag test"}
+	var total time.Duration
+	for _, result := range results {
+		testCase := junitTestCase{
+			Name:      result.name,
+			ClassName: strings.TrimSuffix(filepath.ToSlash(result.name), ".toit"),
+			Time:      junitSeconds(result.duration),
+		}
+		if result.passed() {
+			testCase.SystemOut = string(result.output)
+		} else {
+			suite.Failures++
+			testCase.Failure = &junitFailure{Message: result.err.Error(), Output: string(result.output)}
+		}
+		suite.Cases = append(suite.Cases, testCase)
+		total += result.duration
+	}
+	suite.Tests = len(results)
+	suite.Time = junitSeconds(total)
+	suites := junitTestSuites{
+		Suites:   []junitTestSuite{suite},
+		Tests:    suite.Tests,
+		Failures: suite.Failures,
+		Time:     suite.Time,
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(suites); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// writeTap writes the results in version 13 of the Test Anything Protocol.
+// The output of failing tests is included as YAML block.
+func writeTap(w io.Writer, results []*testResult) error {
+	var buffer bytes.Buffer
+	fmt.Fprintf(&buffer, "TAP version 13\n1..%d\n", len(results))
+	for i, result := range results {
+		if result.passed() {
+			fmt.Fprintf(&buffer, "ok %d - %s\n", i+1, result.name)
+			continue
+		}
+		fmt.Fprintf(&buffer, "not ok %d - %s\n", i+1, result.name)
+		fmt.Fprintf(&buffer, "  ---\n  message: %q\n  duration_ms: %d\n", result.err.Error(), result.duration.Milliseconds())
+		if len(result.output) > 0 {
+			buffer.WriteString("  output: |\n")
+			for _, line := range strings.Split(strings.TrimRight(string(result.output), "\n"), "\n") {
+				fmt.Fprintf(&buffer, "    %s\n", line)
+			}
+		}
+		buffer.WriteString("  ...\n")
+	}
+	_, err := w.Write(buffer.Bytes())
+	return err
+}
@@ -0,0 +1,268 @@
+// Copyright (C) 2026 Toit contributors.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/toitlang/jaguar/cmd/jag/directory"
+	"github.com/toitlang/jaguar/cmd/jag/fakedevice"
+)
+
+func TestDiscoverTests(t *testing.T) {
+	dir := t.TempDir()
+	files := []string{
+		"b_test.toit",
+		"a_test.toit",
+		"helper.toit",
+		"sub/c_test.toit",
+		".git/d_test.toit",
+		".packages/e_test.toit",
+		"packages/f_test.toit",
+	}
+	for _, file := range files {
+		path := filepath.Join(dir, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("main:\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := discoverTests([]string{dir, filepath.Join(dir, "helper.toit"), filepath.Join(dir, "a_test.toit")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		filepath.Join(dir, "a_test.toit"),
+		filepath.Join(dir, "b_test.toit"),
+		filepath.Join(dir, "sub", "c_test.toit"),
+		filepath.Join(dir, "helper.toit"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if _, err := discoverTests([]string{filepath.Join(dir, "missing")}); err == nil {
+		t.Error("discovered tests in a missing directory")
+	}
+}
+
+func testResults() []*testResult {
+	return []*testResult{
+		{name: "tests/a_test.toit", duration: 1500 * time.Millisecond, output: []byte("fine\n")},
+		{name: "tests/b_test.toit", duration: 250 * time.Millisecond, output: []byte("line 1\nline 2\n"), err: &ExitCodeError{Code: 1}},
+	}
+}
+
+func TestWriteJUnit(t *testing.T) {
+	var buffer bytes.Buffer
+	if err := writeJUnit(&buffer, testResults()); err != nil {
+		t.Fatal(err)
+	}
+	var suites junitTestSuites
+	if err := xml.Unmarshal(buffer.Bytes(), &suites); err != nil {
+		t.Fatal(err)
+	}
+	if suites.Tests != 2 || suites.Failures != 1 || suites.Time != "1.750" || len(suites.Suites) != 1 {
+		t.Fatalf("got %+v", suites)
+	}
+	cases := suites.Suites[0].Cases
+	if len(cases) != 2 || cases[0].ClassName != "tests/a_test" || cases[0].Failure != nil || cases[0].SystemOut != "fine\n" {
+		t.Errorf("got %+v for the passing test", cases[0])
+	}
+	if failure := cases[1].Failure; failure == nil || failure.Message != "the program exited with code 1" || failure.Output != "line 1\nline 2\n" {
+		t.Errorf("got %+v for the failing test", cases[1])
+	}
+}
+
+func TestWriteTap(t *testing.T) {
+	var buffer bytes.Buffer
+	if err := writeTap(&buffer, testResults()); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		"TAP version 13",
+		"1..2",
+		"ok 1 - tests/a_test.toit",
+		"not ok 2 - tests/b_test.toit",
+		"  ---",
+		`  message: "the program exited with code 1"`,
+		"  duration_ms: 250",
+		"  output: |",
+		"    line 1",
+		"    line 2",
+		"  ...",
+		"",
+	}, "\n")
+	if got := buffer.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// fakeToitSDK returns an SDK with a 'toit' executable that runs the given
+// test files as shell scripts, and fails to compile anything.
+func fakeToitSDK(t *testing.T) *SDK {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake SDK is a shell script")
+	}
+	sdk := &SDK{Path: t.TempDir(), Version: "v2.0.0"}
+	script := `#!/bin/sh
+case "$1" in
+  run)
+    for arg; do file="$arg"; done
+    exec sh "$file"
+    ;;
+  compile)
+    echo "error: unexpected token" >&2
+    exit 1
+    ;;
+esac
+exit 2
+`
+	if err := os.MkdirAll(filepath.Dir(sdk.ToitPath()), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(sdk.ToitPath(), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return sdk
+}
+
+func TestTestCmdOnHost(t *testing.T) {
+	sdk := fakeToitSDK(t)
+	dir := t.TempDir()
+	tests := map[string]string{
+		"pass_test.toit": "echo fine\n",
+		"fail_test.toit": "echo broken\nexit 3\n",
+		"slow_test.toit": "exec sleep 5\n",
+	}
+	for name, content := range tests {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	junit := filepath.Join(t.TempDir(), "results.xml")
+
+	cmd := TestCmd()
+	cmd.SetArgs([]string{"-d", "host", "--timeout", "500ms", "--junit", junit, dir})
+	cmd.SilenceErrors = true
+	err := cmd.ExecuteContext(SetSDK(context.Background(), sdk))
+	var exitErr *ExitCodeError
+	if !errors.As(err, &exitErr) || exitErr.Code != 1 || exitErr.Error() != "2 of 3 tests failed" {
+		t.Fatalf("got %v", err)
+	}
+
+	encoded, err := os.ReadFile(junit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var suites junitTestSuites
+	if err := xml.Unmarshal(encoded, &suites); err != nil {
+		t.Fatal(err)
+	}
+	failures := map[string]*junitFailure{}
+	for _, testCase := range suites.Suites[0].Cases {
+		failures[filepath.Base(testCase.Name)] = testCase.Failure
+	}
+	if failures["pass_test.toit"] != nil {
+		t.Errorf("got failure %+v for the passing test", failures["pass_test.toit"])
+	}
+	if failure := failures["fail_test.toit"]; failure == nil || failure.Message != "the program exited with code 3" || failure.Output != "broken\n" {
+		t.Errorf("got failure %+v for the failing test", failure)
+	}
+	if failure := failures["slow_test.toit"]; failure == nil || !strings.Contains(failure.Message, "didn't stop within 500ms") {
+		t.Errorf("got failure %+v for the slow test", failure)
+	}
+}
+
+func TestSendCodeCapturesCompileErrors(t *testing.T) {
+	sdk := fakeToitSDK(t)
+	previous, hadPrevious := os.LookupEnv(directory.SnapshotCachePathEnv)
+	os.Setenv(directory.SnapshotCachePathEnv, t.TempDir())
+	defer func() {
+		if hadPrevious {
+			os.Setenv(directory.SnapshotCachePathEnv, previous)
+		} else {
+			os.Unsetenv(directory.SnapshotCachePathEnv)
+		}
+	}()
+	fake, device := newFakeDevice(t, fakedevice.Config{SDKVersion: sdk.Version})
+
+	var out bytes.Buffer
+	err := sendCode(context.Background(), device, sdk, "/run", "broken_test.toit", "", nil, "", -1, &out, &out)
+	var reported *reportedError
+	if !errors.As(err, &reported) {
+		t.Errorf("got %v for a program that doesn't compile", err)
+	}
+	if !strings.Contains(out.String(), "error: unexpected token") {
+		t.Errorf("got output %q", out.String())
+	}
+	if requests := fake.Requests(); len(requests) != 0 {
+		t.Errorf("sent requests %v for a program that doesn't compile", requests)
+	}
+}
+
+func TestTestCmdReportsOnStdout(t *testing.T) {
+	sdk := fakeToitSDK(t)
+	dir := t.TempDir()
+	tests := map[string]string{
+		"pass_test.toit": "echo fine\n",
+		"fail_test.toit": "echo broken\nexit 3\n",
+	}
+	for name, content := range tests {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx := SetSDK(context.Background(), sdk)
+	run := func(args ...string) (string, string) {
+		t.Helper()
+		var stdout, stderr bytes.Buffer
+		cmd := TestCmd()
+		cmd.SetArgs(append(append([]string{"-d", "host", "-v"}, args...), dir))
+		cmd.SetOut(&stdout)
+		cmd.SetErr(&stderr)
+		cmd.SilenceErrors = true
+		if err := cmd.ExecuteContext(ctx); err == nil {
+			t.Fatal("a failing test passed")
+		}
+		return stdout.String(), stderr.String()
+	}
+
+	stdout, stderr := run("--junit", "-")
+	var suites junitTestSuites
+	if err := xml.Unmarshal([]byte(stdout), &suites); err != nil {
+		t.Fatalf("can't parse the JUnit report on stdout: %v\n%s", err, stdout)
+	}
+	if suites.Tests != 2 || suites.Failures != 1 {
+		t.Errorf("got %+v", suites)
+	}
+	if !strings.Contains(stderr, "1 passed, 1 failed") || !strings.Contains(stderr, "fine\n") {
+		t.Errorf("got %q on stderr", stderr)
+	}
+
+	stdout, _ = run("--tap", "-")
+	lines := strings.Split(strings.TrimSuffix(stdout, "\n"), "\n")
+	if lines[0] != "TAP version 13" || lines[1] != "1..2" {
+		t.Fatalf("got TAP report %q", stdout)
+	}
+	for _, line := range lines[2:] {
+		if !strings.HasPrefix(line, "ok ") && !strings.HasPrefix(line, "not ok ") && !strings.HasPrefix(line, "  ") {
+			t.Errorf("got line %q in the TAP report", line)
+		}
+	}
+}
@@ -38,6 +38,9 @@ type SDK struct {
 }
 
 func GetSDK(ctx context.Context) (*SDK, error) {
+	if sdk, ok := ctx.Value(ctxKeySDK).(*SDK); ok {
+		return sdk, nil
+	}
 	info := GetInfo(ctx)
 
 	sdkPath, err := directory.GetSDKPath(info.Version)
@@ -213,14 +216,20 @@ func (s *SDK) Stacktrace(ctx context.Context, args ...string) *exec.Cmd {
 }
 
 func (s *SDK) Compile(ctx context.Context, snapshot string, entrypoint string, optimizationLevel int) error {
+	return s.compile(ctx, snapshot, entrypoint, optimizationLevel, os.Stdout, os.Stderr)
+}
+
+// compile is like Compile, but writes the output of the compiler to the
+// given writers.
+func (s *SDK) compile(ctx context.Context, snapshot string, entrypoint string, optimizationLevel int, stdout io.Writer, stderr io.Writer) error {
 	var buildSnap *exec.Cmd
 	if optimizationLevel >= 0 {
 		buildSnap = s.ToitCompile(ctx, "--snapshot", "-o", snapshot, "-O"+strconv.Itoa(optimizationLevel), entrypoint)
 	} else {
 		buildSnap = s.ToitCompile(ctx, "--snapshot", "-o", snapshot, entrypoint)
 	}
-	buildSnap.Stderr = os.Stderr
-	buildSnap.Stdout = os.Stdout
+	buildSnap.Stderr = stderr
+	buildSnap.Stdout = stdout
 	if err := buildSnap.Run(); err != nil {
 		return err
 	}
@@ -228,6 +237,17 @@ func (s *SDK) Compile(ctx context.Context, snapshot string, entrypoint string, o
 }
 
 func (s *SDK) Build(ctx context.Context, device Device, snapshotPath string, assetsPath string) ([]byte, error) {
+	return s.BuildImage(ctx, device.WordSize(), snapshotPath, assetsPath)
+}
+
+// BuildImage builds an image for devices with the given word size.
+func (s *SDK) BuildImage(ctx context.Context, wordSize int, snapshotPath string, assetsPath string) ([]byte, error) {
+	return s.buildImage(ctx, wordSize, snapshotPath, assetsPath, os.Stdout, os.Stderr)
+}
+
+// buildImage is like BuildImage, but writes the output of the tool to the
+// given writers.
+func (s *SDK) buildImage(ctx context.Context, wordSize int, snapshotPath string, assetsPath string, stdout io.Writer, stderr io.Writer) ([]byte, error) {
 	image, err := os.CreateTemp("", "*.image")
 	if err != nil {
 		return nil, err
@@ -236,7 +256,7 @@ func (s *SDK) Build(ctx context.Context, device Device, snapshotPath string, ass
 	defer os.Remove(image.Name())
 
 	bits := "-m32"
-	if device.WordSize() == 8 {
+	if wordSize == 8 {
 		bits = "-m64"
 	}
 
@@ -249,8 +269,8 @@ func (s *SDK) Build(ctx context.Context, device Device, snapshotPath string, ass
 		arguments = append(arguments, "--assets", assetsPath)
 	}
 	buildImage := s.SnapshotToImage(ctx, arguments...)
-	buildImage.Stderr = os.Stderr
-	buildImage.Stdout = os.Stdout
+	buildImage.Stderr = stderr
+	buildImage.Stdout = stdout
 	if err := buildImage.Run(); err != nil {
 		return nil, err
 	}
@@ -650,6 +670,16 @@ func (p *ProgressReader) Read(buffer []byte) (n int, err error) {
 	return n, err
 }
 
+// SetProgress sets the number of bytes that have been processed, for
+// transfers where the progress is reported by the other side.
+func (p *ProgressReader) SetProgress(current int64) {
+	if current <= p.current {
+		return
+	}
+	p.current = current
+	p.update()
+}
+
 func (p *ProgressReader) Close() error {
 	if closer, ok := p.reader.(io.ReadCloser); ok {
 		return closer.Close()
@@ -58,21 +58,25 @@ func WatchCmd() *cobra.Command {
 				}
 			}
 
+			programAssetsPath, err := GetProgramAssetsPath(cmd.Flags(), "assets")
+			if err != nil {
+				return err
+			}
+
 			var run func(context.Context) error
 			if name, ok := deviceSelect.(deviceNameSelect); ok && string(name) == "host" {
 				run = func(runCtx context.Context) error {
-					err := runOnHostWithSDK(runCtx, sdk, []string{entrypoint}, optimizationLevel, "")
+					err := runOnHostWithSDK(runCtx, sdk, &hostProgram{
+						args:              []string{entrypoint},
+						optimizationLevel: optimizationLevel,
+						assetsPath:        programAssetsPath,
+					})
 					if runCtx.Err() != nil {
 						return nil
 					}
 					return err
 				}
 			} else {
-				programAssetsPath, err := GetProgramAssetsPath(cmd.Flags(), "assets")
-				if err != nil {
-					return err
-				}
-
 				device, err := GetDevice(ctx, sdk, true, deviceSelect)
 				if err != nil {
 					return err
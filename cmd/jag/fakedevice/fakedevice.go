@@ -0,0 +1,346 @@
+// Copyright (C) 2026 Toit contributors.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+// Package fakedevice provides a Jaguar device that runs in the process of
+// a test. It speaks the HTTP protocol of the devices, records the requests
+// it gets, and fails requests on demand.
+package fakedevice
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/toitware/ubjson"
+)
+
+// The headers of the device protocol.
+const (
+	deviceIDHeader      = "X-Jaguar-Device-ID"
+	sdkVersionHeader    = "X-Jaguar-SDK-Version"
+	containerNameHeader = "X-Jaguar-Container-Name"
+	crc32Header         = "X-Jaguar-CRC32"
+)
+
+// Config is the identity of a fake device. Empty fields get defaults.
+type Config struct {
+	ID              string
+	Name            string
+	Chip            string
+	SDKVersion      string
+	WordSize        int
+	ProtocolVersion int
+	Features        []string
+}
+
+// Request is a request the device got.
+type Request struct {
+	Method string
+	Path   string
+	Header http.Header
+	Body   []byte
+}
+
+// Failure describes how a request fails.
+type Failure struct {
+	// Status is the status of the response, if the request isn't dropped.
+	Status int
+	// Drop closes the connection without a response.
+	Drop bool
+	// Delay is waited before the request fails.
+	Delay time.Duration
+}
+
+// Device is a fake Jaguar device with an HTTP server on the loopback
+// interface.
+type Device struct {
+	config Config
+	server *httptest.Server
+
+	mu         sync.Mutex
+	requests   []Request
+	failures   map[string][]Failure
+	containers map[string]string
+	images     map[string][]byte
+	firmware   []byte
+}
+
+// New starts a fake device. It must be closed with Close.
+func New(config Config) *Device {
+	if config.ID == "" {
+		config.ID = uuid.New().String()
+	}
+	if config.Name == "" {
+		config.Name = "fake-device"
+	}
+	if config.Chip == "" {
+		config.Chip = "esp32"
+	}
+	if config.WordSize == 0 {
+		config.WordSize = 4
+	}
+	if config.ProtocolVersion == 0 {
+		config.ProtocolVersion = 1
+	}
+	if config.Features == nil {
+		config.Features = []string{}
+	}
+	d := &Device{
+		config:     config,
+		failures:   map[string][]Failure{},
+		containers: map[string]string{},
+		images:     map[string][]byte{},
+	}
+	d.server = httptest.NewServer(http.HandlerFunc(d.serve))
+	return d
+}
+
+// Close stops the device.
+func (d *Device) Close() {
+	d.server.Close()
+}
+
+// ID returns the id of the device.
+func (d *Device) ID() string {
+	return d.config.ID
+}
+
+// Name returns the name of the device.
+func (d *Device) Name() string {
+	return d.config.Name
+}
+
+// Address returns the URL of the HTTP server of the device.
+func (d *Device) Address() string {
+	return d.server.URL
+}
+
+// Identity returns the identity the device announces, like the payload of
+// its broadcasts and '/identify' responses.
+func (d *Device) Identity() map[string]interface{} {
+	return map[string]interface{}{
+		"name":            d.config.Name,
+		"id":              d.config.ID,
+		"chip":            d.config.Chip,
+		"sdkVersion":      d.config.SDKVersion,
+		"address":         d.Address(),
+		"wordSize":        d.config.WordSize,
+		"protocolVersion": d.config.ProtocolVersion,
+		"features":        d.config.Features,
+	}
+}
+
+func (d *Device) identityMessage() []byte {
+	encoded, err := json.Marshal(map[string]interface{}{
+		"method":  "jaguar.identify",
+		"payload": d.Identity(),
+	})
+	if err != nil {
+		panic(err)
+	}
+	return encoded
+}
+
+// Broadcast sends the identity of the device to the given UDP port on the
+// loopback interface every interval, until the context is done.
+func (d *Device) Broadcast(ctx context.Context, port int, interval time.Duration) error {
+	conn, err := net.Dial("udp4", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	message := d.identityMessage()
+	for {
+		// Nobody might be listening yet, so errors are ignored.
+		conn.Write(message)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Fail makes the next request for the given path fail. Several failures
+// for the same path are used in order.
+func (d *Device) Fail(path string, failure Failure) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.failures[path] = append(d.failures[path], failure)
+}
+
+// FailNext makes the next request for the given path fail with the given
+// status.
+func (d *Device) FailNext(path string, status int) {
+	d.Fail(path, Failure{Status: status})
+}
+
+// Requests returns the requests the device got, in order.
+func (d *Device) Requests() []Request {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]Request{}, d.requests...)
+}
+
+// Containers returns the installed containers as a map from id to name.
+func (d *Device) Containers() map[string]string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	result := map[string]string{}
+	for id, name := range d.containers {
+		result[id] = name
+	}
+	return result
+}
+
+// Image returns the image of the container with the given name, or nil.
+func (d *Device) Image(name string) []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.images[name]
+}
+
+// Firmware returns the last firmware the device got, or nil.
+func (d *Device) Firmware() []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.firmware
+}
+
+func (d *Device) serve(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	d.mu.Lock()
+	d.requests = append(d.requests, Request{
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Header: r.Header.Clone(),
+		Body:   body,
+	})
+	var failure *Failure
+	if pending := d.failures[r.URL.Path]; len(pending) > 0 {
+		failure = &pending[0]
+		d.failures[r.URL.Path] = pending[1:]
+	}
+	d.mu.Unlock()
+
+	if failure != nil {
+		d.fail(w, r, failure)
+		return
+	}
+
+	path := r.URL.Path
+	if path == "/identify" && r.Method == http.MethodGet {
+		writeResponse(w, "application/json", d.identityMessage())
+		return
+	}
+	if id := r.Header.Get(deviceIDHeader); id != d.config.ID {
+		http.Error(w, fmt.Sprintf("Device has id '%s', jag is trying to talk to '%s'", d.config.ID, id), http.StatusForbidden)
+		return
+	}
+
+	switch {
+	case path == "/ping" && r.Method == http.MethodGet:
+		respondOk(w)
+
+	case path == "/list" && r.Method == http.MethodGet:
+		encoded, err := ubjson.Marshal(d.Containers())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeResponse(w, "application/ubjson", encoded)
+
+	case path == "/uninstall" && r.Method == http.MethodPut:
+		name := r.Header.Get(containerNameHeader)
+		d.mu.Lock()
+		for id, installed := range d.containers {
+			if installed == name {
+				delete(d.containers, id)
+			}
+		}
+		delete(d.images, name)
+		d.mu.Unlock()
+		respondOk(w)
+
+	case path == "/firmware" && r.Method == http.MethodPut:
+		d.mu.Lock()
+		d.firmware = body
+		d.mu.Unlock()
+		respondOk(w)
+
+	case (path == "/install" || path == "/run") && r.Method == http.MethodPut:
+		if version := r.Header.Get(sdkVersionHeader); version != d.config.SDKVersion {
+			http.Error(w, fmt.Sprintf("Device has %s, jag has %s", d.config.SDKVersion, version), http.StatusNotAcceptable)
+			return
+		}
+		if header := r.Header.Get(crc32Header); header != strconv.FormatUint(uint64(crc32.ChecksumIEEE(body)), 10) {
+			http.Error(w, "CRC32 mismatch", http.StatusBadRequest)
+			return
+		}
+		if path == "/install" {
+			name := r.Header.Get(containerNameHeader)
+			d.mu.Lock()
+			for id, installed := range d.containers {
+				if installed == name {
+					delete(d.containers, id)
+				}
+			}
+			d.containers[uuid.New().String()] = name
+			d.images[name] = body
+			d.mu.Unlock()
+		}
+		respondOk(w)
+
+	default:
+		http.Error(w, "Not found: "+path, http.StatusNotFound)
+	}
+}
+
+func (d *Device) fail(w http.ResponseWriter, r *http.Request, failure *Failure) {
+	if failure.Delay > 0 {
+		select {
+		case <-time.After(failure.Delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if failure.Drop {
+		if hijacker, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hijacker.Hijack(); err == nil {
+				conn.Close()
+				return
+			}
+		}
+		panic(http.ErrAbortHandler)
+	}
+	status := failure.Status
+	if status == 0 {
+		status = http.StatusInternalServerError
+	}
+	http.Error(w, "injected failure", status)
+}
+
+func writeResponse(w http.ResponseWriter, contentType string, body []byte) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Write(body)
+}
+
+func respondOk(w http.ResponseWriter) {
+	writeResponse(w, "application/json", []byte(`{ "status": "OK" }`))
+}
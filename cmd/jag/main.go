@@ -6,6 +6,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"os"
 
 	"github.com/toitlang/jaguar/cmd/jag/commands"
@@ -33,6 +34,10 @@ func main() {
 	ctx := commands.SetInfo(context.Background(), info)
 	cmd := commands.JagCmd(info, isReleaseBuild)
 	if err := cmd.ExecuteContext(ctx); err != nil {
+		var exitCodeErr *commands.ExitCodeError
+		if errors.As(err, &exitCodeErr) && exitCodeErr.Code > 0 && exitCodeErr.Code < 256 {
+			os.Exit(exitCodeErr.Code)
+		}
 		os.Exit(1)
 	}
 }